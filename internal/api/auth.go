@@ -0,0 +1,358 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"image-preheat/internal/config"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// 路由鉴权策略
+const (
+	// PolicyPublic 不鉴权
+	PolicyPublic = "public"
+	// PolicyAuthenticated 通过鉴权且在允许列表中的调用方（API_AUTH_ALLOWED_USERS/GROUPS），节点身份总是允许
+	PolicyAuthenticated = "authenticated"
+	// PolicyPeer 仅其他节点（共享 token、本服务 ServiceAccount 或经 mTLS 校验的客户端证书）
+	PolicyPeer = "peer"
+)
+
+// defaultPolicies 默认路由策略，未列出的路由为 authenticated
+var defaultPolicies = map[string]string{
+	"/health":          PolicyPublic,
+	"/metrics":         PolicyPublic,
+	"/images/check":    PolicyPeer,
+	"/images/download": PolicyPeer,
+	"/images/layers":   PolicyPeer,
+	"/layers/check":    PolicyPeer,
+}
+
+// TokenReview 结果缓存时间，避免每个请求都访问 API Server
+const tokenReviewCacheTTL = time.Minute
+
+// 未命中缓存的 token 每秒最多发起的 TokenReview 次数与突发量，防止无效 token 刷请求压垮 API Server
+const (
+	tokenReviewRate  = 20
+	tokenReviewBurst = 40
+)
+
+// 未通过校验的 token 最多缓存的条数，超出时淘汰最早过期的记录
+const maxNegativeTokenReviews = 1024
+
+// ErrTokenReviewThrottled TokenReview 调用超过速率限制
+var ErrTokenReviewThrottled = errors.New("TokenReview 请求过多")
+
+// Identity 调用方身份
+type Identity struct {
+	Name   string
+	Groups []string
+	Peer   bool
+}
+
+// Authenticator 校验 bearer token。token 不能由该方式识别时返回 nil, nil，由下一个 Authenticator 继续校验；
+// 返回错误表示鉴权服务不可用
+type Authenticator interface {
+	Authenticate(ctx context.Context, token string) (*Identity, error)
+}
+
+var (
+	authenticators []Authenticator
+	routePolicies  = defaultPolicies
+	// authenticated 路由允许的用户名与用户组
+	allowedUsers  map[string]bool
+	allowedGroups map[string]bool
+)
+
+// InitAuth 按 API_AUTH_MODE 初始化鉴权方式，按 API_AUTH_POLICIES 覆盖路由策略；API_AUTH_MODE 为空时不鉴权
+func InitAuth() error {
+	policies := make(map[string]string, len(defaultPolicies))
+	for route, policy := range defaultPolicies {
+		policies[route] = policy
+	}
+	for _, item := range config.APIAuthPolicies {
+		route, policy, ok := strings.Cut(item, "=")
+		switch policy {
+		case PolicyPublic, PolicyAuthenticated, PolicyPeer:
+		default:
+			ok = false
+		}
+		if !ok {
+			return fmt.Errorf("鉴权策略格式错误（应为 <路由>=<public|authenticated|peer>）: %q", item)
+		}
+		policies[route] = policy
+	}
+	routePolicies = policies
+	allowedUsers = toSet(config.APIAuthAllowedUsers)
+	allowedGroups = toSet(config.APIAuthAllowedGroups)
+
+	var chain []Authenticator
+	for _, mode := range config.APIAuthModes {
+		switch mode {
+		case config.APIAuthModeToken:
+			if config.APIAuthToken == "" {
+				return fmt.Errorf("API_AUTH_MODE 包含 token 但未设置 API_AUTH_TOKEN")
+			}
+			chain = append(chain, &staticTokenAuthenticator{token: config.APIAuthToken})
+		case config.APIAuthModeTokenReview:
+			clientset, err := config.NewK8sClientset()
+			if err != nil {
+				return fmt.Errorf("初始化K8s客户端失败: %v", err)
+			}
+			peerUser := ""
+			if config.ServiceAccountName != "" {
+				peerUser = "system:serviceaccount:" + config.K8sNamespace + ":" + config.ServiceAccountName
+			}
+			chain = append(chain, newTokenReviewAuthenticator(clientset, config.APIAuthAudiences, config.PeerTokenAudience, peerUser))
+		default:
+			return fmt.Errorf("未知的鉴权方式: %s", mode)
+		}
+	}
+	// 节点间 token 只通过 HTTPS 发送，未开启 mTLS 时其他节点无法通过 peer 策略，节点间传输全部失败
+	if len(chain) > 0 && !config.PeerTLSEnabled {
+		return fmt.Errorf("启用 API_AUTH_MODE 时必须开启节点间 mTLS（PEER_TLS_ENABLED=true）")
+	}
+	authenticators = chain
+	if len(chain) > 0 {
+		log.Info().Strs("modes", config.APIAuthModes).Interface("policies", policies).
+			Strs("allowed_users", config.APIAuthAllowedUsers).Strs("allowed_groups", config.APIAuthAllowedGroups).Msg("HTTP API 鉴权已启用")
+	}
+	return nil
+}
+
+func toSet(items []string) map[string]bool {
+	set := make(map[string]bool, len(items))
+	for _, item := range items {
+		set[item] = true
+	}
+	return set
+}
+
+// allowed 判断身份是否满足路由策略：peer 只允许节点身份，authenticated 还允许列表中的用户或用户组
+func allowed(identity *Identity, policy string) bool {
+	if identity.Peer {
+		return true
+	}
+	if policy == PolicyPeer {
+		return false
+	}
+	if allowedUsers[identity.Name] {
+		return true
+	}
+	for _, group := range identity.Groups {
+		if allowedGroups[group] {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthMiddleware 按路由策略鉴权：public 直接放行，authenticated 需要有效的 bearer token（或经 mTLS 校验的客户端证书），
+// peer 还要求调用方为其他节点。未启用鉴权时全部放行
+func AuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		policy, ok := routePolicies[c.FullPath()]
+		if !ok {
+			policy = PolicyAuthenticated
+		}
+		if len(authenticators) == 0 || policy == PolicyPublic {
+			c.Next()
+			return
+		}
+		identity, err := authenticate(c)
+		if errors.Is(err, ErrTokenReviewThrottled) {
+			log.Warn().Str("remote", c.RemoteIP()).Str("path", c.FullPath()).Msg("TokenReview 请求过多")
+			c.Header("Retry-After", "1")
+			c.AbortWithStatusJSON(429, gin.H{"error": "鉴权请求过多"})
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Str("path", c.FullPath()).Msg("鉴权服务不可用")
+			c.AbortWithStatusJSON(503, gin.H{"error": "鉴权服务不可用"})
+			return
+		}
+		if identity == nil {
+			log.Warn().Str("remote", c.RemoteIP()).Str("path", c.FullPath()).Msg("请求未通过鉴权")
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatusJSON(401, gin.H{"error": "未授权"})
+			return
+		}
+		if !allowed(identity, policy) {
+			if policy == PolicyPeer {
+				log.Warn().Str("identity", identity.Name).Str("path", c.FullPath()).Msg("非节点调用方访问节点间接口")
+				c.AbortWithStatusJSON(403, gin.H{"error": "仅允许节点间访问"})
+				return
+			}
+			log.Warn().Str("identity", identity.Name).Strs("groups", identity.Groups).Str("path", c.FullPath()).Msg("调用方不在允许列表中")
+			c.AbortWithStatusJSON(403, gin.H{"error": "调用方无权访问"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// authenticate 识别调用方：开启 mTLS 时经校验的客户端证书视为 peer，否则依次用各 Authenticator 校验 bearer token
+func authenticate(c *gin.Context) (*Identity, error) {
+	if config.PeerTLSEnabled && verifiedPeerCertificate(c) == nil {
+		return &Identity{Name: c.Request.TLS.VerifiedChains[0][0].Subject.CommonName, Peer: true}, nil
+	}
+	scheme, token, _ := strings.Cut(c.GetHeader("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return nil, nil
+	}
+	for _, a := range authenticators {
+		identity, err := a.Authenticate(c.Request.Context(), token)
+		if err != nil || identity != nil {
+			return identity, err
+		}
+	}
+	return nil, nil
+}
+
+// staticTokenAuthenticator 共享 bearer token，各节点使用同一 token 互相访问
+type staticTokenAuthenticator struct {
+	token string
+}
+
+func (a *staticTokenAuthenticator) Authenticate(_ context.Context, token string) (*Identity, error) {
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+		return nil, nil
+	}
+	return &Identity{Name: "shared-token", Peer: true}, nil
+}
+
+// tokenReviewAuthenticator 通过 TokenReview 校验 ServiceAccount token，结果按 token 哈希缓存
+// （未通过的结果最多缓存 maxNegativeTokenReviews 条），未命中缓存时按 tokenReviewRate 限速。
+// 先按节点间专用 audience 校验：本服务 ServiceAccount 的该 audience token 视为 peer；
+// 否则按调用方 audience 校验，得到的身份不视为 peer
+type tokenReviewAuthenticator struct {
+	clientset kubernetes.Interface
+	audiences []string
+	// 节点间 token 的 audience
+	peerAudience string
+	// 视为 peer 的用户名（本服务的 ServiceAccount）
+	peerUser string
+
+	limiter *rate.Limiter
+
+	mu    sync.Mutex
+	cache map[[32]byte]tokenReviewResult
+	// cache 中未通过校验的条数
+	negatives int
+}
+
+type tokenReviewResult struct {
+	identity *Identity
+	expires  time.Time
+}
+
+func newTokenReviewAuthenticator(clientset kubernetes.Interface, audiences []string, peerAudience, peerUser string) *tokenReviewAuthenticator {
+	return &tokenReviewAuthenticator{
+		clientset:    clientset,
+		audiences:    audiences,
+		peerAudience: peerAudience,
+		peerUser:     peerUser,
+		limiter:      rate.NewLimiter(tokenReviewRate, tokenReviewBurst),
+		cache:        make(map[[32]byte]tokenReviewResult),
+	}
+}
+
+func (a *tokenReviewAuthenticator) Authenticate(ctx context.Context, token string) (*Identity, error) {
+	key := sha256.Sum256([]byte(token))
+	now := time.Now()
+	a.mu.Lock()
+	if r, ok := a.cache[key]; ok && now.Before(r.expires) {
+		a.mu.Unlock()
+		return r.identity, nil
+	}
+	a.mu.Unlock()
+	if !a.limiter.Allow() {
+		return nil, ErrTokenReviewThrottled
+	}
+
+	var identity *Identity
+	if a.peerUser != "" && a.peerAudience != "" {
+		user, err := a.review(ctx, token, []string{a.peerAudience})
+		if err != nil {
+			return nil, err
+		}
+		if user != nil && user.Username == a.peerUser {
+			identity = &Identity{Name: user.Username, Groups: user.Groups, Peer: true}
+		}
+	}
+	if identity == nil {
+		user, err := a.review(ctx, token, a.audiences)
+		if err != nil {
+			return nil, err
+		}
+		if user != nil {
+			identity = &Identity{Name: user.Username, Groups: user.Groups}
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.store(key, tokenReviewResult{identity: identity, expires: now.Add(tokenReviewCacheTTL)}, now)
+	return identity, nil
+}
+
+// store 缓存校验结果并清理过期记录；未通过校验的记录超过 maxNegativeTokenReviews 时淘汰最早过期的一条
+func (a *tokenReviewAuthenticator) store(key [32]byte, result tokenReviewResult, now time.Time) {
+	for k, r := range a.cache {
+		if now.After(r.expires) {
+			a.remove(k)
+		}
+	}
+	a.remove(key)
+	if result.identity == nil && a.negatives >= maxNegativeTokenReviews {
+		var oldest [32]byte
+		var oldestExpires time.Time
+		for k, r := range a.cache {
+			if r.identity == nil && (oldestExpires.IsZero() || r.expires.Before(oldestExpires)) {
+				oldest, oldestExpires = k, r.expires
+			}
+		}
+		a.remove(oldest)
+	}
+	a.cache[key] = result
+	if result.identity == nil {
+		a.negatives++
+	}
+}
+
+func (a *tokenReviewAuthenticator) remove(key [32]byte) {
+	r, ok := a.cache[key]
+	if !ok {
+		return
+	}
+	delete(a.cache, key)
+	if r.identity == nil {
+		a.negatives--
+	}
+}
+
+// review 按 audiences 校验 token，未通过时返回 nil
+func (a *tokenReviewAuthenticator) review(ctx context.Context, token string, audiences []string) (*authenticationv1.UserInfo, error) {
+	review, err := a.clientset.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token, Audiences: audiences},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("TokenReview 失败: %v", err)
+	}
+	if !review.Status.Authenticated {
+		return nil, nil
+	}
+	return &review.Status.User, nil
+}
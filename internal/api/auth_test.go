@@ -0,0 +1,187 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"image-preheat/internal/config"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const testPeerUser = "system:serviceaccount:kube-system:image-preheat"
+
+// testTokens token -> 签发时的 audience 与用户
+var testTokens = map[string]struct {
+	audience string
+	user     authenticationv1.UserInfo
+}{
+	"peer-token":    {"image-preheat-peer", authenticationv1.UserInfo{Username: testPeerUser}},
+	"default-token": {"api", authenticationv1.UserInfo{Username: testPeerUser}},
+	"ops-token":     {"api", authenticationv1.UserInfo{Username: "system:serviceaccount:ops:client", Groups: []string{"system:serviceaccounts:ops"}}},
+	"other-token":   {"api", authenticationv1.UserInfo{Username: "system:serviceaccount:default:app"}},
+}
+
+// newFakeTokenReviewer 模拟 API Server 的 TokenReview：token 的 audience 属于请求的 audiences（为空表示默认 audience "api"）时通过
+func newFakeTokenReviewer() *fake.Clientset {
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview).DeepCopy()
+		audiences := review.Spec.Audiences
+		if len(audiences) == 0 {
+			audiences = []string{"api"}
+		}
+		if t, ok := testTokens[review.Spec.Token]; ok {
+			for _, aud := range audiences {
+				if aud == t.audience {
+					review.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: t.user, Audiences: []string{aud}}
+				}
+			}
+		}
+		return true, review, nil
+	})
+	return clientset
+}
+
+func setupAuth(t *testing.T, users, groups []string) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	authenticators = []Authenticator{newTokenReviewAuthenticator(newFakeTokenReviewer(), nil, "image-preheat-peer", testPeerUser)}
+	allowedUsers, allowedGroups = toSet(users), toSet(groups)
+	t.Cleanup(func() {
+		authenticators = nil
+		allowedUsers, allowedGroups = nil, nil
+	})
+	r := gin.New()
+	r.Use(AuthMiddleware())
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r.GET("/images/download", ok)
+	r.POST("/images/preheat", ok)
+	return r
+}
+
+func authRequest(r *gin.Engine, method, path, token string) int {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	r.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestAuthPeerAudience(t *testing.T) {
+	r := setupAuth(t, nil, nil)
+	if code := authRequest(r, http.MethodGet, "/images/download", "peer-token"); code != http.StatusOK {
+		t.Fatalf("节点间 audience 的 token 应视为 peer，实际 %d", code)
+	}
+	// 同一 ServiceAccount 的默认 audience token 不是节点身份
+	if code := authRequest(r, http.MethodGet, "/images/download", "default-token"); code != http.StatusForbidden {
+		t.Fatalf("默认 audience 的 token 不应视为 peer，实际 %d", code)
+	}
+	if code := authRequest(r, http.MethodGet, "/images/download", ""); code != http.StatusUnauthorized {
+		t.Fatalf("缺少 token 应返回 401，实际 %d", code)
+	}
+}
+
+func TestAuthAllowList(t *testing.T) {
+	r := setupAuth(t, nil, nil)
+	// 允许列表为空时 authenticated 只接受节点身份
+	if code := authRequest(r, http.MethodPost, "/images/preheat", "ops-token"); code != http.StatusForbidden {
+		t.Fatalf("未列出的 ServiceAccount 应返回 403，实际 %d", code)
+	}
+	if code := authRequest(r, http.MethodPost, "/images/preheat", "peer-token"); code != http.StatusOK {
+		t.Fatalf("节点身份应允许，实际 %d", code)
+	}
+
+	r = setupAuth(t, nil, []string{"system:serviceaccounts:ops"})
+	if code := authRequest(r, http.MethodPost, "/images/preheat", "ops-token"); code != http.StatusOK {
+		t.Fatalf("允许的用户组应通过，实际 %d", code)
+	}
+	if code := authRequest(r, http.MethodPost, "/images/preheat", "other-token"); code != http.StatusForbidden {
+		t.Fatalf("其他 ServiceAccount 应返回 403，实际 %d", code)
+	}
+	// 允许列表不放开节点间接口
+	if code := authRequest(r, http.MethodGet, "/images/download", "ops-token"); code != http.StatusForbidden {
+		t.Fatalf("允许列表中的调用方不应访问节点间接口，实际 %d", code)
+	}
+
+	r = setupAuth(t, []string{"system:serviceaccount:default:app"}, nil)
+	if code := authRequest(r, http.MethodPost, "/images/preheat", "other-token"); code != http.StatusOK {
+		t.Fatalf("允许的用户应通过，实际 %d", code)
+	}
+}
+
+func TestInitAuthRequiresPeerTLS(t *testing.T) {
+	modes, token, tlsEnabled := config.APIAuthModes, config.APIAuthToken, config.PeerTLSEnabled
+	t.Cleanup(func() {
+		config.APIAuthModes, config.APIAuthToken, config.PeerTLSEnabled = modes, token, tlsEnabled
+		authenticators = nil
+	})
+	config.APIAuthModes, config.APIAuthToken = []string{config.APIAuthModeToken}, "secret"
+
+	config.PeerTLSEnabled = false
+	if err := InitAuth(); err == nil {
+		t.Fatal("启用鉴权但未开启节点间 mTLS 时应拒绝启动")
+	}
+	config.PeerTLSEnabled = true
+	if err := InitAuth(); err != nil {
+		t.Fatalf("开启节点间 mTLS 时应正常初始化: %v", err)
+	}
+}
+
+func TestTokenReviewRateLimit(t *testing.T) {
+	r := setupAuth(t, nil, nil)
+	// 先缓存节点身份，限速后仍可通过
+	if code := authRequest(r, http.MethodGet, "/images/download", "peer-token"); code != http.StatusOK {
+		t.Fatalf("节点身份应允许，实际 %d", code)
+	}
+	throttled := false
+	for i := 0; i < tokenReviewBurst*2; i++ {
+		code := authRequest(r, http.MethodGet, "/images/download", fmt.Sprintf("invalid-%d", i))
+		if code == http.StatusTooManyRequests {
+			throttled = true
+			break
+		}
+		if code != http.StatusUnauthorized {
+			t.Fatalf("无效 token 应返回 401，实际 %d", code)
+		}
+	}
+	if !throttled {
+		t.Fatal("大量未缓存的 token 应被限速")
+	}
+	if code := authRequest(r, http.MethodGet, "/images/download", "peer-token"); code != http.StatusOK {
+		t.Fatalf("已缓存的节点身份不应受限速影响，实际 %d", code)
+	}
+}
+
+func TestTokenReviewNegativeCacheBounded(t *testing.T) {
+	a := newTokenReviewAuthenticator(newFakeTokenReviewer(), nil, "image-preheat-peer", testPeerUser)
+	a.limiter.SetLimit(rate.Inf)
+	ctx := context.Background()
+	if identity, err := a.Authenticate(ctx, "peer-token"); err != nil || identity == nil {
+		t.Fatalf("节点身份应通过: %v, %v", identity, err)
+	}
+	for i := 0; i < maxNegativeTokenReviews+10; i++ {
+		if identity, err := a.Authenticate(ctx, fmt.Sprintf("invalid-%d", i)); err != nil || identity != nil {
+			t.Fatalf("无效 token 不应通过: %v, %v", identity, err)
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.negatives != maxNegativeTokenReviews || len(a.cache) != maxNegativeTokenReviews+1 {
+		t.Fatalf("未通过的缓存应限制为 %d 条，实际 %d（共 %d 条）", maxNegativeTokenReviews, a.negatives, len(a.cache))
+	}
+	if _, ok := a.cache[sha256.Sum256([]byte("peer-token"))]; !ok {
+		t.Fatal("淘汰未通过的记录时不应删除通过的记录")
+	}
+}
@@ -1,43 +1,61 @@
 package api
 
 import (
+	"errors"
+
 	"image-preheat/internal/config"
+	"image-preheat/internal/docker"
 	"image-preheat/internal/preheat"
+	"image-preheat/internal/task"
 
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog/log"
 )
 
-// Gin 版本的镜像查询接口
+// Gin 版本的镜像查询接口，可选参数 platform：本地镜像平台不一致时视为不存在
 func ImageCheckHandlerGin(c *gin.Context) {
 	image := c.Query("image")
-	log.Info().Str("image", image).Str("path", c.FullPath()).Msg("收到镜像存在性检查请求")
+	platform := c.Query("platform")
+	log.Info().Str("image", image).Str("platform", platform).Str("path", c.FullPath()).Msg("收到镜像存在性检查请求")
 	if image == "" {
 		log.Warn().Str("path", c.FullPath()).Msg("缺少镜像名参数")
 		c.JSON(400, gin.H{"error": "缺少镜像名参数"})
 		return
 	}
 
-	localImages, err := preheat.GetAllLocalImages()
+	localImages, err := preheat.GetAllLocalImages(c.Request.Context())
 	if err != nil {
 		log.Error().Err(err).Str("image", image).Msg("获取本地镜像失败")
 		c.JSON(500, gin.H{"error": "获取本地镜像失败"})
 		return
 	}
-	_, exists := localImages[image]
+	// 节点间加载的 digest 固定镜像只有镜像 ID，按请求携带的 id 查找
+	image = preheat.LocalImageRef(c.Request.Context(), image, c.Query("id"))
+	exists := docker.HasImage(localImages, image)
 	if exists {
+		local, err := preheat.CheckImagePlatform(c.Request.Context(), image, platform)
+		if errors.Is(err, preheat.ErrPlatformMismatch) {
+			log.Info().Str("image", image).Str("local_platform", local).Str("platform", platform).Msg("本地镜像平台不一致")
+			c.JSON(404, gin.H{"exists": false, "platform": local})
+			return
+		}
+		if err != nil {
+			log.Warn().Err(err).Str("image", image).Msg("获取镜像平台失败")
+		}
 		log.Info().Str("image", image).Msg("镜像存在于本地")
-		c.JSON(200, gin.H{"exists": true})
+		c.JSON(200, gin.H{"exists": true, "platform": local})
 	} else {
 		log.Info().Str("image", image).Msg("镜像不存在于本地")
 		c.JSON(404, gin.H{"exists": false})
 	}
 }
 
-// Gin 版本的镜像下载接口，通过 docker save 流式输出
+// Gin 版本的镜像下载接口：启用下载产物缓存时按缓存的归档文件提供（支持 Range、ETag 续传），否则通过 docker save 流式输出；
+// 指定 platform 且本地镜像平台不一致时返回 409，避免向其他平台的节点传输错误的镜像
 func ImageDownloadHandlerGin(c *gin.Context) {
 	image := c.Query("image")
-	log.Info().Str("image", image).Str("path", c.FullPath()).Msg("收到镜像下载请求")
+	platform := c.Query("platform")
+	log.Info().Str("image", image).Str("platform", platform).Str("path", c.FullPath()).Msg("收到镜像下载请求")
 	if !preheat.AcquireDownloadAPISlotNonBlock() {
 		log.Warn().Str("image", image).Msg("下载接口繁忙，拒绝服务")
 		c.JSON(429, gin.H{"error": "服务繁忙，请稍后重试"})
@@ -50,11 +68,47 @@ func ImageDownloadHandlerGin(c *gin.Context) {
 		c.JSON(400, gin.H{"error": "缺少镜像名参数"})
 		return
 	}
+	image = preheat.LocalImageRef(c.Request.Context(), image, c.Query("id"))
+	if platform != "" {
+		local, err := preheat.CheckImagePlatform(c.Request.Context(), image, platform)
+		if errors.Is(err, preheat.ErrPlatformMismatch) {
+			log.Warn().Str("image", image).Str("local_platform", local).Str("platform", platform).Msg("本地镜像平台不一致，拒绝下载")
+			c.JSON(409, gin.H{"error": "镜像平台不一致", "platform": local})
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Str("image", image).Msg("获取镜像平台失败")
+			c.JSON(404, gin.H{"error": "镜像不存在"})
+			return
+		}
+	}
+
+	if preheat.DownloadCacheEnabled() {
+		c.Header("Content-Disposition", "attachment; filename="+image+".tar")
+		err := preheat.ServeImageArtifact(c.Writer, c.Request, image, c.Query("base"))
+		if err == nil {
+			return
+		}
+		if !errors.Is(err, preheat.ErrDiskPressure) {
+			log.Error().Err(err).Str("image", image).Msg("镜像下载失败")
+			c.JSON(500, gin.H{"error": "镜像下载失败"})
+			return
+		}
+		// 磁盘空间不足时不缓存产物，直接流式提供（不支持续传）
+		log.Warn().Err(err).Str("image", image).Msg("无法缓存下载产物，改为直接流式提供")
+	}
 
 	c.Header("Content-Type", "application/x-tar")
 	c.Header("Content-Disposition", "attachment; filename="+image+".tar")
 
-	err := preheat.StreamImageToHTTPWithRateLimit(image, c.Writer)
+	// base 非空时仅传输该层链之上的缺失层；客户端断开时请求 ctx 取消，终止 docker save
+	ctx := c.Request.Context()
+	var err error
+	if base := c.Query("base"); base != "" {
+		err = preheat.StreamImageLayersToHTTPWithRateLimit(ctx, image, base, c.Writer)
+	} else {
+		err = preheat.StreamImageToHTTPWithRateLimit(ctx, image, c.Writer)
+	}
 	if err != nil {
 		log.Error().Err(err).Str("image", image).Msg("镜像下载失败")
 		return
@@ -62,6 +116,122 @@ func ImageDownloadHandlerGin(c *gin.Context) {
 	log.Info().Str("image", image).Msg("镜像下载成功")
 }
 
+// 镜像层信息接口，返回镜像的平台与 diffID 列表，供 peer 计算可复用的本地层；
+// 指定 platform 且本地镜像平台不一致时返回 409
+func ImageLayersHandlerGin(c *gin.Context) {
+	image := c.Query("image")
+	platform := c.Query("platform")
+	log.Info().Str("image", image).Str("platform", platform).Str("path", c.FullPath()).Msg("收到镜像层信息请求")
+	if image == "" {
+		log.Warn().Str("path", c.FullPath()).Msg("缺少镜像名参数")
+		c.JSON(400, gin.H{"error": "缺少镜像名参数"})
+		return
+	}
+
+	localImages, err := preheat.GetAllLocalImages(c.Request.Context())
+	if err != nil {
+		log.Error().Err(err).Str("image", image).Msg("获取本地镜像失败")
+		c.JSON(500, gin.H{"error": "获取本地镜像失败"})
+		return
+	}
+	image = preheat.LocalImageRef(c.Request.Context(), image, c.Query("id"))
+	if !docker.HasImage(localImages, image) {
+		c.JSON(404, gin.H{"error": "镜像不存在"})
+		return
+	}
+	info, err := preheat.GetImageLayersInfo(c.Request.Context(), image, platform)
+	if errors.Is(err, preheat.ErrPlatformMismatch) {
+		log.Warn().Err(err).Str("image", image).Msg("本地镜像平台不一致")
+		c.JSON(409, gin.H{"error": "镜像平台不一致"})
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Str("image", image).Msg("获取镜像层信息失败")
+		c.JSON(500, gin.H{"error": "获取镜像层信息失败"})
+		return
+	}
+	c.JSON(200, info)
+}
+
+// 按需预热接口，立即开始预热请求中的镜像并返回任务 ID
+func PreheatHandlerGin(c *gin.Context) {
+	var request struct {
+		Image  string   `json:"image"`
+		Images []string `json:"images"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		log.Warn().Err(err).Str("path", c.FullPath()).Msg("请求参数解析失败")
+		c.JSON(400, gin.H{"error": "请求参数格式错误"})
+		return
+	}
+	images := request.Images
+	if request.Image != "" {
+		images = append(images, request.Image)
+	}
+	log.Info().Strs("images", images).Str("path", c.FullPath()).Msg("收到按需预热请求")
+	if len(images) == 0 {
+		c.JSON(400, gin.H{"error": "缺少镜像名参数"})
+		return
+	}
+	if len(images) > config.MaxImagesPerPreheatRequest {
+		log.Warn().Int("image_count", len(images)).Int("max_allowed", config.MaxImagesPerPreheatRequest).Msg("镜像数量超过限制")
+		c.JSON(400, gin.H{"error": "镜像数量超过限制"})
+		return
+	}
+	job, err := task.GetJobManager().Submit(images)
+	if errors.Is(err, task.ErrTooManyJobs) {
+		log.Warn().Err(err).Msg("创建按需预热任务失败")
+		c.JSON(429, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Warn().Err(err).Msg("创建按需预热任务失败")
+		c.JSON(503, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(202, job)
+}
+
+// 镜像回收报告接口，返回最近一轮回收（或 dry-run）的候选镜像
+func GCReportHandlerGin(c *gin.Context) {
+	if !config.GCEnabled {
+		c.JSON(404, gin.H{"error": "镜像回收未启用"})
+		return
+	}
+	report := task.GetGarbageCollector().Report()
+	if report == nil {
+		c.JSON(404, gin.H{"error": "尚未执行镜像回收"})
+		return
+	}
+	c.JSON(200, report)
+}
+
+// 按需预热任务查询接口
+func JobHandlerGin(c *gin.Context) {
+	job, ok := task.GetJobManager().Get(c.Param("id"))
+	if !ok {
+		c.JSON(404, gin.H{"error": "任务不存在"})
+		return
+	}
+	c.JSON(200, job)
+}
+
+// 回源拉取进度接口，指定 image 时返回单个镜像进度，否则返回全部
+func PullProgressHandlerGin(c *gin.Context) {
+	tracker := preheat.GetPullProgressTracker()
+	image := c.Query("image")
+	if image == "" {
+		c.JSON(200, gin.H{"pulls": tracker.List()})
+		return
+	}
+	progress, ok := tracker.Get(image)
+	if !ok {
+		c.JSON(404, gin.H{"error": "该镜像没有拉取记录"})
+		return
+	}
+	c.JSON(200, progress)
+}
+
 // 健康检查接口
 func HealthCheckHandlerGin(c *gin.Context) {
 	log.Debug().Str("path", c.FullPath()).Msg("健康检查请求")
@@ -70,9 +240,18 @@ func HealthCheckHandlerGin(c *gin.Context) {
 
 // 层状态查询接口
 func LayersCheckHandlerGin(c *gin.Context) {
+	if !preheat.AcquireLayersCheckSlotNonBlock() {
+		log.Warn().Str("path", c.FullPath()).Msg("层状态查询接口繁忙，拒绝服务")
+		c.JSON(429, gin.H{"error": "服务繁忙，请稍后重试"})
+		return
+	}
+	defer preheat.ReleaseLayersCheckSlot()
+
 	var request struct {
 		Image   string   `json:"image" binding:"required"`
 		Digests []string `json:"digests" binding:"required"`
+		// 可选，本地镜像平台不一致时不视为预热镜像，逐层检查
+		Platform string `json:"platform"`
 	}
 
 	if err := c.ShouldBindJSON(&request); err != nil {
@@ -91,18 +270,23 @@ func LayersCheckHandlerGin(c *gin.Context) {
 	}
 
 	// 检查镜像是否存在
-	localImages, err := preheat.GetAllLocalImages()
+	localImages, err := preheat.GetAllLocalImages(c.Request.Context())
 	if err != nil {
 		log.Error().Err(err).Str("image", request.Image).Msg("获取本地镜像失败")
 		c.JSON(500, gin.H{"error": "获取本地镜像失败"})
 		return
 	}
 
-	_, imageExists := localImages[request.Image]
+	imageExists := docker.HasImage(localImages, request.Image)
 	if imageExists {
 		// 镜像存在，检查是否为预热镜像
 		digestManager := preheat.GetPreheatedDigestManager()
-		if digestManager.IsPreheatedImage(request.Image) {
+		platformMismatch := false
+		if request.Platform != "" {
+			_, err := preheat.CheckImagePlatform(c.Request.Context(), request.Image, request.Platform)
+			platformMismatch = errors.Is(err, preheat.ErrPlatformMismatch)
+		}
+		if digestManager.IsPreheatedImage(request.Image) && !platformMismatch {
 			// 镜像存在且为预热镜像，所有层归入preheated_exists
 			log.Info().Str("image", request.Image).Msg("镜像存在且为预热镜像，所有层归入preheated_exists")
 			c.JSON(200, gin.H{
@@ -116,7 +300,7 @@ func LayersCheckHandlerGin(c *gin.Context) {
 	}
 
 	// 镜像不存在或不是预热镜像，逐层检查
-	layerExists, layerMissing, err := preheat.CheckLayersExist(request.Digests)
+	layerExists, layerMissing, err := preheat.CheckLayersExist(c.Request.Context(), request.Digests)
 	if err != nil {
 		log.Error().Err(err).Str("image", request.Image).Msg("层状态查询失败")
 		c.JSON(500, gin.H{"error": "层状态查询失败"})
@@ -0,0 +1,213 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"image-preheat/internal/config"
+	"image-preheat/internal/docker"
+	"image-preheat/internal/preheat"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeDockerClient 测试用 DockerClient：images 为本地镜像，layers 为本地已有的层，digests 为镜像的层 digest
+type fakeDockerClient struct {
+	images    map[string]struct{}
+	layers    map[string]bool
+	digests   map[string][]string
+	platforms map[string]string
+}
+
+func (f *fakeDockerClient) Pull(ctx context.Context, image string, opts docker.PullOptions) error {
+	return nil
+}
+func (f *fakeDockerClient) Save(ctx context.Context, image string, writer io.Writer) error {
+	return nil
+}
+func (f *fakeDockerClient) Load(ctx context.Context, reader io.Reader, platform string) error {
+	return nil
+}
+func (f *fakeDockerClient) GetImages(ctx context.Context) (map[string]struct{}, error) {
+	return f.images, nil
+}
+func (f *fakeDockerClient) ImageExists(ctx context.Context, image string) (bool, error) {
+	return docker.HasImage(f.images, image), nil
+}
+func (f *fakeDockerClient) GetImageDigests(ctx context.Context, image string) ([]string, error) {
+	return f.digests[image], nil
+}
+func (f *fakeDockerClient) CheckLayerExists(ctx context.Context, digest string) (bool, error) {
+	return f.layers[digest], nil
+}
+func (f *fakeDockerClient) CheckLayersExist(ctx context.Context, digests []string) (exists, missing []string, err error) {
+	for _, d := range digests {
+		if f.layers[d] {
+			exists = append(exists, d)
+		} else {
+			missing = append(missing, d)
+		}
+	}
+	return exists, missing, nil
+}
+func (f *fakeDockerClient) GetImageDiffIDs(ctx context.Context, image string) ([]string, error) {
+	return nil, nil
+}
+func (f *fakeDockerClient) LocalLayerChainLength(ctx context.Context, diffIDs []string) (int, error) {
+	return 0, nil
+}
+func (f *fakeDockerClient) GetRepoDigests(ctx context.Context, image string) ([]string, error) {
+	return nil, nil
+}
+func (f *fakeDockerClient) RemoveImage(ctx context.Context, image string) error { return nil }
+func (f *fakeDockerClient) GetImagesInUse(ctx context.Context) (map[string]struct{}, error) {
+	return map[string]struct{}{}, nil
+}
+func (f *fakeDockerClient) GetImagePlatform(ctx context.Context, image string) (string, error) {
+	if p, ok := f.platforms[image]; ok {
+		return p, nil
+	}
+	return "linux/amd64", nil
+}
+func (f *fakeDockerClient) GetImageID(ctx context.Context, image string) (string, error) {
+	return "", nil
+}
+
+type layersCheckResponse struct {
+	Image           string   `json:"image"`
+	Exists          []string `json:"exists"`
+	PreheatedExists []string `json:"preheated_exists"`
+	Missing         []string `json:"missing"`
+}
+
+func setupLayersCheck(t *testing.T) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	docker.SetClient(&fakeDockerClient{
+		images: map[string]struct{}{"app:v1": {}, "arm:v1": {}},
+		layers: map[string]bool{"sha256:a": true, "sha256:b": true, "sha256:c": true},
+		digests: map[string][]string{
+			"app:v1": {"sha256:a", "sha256:b"},
+			"arm:v1": {"sha256:c"},
+		},
+		platforms: map[string]string{"arm:v1": "linux/arm64"},
+	})
+	manager := preheat.GetPreheatedDigestManager()
+	manager.UpdateDigests(context.Background(), "app:v1")
+	manager.UpdateDigests(context.Background(), "arm:v1")
+	t.Cleanup(func() {
+		manager.RemoveImage("app:v1")
+		manager.RemoveImage("arm:v1")
+		docker.SetClient(nil)
+	})
+	r := gin.New()
+	r.POST("/layers/check", LayersCheckHandlerGin)
+	return r
+}
+
+func postLayersCheck(r *gin.Engine, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/layers/check", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func decodeLayersCheck(t *testing.T, w *httptest.ResponseRecorder) layersCheckResponse {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("状态码 %d，响应 %s", w.Code, w.Body.String())
+	}
+	var resp layersCheckResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(resp.Exists)
+	sort.Strings(resp.PreheatedExists)
+	sort.Strings(resp.Missing)
+	return resp
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestLayersCheckBadRequest(t *testing.T) {
+	r := setupLayersCheck(t)
+	tooMany := make([]string, config.MaxDigestsPerRequest+1)
+	for i := range tooMany {
+		tooMany[i] = "sha256:x"
+	}
+	data, _ := json.Marshal(map[string]interface{}{"image": "app:v1", "digests": tooMany})
+	for name, body := range map[string]string{
+		"非 JSON":     "not json",
+		"缺少 image":   `{"digests":["sha256:a"]}`,
+		"缺少 digests": `{"image":"app:v1"}`,
+		"digest 过多":  string(data),
+	} {
+		if w := postLayersCheck(r, body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: 期望 400，实际 %d %s", name, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestLayersCheckBusy(t *testing.T) {
+	r := setupLayersCheck(t)
+	held := 0
+	for preheat.AcquireLayersCheckSlotNonBlock() {
+		held++
+	}
+	defer func() {
+		for i := 0; i < held; i++ {
+			preheat.ReleaseLayersCheckSlot()
+		}
+	}()
+	if w := postLayersCheck(r, `{"image":"app:v1","digests":["sha256:a"]}`); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("并发槽位已满时期望 429，实际 %d", w.Code)
+	}
+}
+
+func TestLayersCheckPreheatedImage(t *testing.T) {
+	r := setupLayersCheck(t)
+	resp := decodeLayersCheck(t, postLayersCheck(r, `{"image":"app:v1","digests":["sha256:a","sha256:b"]}`))
+	if !equalStrings(resp.PreheatedExists, []string{"sha256:a", "sha256:b"}) || len(resp.Exists) != 0 || len(resp.Missing) != 0 {
+		t.Fatalf("预热镜像的层应全部归入 preheated_exists: %+v", resp)
+	}
+}
+
+func TestLayersCheckPerLayer(t *testing.T) {
+	r := setupLayersCheck(t)
+	// 本地没有 other:v1，逐层检查：a 属于预热镜像 app:v1，e 为普通层，d 不存在
+	docker.SetClient(&fakeDockerClient{
+		images:  map[string]struct{}{"app:v1": {}},
+		layers:  map[string]bool{"sha256:a": true, "sha256:e": true},
+		digests: map[string][]string{"app:v1": {"sha256:a"}},
+	})
+	resp := decodeLayersCheck(t, postLayersCheck(r, `{"image":"other:v1","digests":["sha256:a","sha256:e","sha256:d"]}`))
+	if !equalStrings(resp.PreheatedExists, []string{"sha256:a"}) || !equalStrings(resp.Exists, []string{"sha256:e"}) || !equalStrings(resp.Missing, []string{"sha256:d"}) {
+		t.Fatalf("逐层分类不符: %+v", resp)
+	}
+}
+
+func TestLayersCheckPlatformMismatch(t *testing.T) {
+	r := setupLayersCheck(t)
+	// arm:v1 是预热镜像但平台不一致，逐层检查
+	resp := decodeLayersCheck(t, postLayersCheck(r, `{"image":"arm:v1","digests":["sha256:c","sha256:z"],"platform":"linux/amd64"}`))
+	if !equalStrings(resp.PreheatedExists, []string{"sha256:c"}) || len(resp.Exists) != 0 || !equalStrings(resp.Missing, []string{"sha256:z"}) {
+		t.Fatalf("平台不一致时应逐层检查: %+v", resp)
+	}
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"errors"
+
+	"image-preheat/internal/config"
+	"image-preheat/internal/preheat"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// errNoClientCertificate 请求未提供经 CA 校验的客户端证书
+var errNoClientCertificate = errors.New("未提供有效的客户端证书")
+
+// PeerAuthMiddleware 节点间接口的身份校验：开启 PEER_TLS_ENABLED 时要求 CA 签发的客户端证书
+// （配置 PEER_TLS_SERVER_NAME 时需包含该名称），且来源 IP 属于已发现的 peer
+func PeerAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !config.PeerTLSEnabled {
+			c.Next()
+			return
+		}
+		ip := c.RemoteIP()
+		if err := verifiedPeerCertificate(c); err != nil {
+			log.Warn().Err(err).Str("remote", ip).Str("path", c.FullPath()).Msg("节点间请求的客户端证书校验失败")
+			if errors.Is(err, errNoClientCertificate) {
+				c.AbortWithStatusJSON(401, gin.H{"error": "需要客户端证书"})
+			} else {
+				c.AbortWithStatusJSON(403, gin.H{"error": "客户端证书不匹配"})
+			}
+			return
+		}
+		if !preheat.IsKnownPeer(ip) {
+			log.Warn().Str("remote", ip).Str("path", c.FullPath()).Msg("请求方不属于已发现的 peer")
+			c.AbortWithStatusJSON(403, gin.H{"error": "请求方不是已知节点"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// verifiedPeerCertificate 校验请求携带经 CA 校验的客户端证书，配置 PEER_TLS_SERVER_NAME 时证书需包含该名称
+func verifiedPeerCertificate(c *gin.Context) error {
+	state := c.Request.TLS
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return errNoClientCertificate
+	}
+	if name := config.PeerTLSServerName; name != "" {
+		return state.VerifiedChains[0][0].VerifyHostname(name)
+	}
+	return nil
+}
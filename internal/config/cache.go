@@ -1,10 +1,8 @@
 package config
 
 import (
-	"bufio"
 	"os"
 	"path/filepath"
-	"strings"
 	"sync"
 
 	"github.com/fsnotify/fsnotify"
@@ -14,6 +12,7 @@ import (
 type ImageListCache struct {
 	mu       sync.RWMutex
 	images   []string
+	entries  []ImageEntry
 	filePath string
 }
 
@@ -58,28 +57,34 @@ func (c *ImageListCache) WatchAndUpdate() {
 }
 
 func (c *ImageListCache) load() {
-	file, err := os.Open(c.filePath)
+	data, err := os.ReadFile(c.filePath)
 	if err != nil {
 		log.Error().Err(err).Msg("读取镜像列表失败")
 		return
 	}
-	defer file.Close()
 
-	var images []string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line != "" && !strings.HasPrefix(line, "#") {
-			images = append(images, line)
+	var entries []ImageEntry
+	if isStructuredImageList(c.filePath, data) {
+		var invalid []error
+		entries, invalid, err = parseStructuredImageList(data)
+		if err != nil {
+			log.Error().Err(err).Msg("解析结构化镜像列表失败，保留上次加载结果")
+			return
 		}
-	}
-	if err := scanner.Err(); err != nil {
-		log.Error().Err(err).Msg("扫描镜像列表失败")
-		return
+		for _, err := range invalid {
+			log.Warn().Err(err).Msg("跳过无效的镜像列表条目")
+		}
+	} else {
+		entries = parsePlainImageList(data)
 	}
 
+	images := make([]string, 0, len(entries))
+	for _, e := range entries {
+		images = append(images, e.Image)
+	}
 	c.mu.Lock()
 	c.images = images
+	c.entries = entries
 	c.mu.Unlock()
 	log.Info().Strs("images", images).Msg("镜像列表已更新")
 }
@@ -89,3 +94,10 @@ func (c *ImageListCache) GetImages() []string {
 	defer c.mu.RUnlock()
 	return append([]string{}, c.images...)
 }
+
+// GetEntries 获取镜像列表条目（含预热策略）
+func (c *ImageListCache) GetEntries() []ImageEntry {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]ImageEntry{}, c.entries...)
+}
@@ -2,7 +2,9 @@ package config
 
 import (
 	"os"
+	"runtime"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -31,16 +33,80 @@ func GetEnvDuration(key string, def time.Duration) time.Duration {
 	return def
 }
 
+func GetEnvBool(key string, def bool) bool {
+	if v := os.Getenv(key); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return def
+}
+
+// GetEnvList 读取逗号分隔的列表，忽略空项
+func GetEnvList(key string) []string {
+	var list []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// HTTP API 鉴权方式（API_AUTH_MODE）
+const (
+	APIAuthModeToken       = "token"
+	APIAuthModeTokenReview = "tokenreview"
+)
+
+// 节点间传输完整性校验模式（P2P_VERIFY_MODE）
+const (
+	// 以镜像仓库 manifest（或按 digest 固定的引用）中的 config digest 校验归档，无法访问镜像仓库时不进行节点间拉取
+	P2PVerifyDigest = "digest"
+	// 同 digest，无法访问镜像仓库时退化为 consistency（不能防御恶意 peer，需显式开启）
+	P2PVerifyDigestFallback = "digest-fallback"
+	// 只校验归档自洽：层与 config 的 diffID、blob 内容与文件名一致，不访问镜像仓库
+	P2PVerifyConsistency = "consistency"
+	// 不校验
+	P2PVerifyOff = "off"
+)
+
+// APIAuthModeEnabled 判断 API_AUTH_MODE 是否包含 mode
+func APIAuthModeEnabled(mode string) bool {
+	for _, m := range APIAuthModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
 // 统一配置项
 var (
 	// 当前节点名（K8s Downward API 注入），用于分布式锁
 	// 环境变量：NODE_NAME，默认：""
 	NodeName = GetEnv("NODE_NAME", "")
 
+	// 当前 Pod IP（K8s Downward API 注入），写入锁信息供等待节点拉取
+	// 环境变量：POD_IP，默认：""
+	PodIP = GetEnv("POD_IP", "")
+
+	// 当前节点平台（os/arch[/variant]），用于选择拉取的镜像平台及校验节点间传输的镜像平台
+	// 环境变量：NODE_PLATFORM，默认：运行平台（runtime.GOOS/runtime.GOARCH）
+	NodePlatform = GetEnv("NODE_PLATFORM", runtime.GOOS+"/"+runtime.GOARCH)
+
 	// K8s 命名空间
 	// 环境变量：K8S_NAMESPACE，默认："default"
 	K8sNamespace = GetEnv("K8S_NAMESPACE", "default")
 
+	// 分布式锁后端：configmap（单个 ConfigMap 多 key）或 lease（每个镜像一个 coordination.k8s.io Lease）
+	// 环境变量：K8S_LOCK_BACKEND，默认："configmap"
+	K8sLockBackend = GetEnv("K8S_LOCK_BACKEND", "configmap")
+
+	// Lease 锁名称前缀（K8S_LOCK_BACKEND=lease 时生效）
+	// 环境变量：K8S_LOCK_LEASE_PREFIX，默认："image-preheat-lock"
+	K8sLockLeasePrefix = GetEnv("K8S_LOCK_LEASE_PREFIX", "image-preheat-lock")
+
 	// 分布式锁使用的 ConfigMap 名称
 	// 环境变量：K8S_LOCK_CM，默认："image-preheat-lock"
 	K8sLockCM = GetEnv("K8S_LOCK_CM", "image-preheat-lock")
@@ -49,6 +115,18 @@ var (
 	// 环境变量：K8S_LOCK_TIMEOUT，默认：5分钟
 	K8sLockTimeout = GetEnvDuration("K8S_LOCK_TIMEOUT", 5*time.Minute)
 
+	// 集群内同时回源拉取的不同镜像数上限（每个镜像一把锁），<=0 表示不限制
+	// 环境变量：K8S_LOCK_MAX_IMAGES，默认：3
+	K8sLockMaxImages = GetEnvInt("K8S_LOCK_MAX_IMAGES", 3)
+
+	// 其他节点持有镜像回源锁时，等待其拉取完成并节点间获取的超时时间
+	// 环境变量：WAIT_FOR_PEER_TIMEOUT，默认：10分钟
+	WaitForPeerTimeout = GetEnvDuration("WAIT_FOR_PEER_TIMEOUT", 10*time.Minute)
+
+	// 是否监听 PreheatJob 自定义资源（需先安装 CRD）
+	// 环境变量：PREHEAT_JOB_ENABLED，默认：false
+	PreheatJobEnabled = GetEnvBool("PREHEAT_JOB_ENABLED", false)
+
 	// 镜像列表文件路径
 	// 环境变量：IMAGE_LIST_PATH，默认："/etc/preheater/images.list"
 	ImageListPath = GetEnv("IMAGE_LIST_PATH", "/etc/preheater/images.list")
@@ -65,18 +143,83 @@ var (
 	// 环境变量：INTERVAL，默认：1分钟
 	Interval = GetEnvDuration("INTERVAL", time.Minute)
 
-	// 拉取镜像超时时间（心跳/锁有效期）
+	// 预热失败后的重试退避基数，第 n 次失败后等待 基数*2^(n-1)
+	// 环境变量：RETRY_BACKOFF_BASE，默认：30秒
+	RetryBackoffBase = GetEnvDuration("RETRY_BACKOFF_BASE", 30*time.Second)
+
+	// 预热失败后的最大重试退避时间
+	// 环境变量：RETRY_BACKOFF_MAX，默认：30分钟
+	RetryBackoffMax = GetEnvDuration("RETRY_BACKOFF_MAX", 30*time.Minute)
+
+	// 优雅退出超时时间：收到 SIGTERM 后等待进行中的节点间下载完成的最长时间
+	// 环境变量：SHUTDOWN_TIMEOUT，默认：30秒
+	ShutdownTimeout = GetEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+
+	// 拉取镜像超时时间：单次回源拉取或节点间下载（含加载）的最长耗时
 	// 环境变量：PULLING_TIMEOUT，默认：5分钟
 	PullingTimeout = GetEnvDuration("PULLING_TIMEOUT", 5*time.Minute)
 
-	// 镜像归档挂载目录
-	// 环境变量：MOUNT_DIR，默认："/etc/preheater"
-	MountDir = GetEnv("MOUNT_DIR", "/etc/preheater")
+	// 磁盘空间检查路径（镜像存储所在文件系统中的任一路径，需在容器内可见）
+	// 环境变量：DISK_CHECK_PATH，默认：DOCKER_ROOT_DIR
+	DiskCheckPath = GetEnv("DISK_CHECK_PATH", DockerRootDir)
+
+	// 磁盘剩余空间百分比水位线，低于时推迟预热，<=0 表示不检查
+	// 环境变量：DISK_MIN_FREE_PERCENT，默认：15
+	DiskMinFreePercent = GetEnvInt("DISK_MIN_FREE_PERCENT", 15)
+
+	// 磁盘剩余空间字节数水位线，低于时推迟预热，<=0 表示不检查
+	// 环境变量：DISK_MIN_FREE_BYTES，默认：0
+	DiskMinFreeBytes = GetEnvInt("DISK_MIN_FREE_BYTES", 0)
+
+	// 是否在节点 DiskPressure condition 为 True 时推迟预热
+	// 环境变量：DISK_PRESSURE_CHECK，默认：true
+	DiskPressureCheck = GetEnvBool("DISK_PRESSURE_CHECK", true)
+
+	// 优先级不低于该值的镜像不受磁盘水位限制
+	// 环境变量：DISK_BYPASS_PRIORITY，默认：100
+	DiskBypassPriority = GetEnvInt("DISK_BYPASS_PRIORITY", 100)
+
+	// 是否回收已从镜像列表移除的预热镜像（仅限本服务按列表拉取、且未被容器引用的镜像）
+	// 环境变量：GC_ENABLED，默认：false
+	GCEnabled = GetEnvBool("GC_ENABLED", false)
+
+	// 回收 dry-run：只在日志与 /images/gc 报告中列出将删除的镜像，不实际删除
+	// 环境变量：GC_DRY_RUN，默认：true
+	GCDryRun = GetEnvBool("GC_DRY_RUN", true)
+
+	// 镜像从列表移除后的回收宽限期，期间重新加入列表则取消回收
+	// 环境变量：GC_GRACE_PERIOD，默认：24小时
+	GCGracePeriod = GetEnvDuration("GC_GRACE_PERIOD", 24*time.Hour)
+
+	// 本地状态目录（预热队列快照、回收记录、节点间下载产物与暂存文件），需可写，建议挂载 hostPath 以在 Pod 重建后保留；
+	// 与镜像列表所在的只读 ConfigMap 挂载目录分开
+	// 环境变量：MOUNT_DIR，默认："/var/lib/image-preheat"
+	MountDir = GetEnv("MOUNT_DIR", "/var/lib/image-preheat")
 
 	// 下载总限速（所有P2P下载总和，单位：字节/秒）
 	// 环境变量：DOWNLOAD_RATE_LIMIT，默认：500*1024*1024（500MB/s）
 	DownloadRateLimit = GetEnvInt("DOWNLOAD_RATE_LIMIT", 500*1024*1024)
 
+	// 节点间下载产物缓存上限（字节）：/images/download 将镜像归档缓存到 MOUNT_DIR/artifacts 后按文件提供，
+	// 支持 Range 与 ETag 以便续传；缓存同时不会使 MOUNT_DIR 所在磁盘低于水位线，无余量时直接流式输出；
+	// <=0 表示不缓存，直接流式输出（不支持续传）
+	// 环境变量：DOWNLOAD_CACHE_MAX_BYTES，默认：10GiB
+	DownloadCacheMaxBytes = GetEnvInt("DOWNLOAD_CACHE_MAX_BYTES", 10<<30)
+
+	// 节点间下载产物缓存有效期，超过该时间未被下载的产物被删除
+	// 环境变量：DOWNLOAD_CACHE_TTL，默认：1小时
+	DownloadCacheTTL = GetEnvDuration("DOWNLOAD_CACHE_TTL", time.Hour)
+
+	// 节点间拉取先写入 MOUNT_DIR/downloads 下的暂存文件，中断后从同一或其他 peer 续传，下载完成后再加载
+	// 环境变量：DOWNLOAD_RESUME_ENABLED，默认：true
+	DownloadResumeEnabled = GetEnvBool("DOWNLOAD_RESUME_ENABLED", true)
+
+	// 节点间传输完整性校验模式：digest（向镜像仓库获取期望的 config digest）、digest-fallback（同 digest，
+	// 镜像仓库不可用时只校验归档自洽）、consistency（只校验归档自洽）或 off，
+	// 校验通过后才写出决定镜像名的元数据，未通过时不会加载为请求的镜像
+	// 环境变量：P2P_VERIFY_MODE，默认："digest"
+	P2PVerifyMode = GetEnv("P2P_VERIFY_MODE", P2PVerifyDigest)
+
 	// 节点发现服务名称
 	// 环境变量：PEER_DISCOVERY_SERVICE_NAME，默认："image-preheat-peers.default.svc.cluster.local"
 	PeerDiscoveryServiceName = GetEnv("PEER_DISCOVERY_SERVICE_NAME", "image-preheat-peers.default.svc.cluster.local")
@@ -90,10 +233,46 @@ var (
 	// 层状态查询 API 并发数（/layers/check）
 	// 环境变量：LAYERS_CHECK_CONCURRENCY，默认：2
 	LayersCheckConcurrency = GetEnvInt("LAYERS_CHECK_CONCURRENCY", 2)
+	// 按需预热接口（POST /images/preheat）单次最大镜像数
+	// 环境变量：MAX_IMAGES_PER_PREHEAT_REQUEST，默认：20
+	MaxImagesPerPreheatRequest = GetEnvInt("MAX_IMAGES_PER_PREHEAT_REQUEST", 20)
+	// 按需预热镜像在预热队列中的优先级（列表中的镜像默认为 0）；低于 DISK_BYPASS_PRIORITY 时磁盘空间不足会推迟
+	// 环境变量：ON_DEMAND_PRIORITY，默认：50
+	OnDemandPriority = GetEnvInt("ON_DEMAND_PRIORITY", 50)
 	// 层状态查询最大digest数量
 	// 环境变量：MAX_DIGESTS_PER_REQUEST，默认：50
 	MaxDigestsPerRequest = GetEnvInt("MAX_DIGESTS_PER_REQUEST", 50)
 
+	// 镜像客户端类型：cli（docker 命令行）、api（Engine API）、containerd（containerd Go 客户端）
+	// 或 auto（按节点上存在的 docker/containerd socket 自动选择）
+	// 环境变量：DOCKER_CLIENT_TYPE，默认：auto
+	DockerClientType = GetEnv("DOCKER_CLIENT_TYPE", "auto")
+
+	// Docker Engine API 地址（DOCKER_CLIENT_TYPE=api 时生效）
+	// 环境变量：DOCKER_HOST，默认：unix:///var/run/docker.sock
+	DockerHost = GetEnv("DOCKER_HOST", "unix:///var/run/docker.sock")
+
+	// containerd socket 地址（DOCKER_CLIENT_TYPE=containerd/auto 时生效）
+	// 环境变量：CONTAINERD_ADDRESS，默认：/run/containerd/containerd.sock
+	ContainerdAddress = GetEnv("CONTAINERD_ADDRESS", "/run/containerd/containerd.sock")
+
+	// containerd 命名空间（kubelet 使用 k8s.io）
+	// 环境变量：CONTAINERD_NAMESPACE，默认：k8s.io
+	ContainerdNamespace = GetEnv("CONTAINERD_NAMESPACE", "k8s.io")
+
+	// 拉取与导入镜像时解包使用的 containerd snapshotter，需与 CRI 配置一致
+	// 环境变量：CONTAINERD_SNAPSHOTTER，默认：overlayfs
+	ContainerdSnapshotter = GetEnv("CONTAINERD_SNAPSHOTTER", "overlayfs")
+
+	// 镜像仓库凭据 Secret（dockerconfigjson，逗号分隔，<name> 位于 K8S_NAMESPACE 下或 <namespace>/<name>），
+	// 回源拉取与 digest 查询按仓库域名使用其中的凭据
+	// 环境变量：REGISTRY_AUTH_SECRETS，默认：""
+	RegistryAuthSecrets = GetEnvList("REGISTRY_AUTH_SECRETS")
+
+	// 挂载的 dockerconfigjson 凭据文件路径，与 REGISTRY_AUTH_SECRETS 同时配置时优先
+	// 环境变量：REGISTRY_AUTH_FILE，默认：""
+	RegistryAuthFile = GetEnv("REGISTRY_AUTH_FILE", "")
+
 	// Docker存储根目录
 	// 环境变量：DOCKER_ROOT_DIR，默认：/var/lib/docker
 	DockerRootDir = GetEnv("DOCKER_ROOT_DIR", "/var/lib/docker")
@@ -102,6 +281,62 @@ var (
 	// 环境变量：DOCKER_STORAGE_DRIVER，默认：overlay2"
 	DockerStorageDriver = GetEnv("DOCKER_STORAGE_DRIVER", "overlay2")
 
+	// 节点间 mTLS：HTTP 服务改为 HTTPS，节点间接口（/images/check、/images/download、/images/layers、/layers/check）
+	// 要求 CA 签发的客户端证书且来源 IP 属于已发现的 peer
+	// 环境变量：PEER_TLS_ENABLED，默认：false
+	PeerTLSEnabled = GetEnvBool("PEER_TLS_ENABLED", false)
+
+	// 节点间 mTLS 证书、私钥与 CA 文件（文件变化时热加载）
+	// 环境变量：PEER_TLS_CERT_FILE，默认：/etc/preheater-tls/tls.crt
+	PeerTLSCertFile = GetEnv("PEER_TLS_CERT_FILE", "/etc/preheater-tls/tls.crt")
+	// 环境变量：PEER_TLS_KEY_FILE，默认：/etc/preheater-tls/tls.key
+	PeerTLSKeyFile = GetEnv("PEER_TLS_KEY_FILE", "/etc/preheater-tls/tls.key")
+	// 环境变量：PEER_TLS_CA_FILE，默认：/etc/preheater-tls/ca.crt
+	PeerTLSCAFile = GetEnv("PEER_TLS_CA_FILE", "/etc/preheater-tls/ca.crt")
+
+	// 节点间证书需包含的 DNS 名称（双向校验），为空时只校验证书链
+	// 环境变量：PEER_TLS_SERVER_NAME，默认：""
+	PeerTLSServerName = GetEnv("PEER_TLS_SERVER_NAME", "")
+
+	// HTTP API 鉴权方式（逗号分隔，依次尝试）：token（共享 bearer token）、tokenreview（Kubernetes TokenReview
+	// 校验 ServiceAccount token）；为空表示不鉴权，启用时需开启 PEER_TLS_ENABLED
+	// 环境变量：API_AUTH_MODE，默认：""
+	APIAuthModes = GetEnvList("API_AUTH_MODE")
+
+	// 共享 bearer token（API_AUTH_MODE 含 token 时必填），持有者视为 peer
+	// 环境变量：API_AUTH_TOKEN，默认：""
+	APIAuthToken = GetEnv("API_AUTH_TOKEN", "")
+
+	// TokenReview 校验调用方 token 的 audience（逗号分隔），为空表示 API Server 默认 audience
+	// 环境变量：API_AUTH_AUDIENCES，默认：""
+	APIAuthAudiences = GetEnvList("API_AUTH_AUDIENCES")
+
+	// authenticated 路由允许的 TokenReview 用户名（逗号分隔，如 system:serviceaccount:ops:preheat-client），
+	// 与 API_AUTH_ALLOWED_GROUPS 均为空时只允许节点身份
+	// 环境变量：API_AUTH_ALLOWED_USERS，默认：""
+	APIAuthAllowedUsers = GetEnvList("API_AUTH_ALLOWED_USERS")
+
+	// authenticated 路由允许的 TokenReview 用户组（逗号分隔，如 system:serviceaccounts:ops）
+	// 环境变量：API_AUTH_ALLOWED_GROUPS，默认：""
+	APIAuthAllowedGroups = GetEnvList("API_AUTH_ALLOWED_GROUPS")
+
+	// 按路由覆盖鉴权策略（逗号分隔的 <路由>=<public|authenticated|peer>，如 /images/progress=public）
+	// 环境变量：API_AUTH_POLICIES，默认：""
+	APIAuthPolicies = GetEnvList("API_AUTH_POLICIES")
+
+	// 本服务的 ServiceAccount 名称（K8s Downward API 注入），TokenReview 鉴权时该 ServiceAccount 视为 peer
+	// 环境变量：SERVICE_ACCOUNT_NAME，默认：""
+	ServiceAccountName = GetEnv("SERVICE_ACCOUNT_NAME", "")
+
+	// 节点间 token 的专用 audience：节点间请求携带该 audience 的 projected ServiceAccount token，
+	// TokenReview 按该 audience 校验 peer 身份，默认 audience 的 token 不被视为 peer
+	// 环境变量：PEER_TOKEN_AUDIENCE，默认：image-preheat-peer
+	PeerTokenAudience = GetEnv("PEER_TOKEN_AUDIENCE", "image-preheat-peer")
+
+	// 节点间请求携带的 projected ServiceAccount token 文件（audience 为 PEER_TOKEN_AUDIENCE，文件轮换后自动重新读取）
+	// 环境变量：PEER_TOKEN_FILE，默认：/var/run/secrets/image-preheat/token
+	PeerTokenFile = GetEnv("PEER_TOKEN_FILE", "/var/run/secrets/image-preheat/token")
+
 	// peers server 主机名或IP
 	// 环境变量：PEERS_SERVER_NAME，默认：127.0.0.1
 	PeersServerName = GetEnv("PEERS_SERVER_NAME", "127.0.0.1")
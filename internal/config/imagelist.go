@@ -0,0 +1,205 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+// 镜像拉取策略
+const (
+	// PullPolicyIfNotPresent 本地已存在时跳过（默认）
+	PullPolicyIfNotPresent = "IfNotPresent"
+	// PullPolicyAlways 每次调度都回源刷新，用于 latest 等可变 tag
+	PullPolicyAlways = "Always"
+	// PullPolicyIfChanged 每次调度向镜像仓库查询 tag 当前的 digest，与本地不一致时回源刷新
+	PullPolicyIfChanged = "IfChanged"
+)
+
+// ImageEntry 镜像列表中的一项及其预热策略。
+// 纯文本格式的每一行对应一个仅含 Image 的 ImageEntry。
+type ImageEntry struct {
+	Image string `json:"image"`
+	// 优先级，数值越大越先预热，默认 0
+	Priority int `json:"priority,omitempty"`
+	// 目标节点标签，全部匹配的节点才预热，为空表示所有节点
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// 目标节点标签选择器（Kubernetes label selector 语法，如 "gpu in (a100,h100),!edge"），
+	// 与 NodeSelector 同时配置时需同时满足
+	NodeLabelSelector string `json:"nodeLabelSelector,omitempty"`
+	// 目标平台（os/arch[/variant]），与节点平台不一致时跳过，为空表示不限制
+	Platform string `json:"platform,omitempty"`
+	// 拉取的镜像平台（os/arch[/variant]），覆盖节点平台，为空表示使用节点平台
+	PullPlatform string `json:"pullPlatform,omitempty"`
+	// 拉取策略：IfNotPresent（默认）、Always 或 IfChanged
+	PullPolicy string `json:"pullPolicy,omitempty"`
+	// 调度计划（cron 表达式或 @every 1h 等描述符），为空表示每个预热周期都检查
+	Schedule string `json:"schedule,omitempty"`
+
+	schedule      cron.Schedule
+	labelSelector labels.Selector
+}
+
+// UnmarshalJSON 支持条目直接写成镜像名字符串
+func (e *ImageEntry) UnmarshalJSON(data []byte) error {
+	var image string
+	if err := json.Unmarshal(data, &image); err == nil {
+		*e = ImageEntry{Image: image}
+		return nil
+	}
+	type plain ImageEntry
+	var p plain
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	*e = ImageEntry(p)
+	return nil
+}
+
+// validate 校验并补全默认值，解析调度计划
+func (e *ImageEntry) validate() error {
+	e.Image = strings.TrimSpace(e.Image)
+	if e.Image == "" {
+		return fmt.Errorf("镜像名为空")
+	}
+	switch e.PullPolicy {
+	case "":
+		e.PullPolicy = PullPolicyIfNotPresent
+	case PullPolicyIfNotPresent, PullPolicyAlways, PullPolicyIfChanged:
+	default:
+		return fmt.Errorf("未知的拉取策略: %s", e.PullPolicy)
+	}
+	for _, platform := range []string{e.Platform, e.PullPlatform} {
+		if platform == "" {
+			continue
+		}
+		if _, _, _, err := ParsePlatform(platform); err != nil {
+			return err
+		}
+	}
+	if e.NodeLabelSelector != "" {
+		selector, err := labels.Parse(e.NodeLabelSelector)
+		if err != nil {
+			return fmt.Errorf("节点标签选择器格式错误: %v", err)
+		}
+		e.labelSelector = selector
+	}
+	if e.Schedule != "" {
+		schedule, err := cron.ParseStandard(e.Schedule)
+		if err != nil {
+			return fmt.Errorf("调度计划格式错误: %v", err)
+		}
+		e.schedule = schedule
+	}
+	return nil
+}
+
+// NextRun 返回 last 之后下一次应当预热的时间；未配置调度计划时返回 last，即每个周期都执行
+func (e *ImageEntry) NextRun(last time.Time) time.Time {
+	if e.schedule == nil || last.IsZero() {
+		return last
+	}
+	return e.schedule.Next(last)
+}
+
+// NeedsRefresh 本地已存在时是否仍需处理（Always 直接回源，IfChanged 先比较 digest）
+func (e *ImageEntry) NeedsRefresh() bool {
+	return e.PullPolicy == PullPolicyAlways || e.PullPolicy == PullPolicyIfChanged
+}
+
+// MatchesPlatform 判断条目是否面向当前节点平台
+func (e *ImageEntry) MatchesPlatform() bool {
+	return PlatformMatches(e.Platform, NodePlatform)
+}
+
+// TargetPlatform 条目应拉取的镜像平台：PullPlatform，未配置时为节点平台
+func (e *ImageEntry) TargetPlatform() string {
+	return NormalizePlatform(e.PullPlatform)
+}
+
+// MatchesNode 判断节点标签是否满足条目的 NodeSelector 与 NodeLabelSelector
+func (e *ImageEntry) MatchesNode(nodeLabels map[string]string) bool {
+	for k, v := range e.NodeSelector {
+		if nodeLabels[k] != v {
+			return false
+		}
+	}
+	return e.labelSelector == nil || e.labelSelector.Matches(labels.Set(nodeLabels))
+}
+
+// structuredImageList 结构化镜像列表：顶层为条目数组，或包含 images 字段的对象。
+// 条目逐项解析，单个条目字段类型错误时只跳过该条目
+type structuredImageList struct {
+	Images []json.RawMessage `json:"images"`
+}
+
+// isStructuredImageList 判断镜像列表是否为 YAML/JSON 格式：
+// 按扩展名判断，或首个有效行以 {、[ 或 images: 开头（纯文本格式的镜像名不会以这些开头）
+func isStructuredImageList(path string, data []byte) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		return strings.HasPrefix(line, "{") || strings.HasPrefix(line, "[") || strings.HasPrefix(line, "images:")
+	}
+	return false
+}
+
+// parseStructuredImageList 解析 YAML/JSON 镜像列表，返回有效条目与被跳过条目的错误
+func parseStructuredImageList(data []byte) ([]ImageEntry, []error, error) {
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	var raw []json.RawMessage
+	if trimmed := bytes.TrimSpace(jsonData); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &raw)
+	} else {
+		var list structuredImageList
+		err = json.Unmarshal(trimmed, &list)
+		raw = list.Images
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	valid := make([]ImageEntry, 0, len(raw))
+	var invalid []error
+	for i, data := range raw {
+		var entry ImageEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			invalid = append(invalid, fmt.Errorf("第 %d 项: %v", i+1, err))
+			continue
+		}
+		if err := entry.validate(); err != nil {
+			invalid = append(invalid, fmt.Errorf("第 %d 项（%s）: %v", i+1, entry.Image, err))
+			continue
+		}
+		valid = append(valid, entry)
+	}
+	return valid, invalid, nil
+}
+
+// parsePlainImageList 解析纯文本镜像列表：每行一个镜像，支持 # 注释
+func parsePlainImageList(data []byte) []ImageEntry {
+	var entries []ImageEntry
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			entries = append(entries, ImageEntry{Image: line, PullPolicy: PullPolicyIfNotPresent})
+		}
+	}
+	return entries
+}
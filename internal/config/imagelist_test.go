@@ -0,0 +1,269 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func imageNames(entries []ImageEntry) []string {
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Image)
+	}
+	return names
+}
+
+func findEntry(t *testing.T, entries []ImageEntry, image string) ImageEntry {
+	t.Helper()
+	for _, e := range entries {
+		if e.Image == image {
+			return e
+		}
+	}
+	t.Fatalf("未解析出 %s: %v", image, imageNames(entries))
+	return ImageEntry{}
+}
+
+func TestIsStructuredImageList(t *testing.T) {
+	cases := []struct {
+		path, data string
+		want       bool
+	}{
+		{"images.yaml", "nginx:1.25\n", true},
+		{"images.YML", "", true},
+		{"images.json", "[]", true},
+		{"images.txt", "# 预热镜像\n\nimages:\n  - nginx:1.25\n", true},
+		{"images", "- image: nginx:1.25\n", false},
+		{"images", "[\"nginx:1.25\"]", true},
+		{"images", "  {\"images\": []}", true},
+		{"images.txt", "# 预热镜像\n\nnginx:1.25\nredis:7\n", false},
+		{"images.txt", "", false},
+	}
+	for _, tc := range cases {
+		if got := isStructuredImageList(tc.path, []byte(tc.data)); got != tc.want {
+			t.Errorf("isStructuredImageList(%q, %q) = %v，期望 %v", tc.path, tc.data, got, tc.want)
+		}
+	}
+}
+
+func TestParsePlainImageList(t *testing.T) {
+	entries := parsePlainImageList([]byte("# 预热镜像\nnginx:1.25\n\n  redis:7  \r\n# busybox:1.36\nregistry.example.com:5000/app:v1\n"))
+	want := []string{"nginx:1.25", "redis:7", "registry.example.com:5000/app:v1"}
+	if got := imageNames(entries); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("解析为 %v，期望 %v", got, want)
+	}
+	for _, e := range entries {
+		if e.PullPolicy != PullPolicyIfNotPresent || e.Priority != 0 || e.NodeSelector != nil || e.Schedule != "" {
+			t.Fatalf("纯文本条目应只含镜像名与默认拉取策略: %+v", e)
+		}
+	}
+}
+
+func TestParseStructuredImageList(t *testing.T) {
+	cases := []struct {
+		name, data string
+	}{
+		{"top-level array", `
+- nginx:1.25
+- image: redis:7
+  priority: 10
+  pullPolicy: Always
+  pullPlatform: linux/arm64
+`},
+		{"images object", `
+# 预热镜像
+images:
+  - nginx:1.25
+  - image: redis:7
+    priority: 10
+    pullPolicy: Always
+    pullPlatform: Linux/ARM64
+`},
+		{"json", `{"images": ["nginx:1.25", {"image": "redis:7", "priority": 10, "pullPolicy": "Always", "pullPlatform": "linux/arm64"}]}`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			entries, invalid, err := parseStructuredImageList([]byte(tc.data))
+			if err != nil || len(invalid) != 0 {
+				t.Fatalf("解析失败: %v %v", err, invalid)
+			}
+			if got := imageNames(entries); strings.Join(got, ",") != "nginx:1.25,redis:7" {
+				t.Fatalf("解析为 %v", got)
+			}
+			if plain := entries[0]; plain.PullPolicy != PullPolicyIfNotPresent || plain.Priority != 0 {
+				t.Fatalf("字符串条目应使用默认策略: %+v", plain)
+			}
+			redis := entries[1]
+			if redis.Priority != 10 || redis.PullPolicy != PullPolicyAlways || !redis.NeedsRefresh() {
+				t.Fatalf("redis 策略解析错误: %+v", redis)
+			}
+			if redis.TargetPlatform() != "linux/arm64" {
+				t.Fatalf("拉取平台应为 linux/arm64，实际 %s", redis.TargetPlatform())
+			}
+		})
+	}
+
+	if _, _, err := parseStructuredImageList([]byte("images: [nginx")); err == nil {
+		t.Fatal("YAML 格式错误时应返回错误")
+	}
+}
+
+func TestParseStructuredImageListInvalidEntries(t *testing.T) {
+	entries, invalid, err := parseStructuredImageList([]byte(`
+images:
+  - nginx:1.25
+  - image: bad-priority:v1
+    priority: high
+  - image: bad-policy:v1
+    pullPolicy: Never
+  - image: bad-platform:v1
+    platform: amd64
+  - image: bad-pull-platform:v1
+    pullPlatform: linux/arm64/v8/extra
+  - image: bad-selector:v1
+    nodeLabelSelector: "gpu in ("
+  - image: bad-schedule:v1
+    schedule: "every day"
+  - image: "  "
+  - image: redis:7
+    priority: 5
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 无效条目只跳过自身，其余条目正常加载
+	if got := imageNames(entries); strings.Join(got, ",") != "nginx:1.25,redis:7" {
+		t.Fatalf("有效条目为 %v，期望 nginx:1.25,redis:7", got)
+	}
+	if len(invalid) != 7 {
+		t.Fatalf("应跳过 7 个无效条目，实际 %d: %v", len(invalid), invalid)
+	}
+	for i, want := range []string{"第 2 项", "bad-policy:v1", "bad-platform:v1", "bad-pull-platform:v1", "bad-selector:v1", "bad-schedule:v1", "镜像名为空"} {
+		if !strings.Contains(invalid[i].Error(), want) {
+			t.Errorf("第 %d 个错误 %q 应包含 %q", i+1, invalid[i], want)
+		}
+	}
+}
+
+func TestImageEntryMatchesNode(t *testing.T) {
+	entries, invalid, err := parseStructuredImageList([]byte(`
+- image: any:v1
+- image: gpu:v1
+  nodeSelector:
+    accelerator: nvidia
+- image: a100:v1
+  nodeSelector:
+    accelerator: nvidia
+  nodeLabelSelector: "gpu in (a100,h100),!edge"
+`))
+	if err != nil || len(invalid) != 0 {
+		t.Fatalf("解析失败: %v %v", err, invalid)
+	}
+	cases := []struct {
+		image  string
+		labels map[string]string
+		want   bool
+	}{
+		{"any:v1", nil, true},
+		{"gpu:v1", map[string]string{"accelerator": "nvidia"}, true},
+		{"gpu:v1", map[string]string{"accelerator": "amd"}, false},
+		{"gpu:v1", nil, false},
+		{"a100:v1", map[string]string{"accelerator": "nvidia", "gpu": "h100"}, true},
+		{"a100:v1", map[string]string{"accelerator": "nvidia", "gpu": "t4"}, false},
+		{"a100:v1", map[string]string{"accelerator": "nvidia", "gpu": "a100", "edge": "true"}, false},
+		{"a100:v1", map[string]string{"gpu": "a100"}, false},
+	}
+	for _, tc := range cases {
+		e := findEntry(t, entries, tc.image)
+		if got := e.MatchesNode(tc.labels); got != tc.want {
+			t.Errorf("%s MatchesNode(%v) = %v，期望 %v", tc.image, tc.labels, got, tc.want)
+		}
+	}
+}
+
+func TestImageEntryMatchesPlatform(t *testing.T) {
+	platform := NodePlatform
+	t.Cleanup(func() { NodePlatform = platform })
+	NodePlatform = "linux/amd64"
+
+	for p, want := range map[string]bool{"": true, "linux/amd64": true, "Linux/AMD64": true, "linux/arm64": false, "windows/amd64": false} {
+		e := ImageEntry{Image: "nginx:1.25", Platform: p}
+		if got := e.MatchesPlatform(); got != want {
+			t.Errorf("platform %q MatchesPlatform = %v，期望 %v", p, got, want)
+		}
+	}
+	if got := (&ImageEntry{}).TargetPlatform(); got != "linux/amd64" {
+		t.Errorf("未配置 pullPlatform 时应拉取节点平台，实际 %s", got)
+	}
+}
+
+func TestImageEntrySchedule(t *testing.T) {
+	entries, invalid, err := parseStructuredImageList([]byte(`
+- image: always:v1
+- image: nightly:v1
+  schedule: "0 2 * * *"
+- image: hourly:v1
+  schedule: "@every 1h"
+`))
+	if err != nil || len(invalid) != 0 {
+		t.Fatalf("解析失败: %v %v", err, invalid)
+	}
+	last := time.Date(2024, 5, 1, 10, 30, 0, 0, time.Local)
+
+	always := findEntry(t, entries, "always:v1")
+	if next := always.NextRun(last); !next.Equal(last) {
+		t.Fatalf("未配置调度计划时每个周期都执行，实际下次 %v", next)
+	}
+	nightly := findEntry(t, entries, "nightly:v1")
+	if next := nightly.NextRun(last); !next.Equal(time.Date(2024, 5, 2, 2, 0, 0, 0, time.Local)) {
+		t.Fatalf("cron 调度下次执行时间错误: %v", next)
+	}
+	if next := nightly.NextRun(time.Time{}); !next.IsZero() {
+		t.Fatalf("从未执行过时应立即执行，实际 %v", next)
+	}
+	hourly := findEntry(t, entries, "hourly:v1")
+	if next := hourly.NextRun(last); !next.Equal(last.Add(time.Hour)) {
+		t.Fatalf("@every 调度下次执行时间错误: %v", next)
+	}
+}
+
+func TestImageListCacheLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "images.yaml")
+	write := func(data string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := NewImageListCache(path)
+
+	write("images:\n  - nginx:1.25\n  - image: redis:7\n    pullPolicy: Never\n  - image: busybox:1.36\n    priority: 3\n")
+	c.load()
+	if got := c.GetImages(); strings.Join(got, ",") != "nginx:1.25,busybox:1.36" {
+		t.Fatalf("应跳过无效条目，实际 %v", got)
+	}
+	if entries := c.GetEntries(); len(entries) != 2 || entries[1].Priority != 3 {
+		t.Fatalf("条目解析错误: %+v", entries)
+	}
+
+	// 格式错误时保留上次加载结果
+	write("images: [nginx")
+	c.load()
+	if got := c.GetImages(); strings.Join(got, ",") != "nginx:1.25,busybox:1.36" {
+		t.Fatalf("格式错误时应保留上次结果，实际 %v", got)
+	}
+
+	// 旧的纯文本格式
+	plain := NewImageListCache(filepath.Join(dir, "images.txt"))
+	if err := os.WriteFile(plain.filePath, []byte("# 预热镜像\nnginx:1.25\nredis:7\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	plain.load()
+	if got := plain.GetImages(); strings.Join(got, ",") != "nginx:1.25,redis:7" {
+		t.Fatalf("纯文本格式解析为 %v", got)
+	}
+}
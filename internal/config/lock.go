@@ -2,116 +2,332 @@ package config
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/retry"
 )
 
+// 分布式锁后端类型
+const (
+	LockBackendConfigMap = "configmap"
+	LockBackendLease     = "lease"
+)
+
+// 每个镜像一把锁，ConfigMap 中的 key 为 lockKeyPrefix + 镜像名转义
+const lockKeyPrefix = "pulling-lock."
+
+// 全局单调递增的 fencing token 计数器所在 key
+const fencingTokenKey = "fencing-token"
+
+// ErrLockLost 锁已被其他节点抢占、删除或 fencing token 不匹配
+var ErrLockLost = errors.New("分布式锁已丢失")
+
+// ErrLockCapacity 集群内同时回源的镜像数已达 K8S_LOCK_MAX_IMAGES 上限
+var ErrLockCapacity = errors.New("集群回源并发已满")
+
+// Locker 镜像回源分布式锁接口，每个镜像一把锁
+type Locker interface {
+	// 尝试获取镜像锁，addr 为本节点 Pod IP，成功时返回单调递增的 fencing token；
+	// 锁被其他节点持有时返回 acquired=false，集群回源并发已满时返回 ErrLockCapacity
+	TryAcquireLock(image, node, addr string) (token int64, acquired bool, err error)
+	// 释放本节点以 token 持有的镜像锁
+	ReleaseLock(image, node string, token int64) error
+	// 续期本节点以 token 持有的镜像锁，锁已不属于本节点时返回 ErrLockLost
+	RefreshLock(image, node string, token int64) error
+	// 获取镜像锁信息，未加锁时返回 nil
+	GetLockInfo(image string) (*K8sLockInfo, error)
+	// 阻塞直到镜像锁被释放或超时失效，返回最后观察到的持锁信息
+	WaitForLockRelease(ctx context.Context, image string) (*K8sLockInfo, error)
+}
+
+// NewK8sClientset 使用 InCluster 配置创建 K8s 客户端
+func NewK8sClientset() (kubernetes.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// NewK8sDynamicClient 使用 in-cluster 配置创建 dynamic 客户端（用于自定义资源）
+func NewK8sDynamicClient() (dynamic.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	return dynamic.NewForConfig(config)
+}
+
+// NewLocker 按后端类型创建分布式锁，name 为 ConfigMap 名或 Lease 名前缀
+func NewLocker(backend string, clientset kubernetes.Interface, namespace, name string, timeout time.Duration, maxImages int) (Locker, error) {
+	switch backend {
+	case LockBackendConfigMap, "":
+		return NewK8sConfigMapLock(clientset, namespace, name, timeout, maxImages), nil
+	case LockBackendLease:
+		return NewK8sLeaseLock(clientset, namespace, name, timeout, maxImages), nil
+	default:
+		return nil, fmt.Errorf("未知的锁后端类型: %s", backend)
+	}
+}
+
 type K8sLockInfo struct {
 	Image     string    `json:"image"`
 	Node      string    `json:"node"`
+	Addr      string    `json:"addr,omitempty"`  // 持锁节点 Pod IP，等待方在锁释放后从该地址节点间拉取
+	Token     int64     `json:"token,omitempty"` // fencing token
 	Timestamp time.Time `json:"timestamp"`
 }
 
 type K8sConfigMapLock struct {
-	Clientset *kubernetes.Clientset
+	Clientset kubernetes.Interface
 	Namespace string
 	CMName    string
 	Timeout   time.Duration
+	// 集群内同时回源拉取的不同镜像数上限，<=0 表示不限制
+	MaxImages int
 }
 
-func NewK8sConfigMapLock(namespace, cmName string, timeout time.Duration) (*K8sConfigMapLock, error) {
-	config, err := rest.InClusterConfig()
-	if err != nil {
-		return nil, err
-	}
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return nil, err
-	}
+func NewK8sConfigMapLock(clientset kubernetes.Interface, namespace, cmName string, timeout time.Duration, maxImages int) *K8sConfigMapLock {
 	return &K8sConfigMapLock{
 		Clientset: clientset,
 		Namespace: namespace,
 		CMName:    cmName,
 		Timeout:   timeout,
-	}, nil
+		MaxImages: maxImages,
+	}
+}
+
+// LockKey 将镜像名转换为合法的 ConfigMap key（只允许 [-._a-zA-Z0-9]），
+// 追加镜像名哈希避免转义后冲突
+func LockKey(image string) string {
+	var b strings.Builder
+	for _, r := range image {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	name := b.String()
+	if len(name) > 200 {
+		name = name[:200]
+	}
+	sum := sha256.Sum256([]byte(image))
+	return lockKeyPrefix + name + "." + hex.EncodeToString(sum[:4])
 }
 
-func (l *K8sConfigMapLock) TryAcquireLock(image, node string) (bool, error) {
+func decodeLockInfo(v string) (*K8sLockInfo, error) {
+	var info K8sLockInfo
+	if err := json.Unmarshal([]byte(v), &info); err != nil {
+		return nil, fmt.Errorf("锁数据解析失败: %v", err)
+	}
+	return &info, nil
+}
+
+func (l *K8sConfigMapLock) TryAcquireLock(image, node, addr string) (int64, bool, error) {
+	key := LockKey(image)
 	for i := 0; i < 5; i++ {
 		cm, err := l.Clientset.CoreV1().ConfigMaps(l.Namespace).Get(context.TODO(), l.CMName, metav1.GetOptions{})
 		if err != nil {
-			return false, err
+			return 0, false, err
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		active := 0
+		for k, v := range cm.Data {
+			if !strings.HasPrefix(k, lockKeyPrefix) || v == "" {
+				continue
+			}
+			info, err := decodeLockInfo(v)
+			if err != nil {
+				log.Warn().Err(err).Str("key", k).Msg("锁数据损坏，按已超时清理")
+				delete(cm.Data, k)
+				continue
+			}
+			if time.Since(info.Timestamp) >= l.Timeout {
+				// 顺带清理已超时的锁
+				delete(cm.Data, k)
+				continue
+			}
+			if k == key {
+				return 0, false, nil // 该镜像锁未超时
+			}
+			active++
+		}
+		if l.MaxImages > 0 && active >= l.MaxImages {
+			return 0, false, ErrLockCapacity
 		}
-		var info K8sLockInfo
-		if v, ok := cm.Data["pulling-lock"]; ok && v != "" {
-			_ = json.Unmarshal([]byte(v), &info)
-			if time.Since(info.Timestamp) < l.Timeout {
-				return false, nil // 锁未超时
+
+		var token int64
+		if v := cm.Data[fencingTokenKey]; v != "" {
+			if token, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return 0, false, fmt.Errorf("fencing token 解析失败: %v", err)
 			}
 		}
-		// 尝试原子更新
-		newInfo := K8sLockInfo{Image: image, Node: node, Timestamp: time.Now()}
-		data, _ := json.Marshal(newInfo)
-		cm.Data["pulling-lock"] = string(data)
+		token++
+		newInfo := K8sLockInfo{Image: image, Node: node, Addr: addr, Token: token, Timestamp: time.Now()}
+		data, err := json.Marshal(newInfo)
+		if err != nil {
+			return 0, false, err
+		}
+		cm.Data[key] = string(data)
+		cm.Data[fencingTokenKey] = strconv.FormatInt(token, 10)
+		// 依赖 resourceVersion 乐观并发控制，冲突说明期间有其他节点修改过锁
 		_, err = l.Clientset.CoreV1().ConfigMaps(l.Namespace).Update(context.TODO(), cm, metav1.UpdateOptions{})
 		if err == nil {
-			return true, nil // 抢锁成功
+			return token, true, nil // 抢锁成功
+		}
+		if !apierrors.IsConflict(err) {
+			return 0, false, err
 		}
-		// 冲突则重试
 		time.Sleep(200 * time.Millisecond)
 	}
-	return false, nil
+	return 0, false, fmt.Errorf("抢锁冲突重试次数耗尽: %s", image)
 }
 
-func (l *K8sConfigMapLock) ReleaseLock(image, node string) error {
-	cm, err := l.Clientset.CoreV1().ConfigMaps(l.Namespace).Get(context.TODO(), l.CMName, metav1.GetOptions{})
-	if err != nil {
-		return err
-	}
-	var info K8sLockInfo
-	if v, ok := cm.Data["pulling-lock"]; ok && v != "" {
-		_ = json.Unmarshal([]byte(v), &info)
-		if info.Node == node && info.Image == image {
-			cm.Data["pulling-lock"] = ""
-			_, err = l.Clientset.CoreV1().ConfigMaps(l.Namespace).Update(context.TODO(), cm, metav1.UpdateOptions{})
+func (l *K8sConfigMapLock) ReleaseLock(image, node string, token int64) error {
+	key := LockKey(image)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := l.Clientset.CoreV1().ConfigMaps(l.Namespace).Get(context.TODO(), l.CMName, metav1.GetOptions{})
+		if err != nil {
 			return err
 		}
-	}
-	return nil
+		v := cm.Data[key]
+		if v == "" {
+			return nil
+		}
+		info, err := decodeLockInfo(v)
+		if err != nil || info.Node != node || info.Token != token {
+			return nil // 锁已不属于本节点，无需释放
+		}
+		delete(cm.Data, key)
+		_, err = l.Clientset.CoreV1().ConfigMaps(l.Namespace).Update(context.TODO(), cm, metav1.UpdateOptions{})
+		return err
+	})
 }
 
-func (l *K8sConfigMapLock) RefreshLock(image, node string) error {
-	cm, err := l.Clientset.CoreV1().ConfigMaps(l.Namespace).Get(context.TODO(), l.CMName, metav1.GetOptions{})
-	if err != nil {
-		return err
-	}
-	var info K8sLockInfo
-	if v, ok := cm.Data["pulling-lock"]; ok && v != "" {
-		_ = json.Unmarshal([]byte(v), &info)
-		if info.Node == node && info.Image == image {
-			info.Timestamp = time.Now()
-			data, _ := json.Marshal(info)
-			cm.Data["pulling-lock"] = string(data)
-			_, err = l.Clientset.CoreV1().ConfigMaps(l.Namespace).Update(context.TODO(), cm, metav1.UpdateOptions{})
+func (l *K8sConfigMapLock) RefreshLock(image, node string, token int64) error {
+	key := LockKey(image)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := l.Clientset.CoreV1().ConfigMaps(l.Namespace).Get(context.TODO(), l.CMName, metav1.GetOptions{})
+		if err != nil {
 			return err
 		}
-	}
-	return nil
+		v := cm.Data[key]
+		if v == "" {
+			return ErrLockLost
+		}
+		info, err := decodeLockInfo(v)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrLockLost, err)
+		}
+		if info.Node != node || info.Token != token {
+			return ErrLockLost
+		}
+		info.Timestamp = time.Now()
+		data, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+		cm.Data[key] = string(data)
+		_, err = l.Clientset.CoreV1().ConfigMaps(l.Namespace).Update(context.TODO(), cm, metav1.UpdateOptions{})
+		return err
+	})
 }
 
-func (l *K8sConfigMapLock) GetLockInfo() (*K8sLockInfo, error) {
+// GetLockInfo 获取指定镜像的锁信息，未加锁时返回 nil
+func (l *K8sConfigMapLock) GetLockInfo(image string) (*K8sLockInfo, error) {
 	cm, err := l.Clientset.CoreV1().ConfigMaps(l.Namespace).Get(context.TODO(), l.CMName, metav1.GetOptions{})
 	if err != nil {
 		return nil, err
 	}
-	var info K8sLockInfo
-	if v, ok := cm.Data["pulling-lock"]; ok && v != "" {
-		_ = json.Unmarshal([]byte(v), &info)
-		return &info, nil
+	if v := cm.Data[LockKey(image)]; v != "" {
+		return decodeLockInfo(v)
 	}
 	return nil, nil
 }
+
+// WaitForLockRelease 监听锁 ConfigMap，直到指定镜像的锁被释放或超时失效，
+// 返回最后一次观察到的持锁信息（可能为 nil）
+func (l *K8sConfigMapLock) WaitForLockRelease(ctx context.Context, image string) (*K8sLockInfo, error) {
+	key := LockKey(image)
+	var holder *K8sLockInfo
+	released := func(cm *corev1.ConfigMap) bool {
+		v := cm.Data[key]
+		if v == "" {
+			return true
+		}
+		info, err := decodeLockInfo(v)
+		if err != nil {
+			return true
+		}
+		holder = info
+		return time.Since(info.Timestamp) >= l.Timeout
+	}
+
+	// 持锁方异常退出时不会产生 ConfigMap 事件，需定期按时间戳判断是否超时
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		cm, err := l.Clientset.CoreV1().ConfigMaps(l.Namespace).Get(ctx, l.CMName, metav1.GetOptions{})
+		if err != nil {
+			return holder, err
+		}
+		if released(cm) {
+			return holder, nil
+		}
+		w, err := l.Clientset.CoreV1().ConfigMaps(l.Namespace).Watch(ctx, metav1.ListOptions{
+			FieldSelector:   fields.OneTermEqualSelector("metadata.name", l.CMName).String(),
+			ResourceVersion: cm.ResourceVersion,
+		})
+		if err != nil {
+			return holder, err
+		}
+		done, err := func() (bool, error) {
+			defer w.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return false, ctx.Err()
+				case <-ticker.C:
+					if holder != nil && time.Since(holder.Timestamp) >= l.Timeout {
+						return true, nil
+					}
+				case event, ok := <-w.ResultChan():
+					if !ok {
+						return false, nil // watch 断开，重新 Get+Watch
+					}
+					switch event.Type {
+					case watch.Deleted:
+						return true, nil
+					case watch.Added, watch.Modified:
+						if cm, ok := event.Object.(*corev1.ConfigMap); ok && released(cm) {
+							return true, nil
+						}
+					}
+				}
+			}
+		}()
+		if err != nil || done {
+			return holder, err
+		}
+	}
+}
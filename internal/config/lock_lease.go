@@ -0,0 +1,420 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// Lease 锁的标签与注解
+const (
+	leaseLockLabelKey       = "app.kubernetes.io/component"
+	leaseLockLabelValue     = "image-preheat-lock"
+	leaseImageAnnotation    = "image-preheat/image"
+	leaseAddrAnnotation     = "image-preheat/addr"
+	leaseNameFragmentMaxLen = 40
+)
+
+// K8sLeaseLock 基于 coordination.k8s.io Lease 的分布式锁，每个镜像一个 Lease。
+// 过期判断参考 client-go leaderelection：以本地观察到 Lease 变化的时间为准，
+// 不依赖各节点时钟一致。
+type K8sLeaseLock struct {
+	Clientset kubernetes.Interface
+	Namespace string
+	Prefix    string
+	Timeout   time.Duration
+	// 集群内同时回源拉取的不同镜像数上限，<=0 表示不限制（基于 List 计数，尽力而为）
+	MaxImages int
+
+	// 已释放或过期的 Lease 保留时间，超过后删除
+	IdleTTL time.Duration
+
+	mu       sync.Mutex
+	observed map[string]leaseObservation // lease name -> 本地观察记录
+	lastGC   time.Time
+}
+
+// 清理空闲 Lease 的最小间隔
+const leaseGCInterval = 10 * time.Minute
+
+type leaseObservation struct {
+	resourceVersion string
+	time            time.Time
+}
+
+func NewK8sLeaseLock(clientset kubernetes.Interface, namespace, prefix string, timeout time.Duration, maxImages int) *K8sLeaseLock {
+	return &K8sLeaseLock{
+		Clientset: clientset,
+		Namespace: namespace,
+		Prefix:    prefix,
+		Timeout:   timeout,
+		MaxImages: maxImages,
+		IdleTTL:   leaseIdleTTL(timeout),
+		observed:  make(map[string]leaseObservation),
+	}
+}
+
+// leaseIdleTTL 空闲 Lease 保留时间：不短于 1 小时且不短于 10 倍锁超时。
+// 删除后 leaseTransitions 从头计数，原持锁方早已因续期失败中止拉取，不会与新 token 混淆
+func leaseIdleTTL(timeout time.Duration) time.Duration {
+	if ttl := 10 * timeout; ttl > time.Hour {
+		return ttl
+	}
+	return time.Hour
+}
+
+// leaseName 将镜像名转换为合法的 Lease 名称（DNS subdomain），追加哈希避免冲突
+func (l *K8sLeaseLock) leaseName(image string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(image) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('-')
+		}
+	}
+	name := b.String()
+	if len(name) > leaseNameFragmentMaxLen {
+		name = name[:leaseNameFragmentMaxLen]
+	}
+	name = strings.Trim(name, "-")
+	sum := sha256.Sum256([]byte(image))
+	return l.Prefix + "-" + name + "-" + hex.EncodeToString(sum[:4])
+}
+
+// expired 判断 Lease 是否已过期：resourceVersion 在 leaseDuration 内未变化即视为过期
+func (l *K8sLeaseLock) expired(lease *coordinationv1.Lease) bool {
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity == "" {
+		return true
+	}
+	duration := l.Timeout
+	if lease.Spec.LeaseDurationSeconds != nil {
+		duration = time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+	}
+
+	return time.Since(l.observe(lease)) >= duration
+}
+
+// observe 记录 Lease 的 resourceVersion，返回本地最后一次观察到其变化的时间
+func (l *K8sLeaseLock) observe(lease *coordinationv1.Lease) time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	obs, ok := l.observed[lease.Name]
+	if !ok || obs.resourceVersion != lease.ResourceVersion {
+		obs = leaseObservation{resourceVersion: lease.ResourceVersion, time: time.Now()}
+		l.observed[lease.Name] = obs
+	}
+	return obs.time
+}
+
+func (l *K8sLeaseLock) lockInfo(lease *coordinationv1.Lease) *K8sLockInfo {
+	info := &K8sLockInfo{
+		Image: lease.Annotations[leaseImageAnnotation],
+		Addr:  lease.Annotations[leaseAddrAnnotation],
+	}
+	if lease.Spec.HolderIdentity != nil {
+		info.Node = *lease.Spec.HolderIdentity
+	}
+	if lease.Spec.LeaseTransitions != nil {
+		info.Token = int64(*lease.Spec.LeaseTransitions)
+	}
+	if lease.Spec.RenewTime != nil {
+		info.Timestamp = lease.Spec.RenewTime.Time
+	}
+	return info
+}
+
+// heldBy 判断 Lease 是否仍由 node 以 token 持有
+func heldBy(lease *coordinationv1.Lease, node string, token int64) bool {
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != node {
+		return false
+	}
+	return lease.Spec.LeaseTransitions != nil && int64(*lease.Spec.LeaseTransitions) == token
+}
+
+// activeImages 统计其他镜像当前有效的 Lease 数
+func (l *K8sLeaseLock) activeImages(ctx context.Context, exclude string) (int, error) {
+	list, err := l.Clientset.CoordinationV1().Leases(l.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: leaseLockLabelKey + "=" + leaseLockLabelValue,
+	})
+	if err != nil {
+		return 0, err
+	}
+	active := 0
+	for i := range list.Items {
+		lease := &list.Items[i]
+		if lease.Name != exclude && !l.expired(lease) {
+			active++
+		}
+	}
+	return active, nil
+}
+
+// TryAcquireLock 抢占镜像 Lease，fencing token 为 Lease 的 leaseTransitions
+func (l *K8sLeaseLock) TryAcquireLock(image, node, addr string) (int64, bool, error) {
+	ctx := context.TODO()
+	name := l.leaseName(image)
+	leases := l.Clientset.CoordinationV1().Leases(l.Namespace)
+	for i := 0; i < 5; i++ {
+		lease, err := leases.Get(ctx, name, metav1.GetOptions{})
+		notFound := apierrors.IsNotFound(err)
+		if err != nil && !notFound {
+			return 0, false, err
+		}
+		if !notFound && !l.expired(lease) {
+			return 0, false, nil // 该镜像锁未超时
+		}
+		if l.MaxImages > 0 {
+			active, err := l.activeImages(ctx, name)
+			if err != nil {
+				return 0, false, err
+			}
+			if active >= l.MaxImages {
+				return 0, false, ErrLockCapacity
+			}
+		}
+
+		now := metav1.NewMicroTime(time.Now())
+		durationSeconds := int32(l.Timeout / time.Second)
+		if notFound {
+			lease = &coordinationv1.Lease{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: l.Namespace,
+					Labels:    map[string]string{leaseLockLabelKey: leaseLockLabelValue},
+				},
+			}
+		}
+		if lease.Annotations == nil {
+			lease.Annotations = map[string]string{}
+		}
+		var transitions int32
+		if lease.Spec.LeaseTransitions != nil {
+			transitions = *lease.Spec.LeaseTransitions
+		}
+		transitions++
+		lease.Annotations[leaseImageAnnotation] = image
+		lease.Annotations[leaseAddrAnnotation] = addr
+		lease.Spec.HolderIdentity = &node
+		lease.Spec.LeaseDurationSeconds = &durationSeconds
+		lease.Spec.LeaseTransitions = &transitions
+		lease.Spec.AcquireTime = &now
+		lease.Spec.RenewTime = &now
+
+		if notFound {
+			_, err = leases.Create(ctx, lease, metav1.CreateOptions{})
+		} else {
+			_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+		}
+		if err == nil {
+			return int64(transitions), true, nil // 抢锁成功
+		}
+		// 其他节点并发创建/更新了同一 Lease，重新读取后重试
+		if !apierrors.IsConflict(err) && !apierrors.IsAlreadyExists(err) {
+			return 0, false, err
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return 0, false, fmt.Errorf("抢锁冲突重试次数耗尽: %s", image)
+}
+
+// ReleaseLock 清空 holderIdentity 释放锁，保留 Lease 以延续 leaseTransitions 计数
+func (l *K8sLeaseLock) ReleaseLock(image, node string, token int64) error {
+	ctx := context.TODO()
+	leases := l.Clientset.CoordinationV1().Leases(l.Namespace)
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		lease, err := leases.Get(ctx, l.leaseName(image), metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !heldBy(lease, node, token) {
+			return nil // 锁已不属于本节点，无需释放
+		}
+		lease.Spec.HolderIdentity = nil
+		lease.Spec.RenewTime = nil
+		_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+		return err
+	})
+	if err == nil {
+		l.maybeCollectGarbage(ctx)
+	}
+	return err
+}
+
+// maybeCollectGarbage 每隔 leaseGCInterval 最多执行一次 CollectGarbage
+func (l *K8sLeaseLock) maybeCollectGarbage(ctx context.Context) {
+	l.mu.Lock()
+	due := time.Since(l.lastGC) >= leaseGCInterval
+	if due {
+		l.lastGC = time.Now()
+	}
+	l.mu.Unlock()
+	if !due {
+		return
+	}
+	if err := l.CollectGarbage(ctx); err != nil {
+		log.Warn().Err(err).Msg("清理空闲 Lease 锁失败")
+	}
+}
+
+// CollectGarbage 删除已释放或过期、且本地观察到其未变化超过 IdleTTL 的 Lease，
+// 并清理已不存在的 Lease 的观察记录。删除以 resourceVersion 为前提条件，期间被重新抢占的 Lease 不会被删除
+func (l *K8sLeaseLock) CollectGarbage(ctx context.Context) error {
+	leases := l.Clientset.CoordinationV1().Leases(l.Namespace)
+	list, err := leases.List(ctx, metav1.ListOptions{
+		LabelSelector: leaseLockLabelKey + "=" + leaseLockLabelValue,
+	})
+	if err != nil {
+		return err
+	}
+	alive := make(map[string]bool, len(list.Items))
+	for i := range list.Items {
+		lease := &list.Items[i]
+		alive[lease.Name] = true
+		if !l.expired(lease) || time.Since(l.observe(lease)) < l.IdleTTL {
+			continue
+		}
+		rv := lease.ResourceVersion
+		err := leases.Delete(ctx, lease.Name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{ResourceVersion: &rv},
+		})
+		if err != nil && !apierrors.IsNotFound(err) && !apierrors.IsConflict(err) {
+			log.Warn().Err(err).Str("lease", lease.Name).Msg("删除空闲 Lease 锁失败")
+			continue
+		}
+		delete(alive, lease.Name)
+		log.Info().Str("lease", lease.Name).Str("image", lease.Annotations[leaseImageAnnotation]).Msg("已删除空闲 Lease 锁")
+	}
+	l.mu.Lock()
+	for name := range l.observed {
+		if !alive[name] {
+			delete(l.observed, name)
+		}
+	}
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *K8sLeaseLock) RefreshLock(image, node string, token int64) error {
+	ctx := context.TODO()
+	leases := l.Clientset.CoordinationV1().Leases(l.Namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		lease, err := leases.Get(ctx, l.leaseName(image), metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return ErrLockLost
+		}
+		if err != nil {
+			return err
+		}
+		if !heldBy(lease, node, token) {
+			return ErrLockLost
+		}
+		now := metav1.NewMicroTime(time.Now())
+		lease.Spec.RenewTime = &now
+		_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// GetLockInfo 获取指定镜像的锁信息，未加锁时返回 nil
+func (l *K8sLeaseLock) GetLockInfo(image string) (*K8sLockInfo, error) {
+	lease, err := l.Clientset.CoordinationV1().Leases(l.Namespace).Get(context.TODO(), l.leaseName(image), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity == "" {
+		return nil, nil
+	}
+	return l.lockInfo(lease), nil
+}
+
+// WaitForLockRelease 监听镜像对应的 Lease，直到其被删除、易主或过期
+func (l *K8sLeaseLock) WaitForLockRelease(ctx context.Context, image string) (*K8sLockInfo, error) {
+	name := l.leaseName(image)
+	leases := l.Clientset.CoordinationV1().Leases(l.Namespace)
+	var holder *K8sLockInfo
+	released := func(lease *coordinationv1.Lease) bool {
+		if l.expired(lease) {
+			return true
+		}
+		info := l.lockInfo(lease)
+		if holder != nil && (holder.Node != info.Node || holder.Token != info.Token) {
+			return true // 已被释放后由其他节点重新获取
+		}
+		holder = info
+		return false
+	}
+
+	// 持锁方异常退出时不会产生 Lease 事件，需定期检查是否过期
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		lease, err := leases.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return holder, nil
+		}
+		if err != nil {
+			return holder, err
+		}
+		if released(lease) {
+			return holder, nil
+		}
+		w, err := leases.Watch(ctx, metav1.ListOptions{
+			FieldSelector:   fields.OneTermEqualSelector("metadata.name", name).String(),
+			ResourceVersion: lease.ResourceVersion,
+		})
+		if err != nil {
+			return holder, err
+		}
+		done, err := func() (bool, error) {
+			defer w.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return false, ctx.Err()
+				case <-ticker.C:
+					if l.expired(lease) {
+						return true, nil
+					}
+				case event, ok := <-w.ResultChan():
+					if !ok {
+						return false, nil // watch 断开，重新 Get+Watch
+					}
+					switch event.Type {
+					case watch.Deleted:
+						return true, nil
+					case watch.Added, watch.Modified:
+						if updated, ok := event.Object.(*coordinationv1.Lease); ok {
+							lease = updated
+							if released(lease) {
+								return true, nil
+							}
+						}
+					}
+				}
+			}
+		}()
+		if err != nil || done {
+			return holder, err
+		}
+	}
+}
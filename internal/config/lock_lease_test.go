@@ -0,0 +1,187 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestLeaseLock(maxImages int) *K8sLeaseLock {
+	return NewK8sLeaseLock(newFakeClientset(), testNamespace, "image-preheat-lock", time.Minute, maxImages)
+}
+
+// expireLease 将本地对镜像 Lease 的观察时间提前 age，模拟 Lease 在 age 内未被续期
+func expireLease(t *testing.T, l *K8sLeaseLock, image string, age time.Duration) {
+	t.Helper()
+	name := l.leaseName(image)
+	lease, err := l.Clientset.CoordinationV1().Leases(l.Namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.mu.Lock()
+	l.observed[name] = leaseObservation{resourceVersion: lease.ResourceVersion, time: time.Now().Add(-age)}
+	l.mu.Unlock()
+}
+
+func TestLeaseLockAcquire(t *testing.T) {
+	l := newTestLeaseLock(0)
+	token, acquired, err := l.TryAcquireLock("nginx:1.25", "node-a", "10.0.0.1")
+	if err != nil || !acquired || token != 1 {
+		t.Fatalf("首次抢锁: token=%d acquired=%v err=%v", token, acquired, err)
+	}
+	lease, err := l.Clientset.CoordinationV1().Leases(testNamespace).Get(context.TODO(), l.leaseName("nginx:1.25"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *lease.Spec.HolderIdentity != "node-a" || *lease.Spec.LeaseTransitions != 1 || *lease.Spec.LeaseDurationSeconds != 60 {
+		t.Fatalf("Lease 内容不符: %+v", lease.Spec)
+	}
+	if lease.Labels[leaseLockLabelKey] != leaseLockLabelValue {
+		t.Fatalf("Lease 缺少标签: %v", lease.Labels)
+	}
+	info, err := l.GetLockInfo("nginx:1.25")
+	if err != nil || info == nil || info.Node != "node-a" || info.Addr != "10.0.0.1" || info.Image != "nginx:1.25" || info.Token != 1 {
+		t.Fatalf("锁信息不符: %+v err=%v", info, err)
+	}
+}
+
+func TestLeaseLockConflictWithHolder(t *testing.T) {
+	l := newTestLeaseLock(0)
+	if _, _, err := l.TryAcquireLock("nginx", "node-a", ""); err != nil {
+		t.Fatal(err)
+	}
+	// 另一个节点使用独立的观察记录
+	other := NewK8sLeaseLock(l.Clientset, testNamespace, l.Prefix, l.Timeout, 0)
+	if _, acquired, err := other.TryAcquireLock("nginx", "node-b", ""); err != nil || acquired {
+		t.Fatalf("其他节点持锁时不应抢到: acquired=%v err=%v", acquired, err)
+	}
+	if err := other.RefreshLock("nginx", "node-b", 1); !errors.Is(err, ErrLockLost) {
+		t.Fatalf("未持锁的节点续期应返回 ErrLockLost，实际: %v", err)
+	}
+}
+
+func TestLeaseLockTakeoverAfterExpiry(t *testing.T) {
+	l := newTestLeaseLock(0)
+	oldToken, _, err := l.TryAcquireLock("nginx", "node-a", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := NewK8sLeaseLock(l.Clientset, testNamespace, l.Prefix, l.Timeout, 0)
+	if _, acquired, _ := other.TryAcquireLock("nginx", "node-b", "10.0.0.2"); acquired {
+		t.Fatal("Lease 未过期时不应被接管")
+	}
+	expireLease(t, other, "nginx", 2*l.Timeout)
+	newToken, acquired, err := other.TryAcquireLock("nginx", "node-b", "10.0.0.2")
+	if err != nil || !acquired {
+		t.Fatalf("Lease 过期后应可接管: acquired=%v err=%v", acquired, err)
+	}
+	// fencing token 取自 leaseTransitions
+	lease, err := l.Clientset.CoordinationV1().Leases(testNamespace).Get(context.TODO(), l.leaseName("nginx"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newToken != oldToken+1 || int64(*lease.Spec.LeaseTransitions) != newToken {
+		t.Fatalf("fencing token 应等于 leaseTransitions: old=%d new=%d transitions=%d", oldToken, newToken, *lease.Spec.LeaseTransitions)
+	}
+	if err := l.RefreshLock("nginx", "node-a", oldToken); !errors.Is(err, ErrLockLost) {
+		t.Fatalf("被接管后续期应返回 ErrLockLost，实际: %v", err)
+	}
+	// 原持锁方释放不影响新持锁方
+	if err := l.ReleaseLock("nginx", "node-a", oldToken); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := l.GetLockInfo("nginx"); info == nil || info.Node != "node-b" || info.Token != newToken {
+		t.Fatalf("新持锁方的锁不应被释放: %+v", info)
+	}
+	if err := other.RefreshLock("nginx", "node-b", newToken); err != nil {
+		t.Fatalf("新持锁方续期失败: %v", err)
+	}
+}
+
+func TestLeaseLockRelease(t *testing.T) {
+	l := newTestLeaseLock(0)
+	token, _, err := l.TryAcquireLock("nginx", "node-a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.ReleaseLock("nginx", "node-a", token); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := l.GetLockInfo("nginx"); err != nil || info != nil {
+		t.Fatalf("释放后不应有锁信息: %+v err=%v", info, err)
+	}
+	if err := l.RefreshLock("nginx", "node-a", token); !errors.Is(err, ErrLockLost) {
+		t.Fatalf("释放后续期应返回 ErrLockLost，实际: %v", err)
+	}
+	// 释放后立即可被其他节点获取，token 延续 leaseTransitions 递增
+	other := NewK8sLeaseLock(l.Clientset, testNamespace, l.Prefix, l.Timeout, 0)
+	next, acquired, err := other.TryAcquireLock("nginx", "node-b", "")
+	if err != nil || !acquired || next != token+1 {
+		t.Fatalf("释放后重新抢锁: token=%d acquired=%v err=%v", next, acquired, err)
+	}
+}
+
+func TestLeaseLockCapacity(t *testing.T) {
+	l := newTestLeaseLock(1)
+	if _, acquired, err := l.TryAcquireLock("nginx", "node-a", ""); err != nil || !acquired {
+		t.Fatalf("首次抢锁: acquired=%v err=%v", acquired, err)
+	}
+	if _, acquired, err := l.TryAcquireLock("redis", "node-b", ""); !errors.Is(err, ErrLockCapacity) || acquired {
+		t.Fatalf("超过镜像数上限应返回 ErrLockCapacity: acquired=%v err=%v", acquired, err)
+	}
+	if _, acquired, err := l.TryAcquireLock("nginx", "node-b", ""); err != nil || acquired {
+		t.Fatalf("同一镜像被持有: acquired=%v err=%v", acquired, err)
+	}
+}
+
+func TestLeaseLockCollectGarbage(t *testing.T) {
+	l := newTestLeaseLock(0)
+	leases := l.Clientset.CoordinationV1().Leases(testNamespace)
+	released, _, err := l.TryAcquireLock("released", "node-a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.ReleaseLock("released", "node-a", released); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := l.TryAcquireLock("held", "node-a", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := l.TryAcquireLock("recent", "node-a", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.ReleaseLock("recent", "node-a", 1); err != nil {
+		t.Fatal(err)
+	}
+	expireLease(t, l, "released", 2*l.IdleTTL)
+	// 持有中的 Lease 即使本地观察很久未变化，只要仍未过期就保留；这里只把观察时间提前到过期之前
+	expireLease(t, l, "held", l.Timeout/2)
+
+	if err := l.CollectGarbage(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leases.Get(context.TODO(), l.leaseName("released"), metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Fatalf("空闲超过 IdleTTL 的 Lease 应被删除，实际: %v", err)
+	}
+	for _, image := range []string{"held", "recent"} {
+		if _, err := leases.Get(context.TODO(), l.leaseName(image), metav1.GetOptions{}); err != nil {
+			t.Fatalf("%s 的 Lease 不应被删除: %v", image, err)
+		}
+	}
+	l.mu.Lock()
+	_, observed := l.observed[l.leaseName("released")]
+	l.mu.Unlock()
+	if observed {
+		t.Fatal("已删除 Lease 的观察记录应被清理")
+	}
+
+	// 删除后重新抢锁，token 从头计数
+	token, acquired, err := l.TryAcquireLock("released", "node-b", "")
+	if err != nil || !acquired || token != 1 {
+		t.Fatalf("删除后重新抢锁: token=%d acquired=%v err=%v", token, acquired, err)
+	}
+}
@@ -0,0 +1,184 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const testNamespace = "kube-system"
+
+// newFakeClientset 返回维护 resourceVersion 的 fake clientset：create/update 时递增 resourceVersion，
+// update 携带的 resourceVersion 与当前不一致时返回 Conflict，与 API server 的乐观并发控制一致
+func newFakeClientset(objects ...runtime.Object) *fake.Clientset {
+	clientset := fake.NewSimpleClientset(objects...)
+	var rv atomic.Int64
+	rv.Store(1000)
+	clientset.PrependReactor("*", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		var obj runtime.Object
+		switch a := action.(type) {
+		case k8stesting.CreateAction:
+			obj = a.GetObject()
+		case k8stesting.UpdateAction:
+			obj = a.GetObject()
+			accessor, err := meta.Accessor(obj)
+			if err != nil {
+				return false, nil, nil
+			}
+			current, err := clientset.Tracker().Get(action.GetResource(), action.GetNamespace(), accessor.GetName())
+			if err != nil {
+				return false, nil, nil
+			}
+			currentAccessor, _ := meta.Accessor(current)
+			if accessor.GetResourceVersion() != currentAccessor.GetResourceVersion() {
+				return true, nil, apierrors.NewConflict(action.GetResource().GroupResource(), accessor.GetName(), errors.New("resourceVersion 不一致"))
+			}
+		default:
+			return false, nil, nil
+		}
+		accessor, err := meta.Accessor(obj)
+		if err != nil {
+			return false, nil, nil
+		}
+		accessor.SetResourceVersion(strconv.FormatInt(rv.Add(1), 10))
+		return false, nil, nil
+	})
+	return clientset
+}
+
+func newTestConfigMapLock(t *testing.T, maxImages int) (*K8sConfigMapLock, *fake.Clientset) {
+	t.Helper()
+	clientset := newFakeClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "image-preheat-lock", Namespace: testNamespace, ResourceVersion: "1"},
+	})
+	return NewK8sConfigMapLock(clientset, testNamespace, "image-preheat-lock", time.Minute, maxImages), clientset
+}
+
+// expireConfigMapLock 将镜像锁的时间戳改到锁超时之前
+func expireConfigMapLock(t *testing.T, l *K8sConfigMapLock, image string) {
+	t.Helper()
+	cm, err := l.Clientset.CoreV1().ConfigMaps(l.Namespace).Get(context.TODO(), l.CMName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := decodeLockInfo(cm.Data[LockKey(image)])
+	if err != nil {
+		t.Fatal(err)
+	}
+	info.Timestamp = time.Now().Add(-2 * l.Timeout)
+	data, _ := json.Marshal(info)
+	cm.Data[LockKey(image)] = string(data)
+	if _, err := l.Clientset.CoreV1().ConfigMaps(l.Namespace).Update(context.TODO(), cm, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigMapLockAcquireAndConflict(t *testing.T) {
+	l, _ := newTestConfigMapLock(t, 0)
+	token, acquired, err := l.TryAcquireLock("nginx", "node-a", "10.0.0.1")
+	if err != nil || !acquired || token != 1 {
+		t.Fatalf("首次抢锁: token=%d acquired=%v err=%v", token, acquired, err)
+	}
+	if _, acquired, err := l.TryAcquireLock("nginx", "node-b", "10.0.0.2"); err != nil || acquired {
+		t.Fatalf("其他节点持锁时不应抢到: acquired=%v err=%v", acquired, err)
+	}
+	info, err := l.GetLockInfo("nginx")
+	if err != nil || info == nil || info.Node != "node-a" || info.Addr != "10.0.0.1" || info.Token != token {
+		t.Fatalf("锁信息不符: %+v err=%v", info, err)
+	}
+	// 不同镜像互不阻塞
+	if _, acquired, err := l.TryAcquireLock("redis", "node-b", "10.0.0.2"); err != nil || !acquired {
+		t.Fatalf("不同镜像应可同时加锁: acquired=%v err=%v", acquired, err)
+	}
+}
+
+func TestConfigMapLockTakeoverAfterExpiry(t *testing.T) {
+	l, _ := newTestConfigMapLock(t, 0)
+	oldToken, _, err := l.TryAcquireLock("nginx", "node-a", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expireConfigMapLock(t, l, "nginx")
+	newToken, acquired, err := l.TryAcquireLock("nginx", "node-b", "10.0.0.2")
+	if err != nil || !acquired {
+		t.Fatalf("锁超时后应可接管: acquired=%v err=%v", acquired, err)
+	}
+	if newToken <= oldToken {
+		t.Fatalf("fencing token 应单调递增: old=%d new=%d", oldToken, newToken)
+	}
+	if err := l.RefreshLock("nginx", "node-a", oldToken); !errors.Is(err, ErrLockLost) {
+		t.Fatalf("被接管后续期应返回 ErrLockLost，实际: %v", err)
+	}
+	// 原持锁方释放不影响新持锁方
+	if err := l.ReleaseLock("nginx", "node-a", oldToken); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := l.GetLockInfo("nginx"); info == nil || info.Node != "node-b" {
+		t.Fatalf("新持锁方的锁不应被释放: %+v", info)
+	}
+	if err := l.RefreshLock("nginx", "node-b", newToken); err != nil {
+		t.Fatalf("新持锁方续期失败: %v", err)
+	}
+}
+
+func TestConfigMapLockRelease(t *testing.T) {
+	l, _ := newTestConfigMapLock(t, 0)
+	token, _, err := l.TryAcquireLock("nginx", "node-a", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.ReleaseLock("nginx", "node-a", token); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := l.GetLockInfo("nginx"); err != nil || info != nil {
+		t.Fatalf("释放后不应有锁信息: %+v err=%v", info, err)
+	}
+	if err := l.RefreshLock("nginx", "node-a", token); !errors.Is(err, ErrLockLost) {
+		t.Fatalf("释放后续期应返回 ErrLockLost，实际: %v", err)
+	}
+	next, acquired, err := l.TryAcquireLock("nginx", "node-b", "10.0.0.2")
+	if err != nil || !acquired || next <= token {
+		t.Fatalf("释放后应可重新抢锁且 token 递增: token=%d acquired=%v err=%v", next, acquired, err)
+	}
+}
+
+func TestConfigMapLockCapacity(t *testing.T) {
+	l, _ := newTestConfigMapLock(t, 1)
+	if _, acquired, err := l.TryAcquireLock("nginx", "node-a", ""); err != nil || !acquired {
+		t.Fatalf("首次抢锁: acquired=%v err=%v", acquired, err)
+	}
+	if _, acquired, err := l.TryAcquireLock("redis", "node-b", ""); !errors.Is(err, ErrLockCapacity) || acquired {
+		t.Fatalf("超过镜像数上限应返回 ErrLockCapacity: acquired=%v err=%v", acquired, err)
+	}
+	// 同一镜像被持有时仍返回未抢到，而不是容量已满
+	if _, acquired, err := l.TryAcquireLock("nginx", "node-b", ""); err != nil || acquired {
+		t.Fatalf("同一镜像被持有: acquired=%v err=%v", acquired, err)
+	}
+}
+
+func TestConfigMapLockConflictRetry(t *testing.T) {
+	l, clientset := newTestConfigMapLock(t, 0)
+	// 第一次 update 前由其他节点修改 ConfigMap，模拟并发抢锁
+	var injected atomic.Bool
+	clientset.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if injected.Swap(true) {
+			return false, nil, nil
+		}
+		return true, nil, apierrors.NewConflict(corev1.Resource("configmaps"), l.CMName, errors.New("并发修改"))
+	})
+	if _, acquired, err := l.TryAcquireLock("nginx", "node-a", ""); err != nil || !acquired {
+		t.Fatalf("冲突后应重试成功: acquired=%v err=%v", acquired, err)
+	}
+}
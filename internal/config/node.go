@@ -0,0 +1,75 @@
+package config
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// NodeLabels 读取并缓存本节点 Node 对象的标签（及 DiskPressure 状态）
+type NodeLabels struct {
+	Clientset kubernetes.Interface
+	NodeName  string
+	// 缓存有效期，过期后下次 Get 时重新读取 Node
+	TTL time.Duration
+
+	mu           sync.Mutex
+	labels       map[string]string
+	diskPressure bool
+	fetched      time.Time
+}
+
+func NewNodeLabels(clientset kubernetes.Interface, nodeName string, ttl time.Duration) *NodeLabels {
+	return &NodeLabels{Clientset: clientset, NodeName: nodeName, TTL: ttl}
+}
+
+// Get 返回节点标签副本。读取 Node 失败时若有缓存则同时返回缓存与错误，由调用方决定是否使用
+func (n *NodeLabels) Get(ctx context.Context) (map[string]string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	err := n.refresh(ctx)
+	if n.labels == nil {
+		return nil, err
+	}
+	return copyLabels(n.labels), err
+}
+
+// DiskPressure 返回节点 DiskPressure condition 是否为 True，读取失败时同 Get 返回缓存值与错误
+func (n *NodeLabels) DiskPressure(ctx context.Context) (bool, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	err := n.refresh(ctx)
+	return n.diskPressure, err
+}
+
+// refresh 缓存过期时重新读取 Node，调用方需持有锁
+func (n *NodeLabels) refresh(ctx context.Context) error {
+	if n.labels != nil && time.Since(n.fetched) < n.TTL {
+		return nil
+	}
+	node, err := n.Clientset.CoreV1().Nodes().Get(ctx, n.NodeName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	n.labels = copyLabels(node.Labels)
+	n.diskPressure = false
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == corev1.NodeDiskPressure && cond.Status == corev1.ConditionTrue {
+			n.diskPressure = true
+		}
+	}
+	n.fetched = time.Now()
+	return nil
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	c := make(map[string]string, len(labels))
+	for k, v := range labels {
+		c[k] = v
+	}
+	return c
+}
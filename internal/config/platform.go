@@ -0,0 +1,53 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParsePlatform 解析 os/arch[/variant] 格式的平台，统一为小写
+func ParsePlatform(platform string) (goos, arch, variant string, err error) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(platform)), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return "", "", "", fmt.Errorf("平台格式错误（应为 os/arch[/variant]）: %q", platform)
+	}
+	if len(parts) == 3 {
+		variant = parts[2]
+	}
+	return parts[0], parts[1], variant, nil
+}
+
+// NormalizePlatform 返回规范化的平台字符串，为空时返回节点平台，无法解析时原样返回
+func NormalizePlatform(platform string) string {
+	if platform == "" {
+		platform = NodePlatform
+	}
+	goos, arch, variant, err := ParsePlatform(platform)
+	if err != nil {
+		return platform
+	}
+	if variant == "" {
+		return goos + "/" + arch
+	}
+	return goos + "/" + arch + "/" + variant
+}
+
+// PlatformMatches 判断两个平台是否一致：os 与 arch 必须相同，variant 仅在双方都指定时比较；
+// 任一方为空视为不限制
+func PlatformMatches(a, b string) bool {
+	if a == "" || b == "" {
+		return true
+	}
+	aOS, aArch, aVariant, err := ParsePlatform(a)
+	if err != nil {
+		return false
+	}
+	bOS, bArch, bVariant, err := ParsePlatform(b)
+	if err != nil {
+		return false
+	}
+	if aOS != bOS || aArch != bArch {
+		return false
+	}
+	return aVariant == "" || bVariant == "" || aVariant == bVariant
+}
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// RegistryCredential 镜像仓库凭据（dockerconfigjson auths 中的一项）
+type RegistryCredential struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	Auth          string `json:"auth,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// dockerConfig dockerconfigjson 格式（~/.docker/config.json）
+type dockerConfig struct {
+	Auths map[string]RegistryCredential `json:"auths"`
+}
+
+// RegistryKeychain 从 dockerconfigjson 格式的 Secret（imagePullSecrets）与挂载文件读取镜像仓库凭据，
+// 按仓库域名查找。Secret 为 <name> 或 <namespace>/<name>，前者位于 Namespace 下；
+// 文件中的凭据优先于 Secret，靠前的 Secret 优先于靠后的
+type RegistryKeychain struct {
+	Clientset kubernetes.Interface
+	Namespace string
+	Secrets   []string
+	File      string
+	// 缓存有效期，过期后下次 Lookup 时重新读取（Secret 轮换后无需重启）
+	TTL time.Duration
+
+	mu      sync.Mutex
+	auths   map[string]RegistryCredential
+	fetched time.Time
+}
+
+func NewRegistryKeychain(clientset kubernetes.Interface, namespace string, secrets []string, file string, ttl time.Duration) *RegistryKeychain {
+	return &RegistryKeychain{Clientset: clientset, Namespace: namespace, Secrets: secrets, File: file, TTL: ttl}
+}
+
+// Lookup 返回仓库域名（如 docker.io、registry.example.com:5000）对应的凭据。
+// 重新读取失败时若有缓存则同时返回缓存结果与错误
+func (k *RegistryKeychain) Lookup(ctx context.Context, domain string) (*RegistryCredential, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	err := k.refresh(ctx)
+	cred, ok := k.auths[RegistryAuthKey(domain)]
+	if !ok {
+		return nil, err
+	}
+	return &cred, err
+}
+
+// refresh 缓存过期时重新读取文件与 Secret，调用方需持有锁。部分来源读取失败时保留其余来源，
+// 全部失败且已有缓存时沿用缓存
+func (k *RegistryKeychain) refresh(ctx context.Context) error {
+	if k.auths != nil && time.Since(k.fetched) < k.TTL {
+		return nil
+	}
+	auths := make(map[string]RegistryCredential)
+	var errs []string
+	sources := 0
+	// 先读取低优先级来源，高优先级来源覆盖
+	for i := len(k.Secrets) - 1; i >= 0; i-- {
+		sources++
+		if err := k.loadSecret(ctx, k.Secrets[i], auths); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if k.File != "" {
+		sources++
+		if err := loadDockerConfigFile(k.File, auths); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 && len(errs) == sources && k.auths != nil {
+		return fmt.Errorf("读取镜像仓库凭据失败: %s", strings.Join(errs, "; "))
+	}
+	k.auths = auths
+	k.fetched = time.Now()
+	if len(errs) > 0 {
+		return fmt.Errorf("读取镜像仓库凭据失败: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// loadSecret 读取 kubernetes.io/dockerconfigjson（或旧的 kubernetes.io/dockercfg）类型的 Secret
+func (k *RegistryKeychain) loadSecret(ctx context.Context, ref string, auths map[string]RegistryCredential) error {
+	namespace, name := k.Namespace, ref
+	if ns, n, ok := strings.Cut(ref, "/"); ok {
+		namespace, name = ns, n
+	}
+	secret, err := k.Clientset.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("Secret %s/%s: %v", namespace, name, err)
+	}
+	if data, ok := secret.Data[corev1.DockerConfigJsonKey]; ok {
+		err = parseDockerConfig(data, auths)
+	} else if data, ok := secret.Data[corev1.DockerConfigKey]; ok {
+		var legacy map[string]RegistryCredential
+		if err = json.Unmarshal(data, &legacy); err == nil {
+			addRegistryAuths(legacy, auths)
+		}
+	} else {
+		err = fmt.Errorf("缺少 %s", corev1.DockerConfigJsonKey)
+	}
+	if err != nil {
+		return fmt.Errorf("Secret %s/%s: %v", namespace, name, err)
+	}
+	return nil
+}
+
+// loadDockerConfigFile 读取挂载的 dockerconfigjson 文件
+func loadDockerConfigFile(path string, auths map[string]RegistryCredential) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := parseDockerConfig(data, auths); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+func parseDockerConfig(data []byte, auths map[string]RegistryCredential) error {
+	var cfg dockerConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return err
+	}
+	addRegistryAuths(cfg.Auths, auths)
+	return nil
+}
+
+// addRegistryAuths 按规范化的仓库域名加入凭据，仅有 auth 字段时解码出用户名与密码
+func addRegistryAuths(src, auths map[string]RegistryCredential) {
+	for server, cred := range src {
+		if cred.Username == "" && cred.Auth != "" {
+			if decoded, err := base64.StdEncoding.DecodeString(cred.Auth); err == nil {
+				cred.Username, cred.Password, _ = strings.Cut(string(decoded), ":")
+			}
+		}
+		auths[RegistryAuthKey(server)] = cred
+	}
+}
+
+// RegistryAuthKey 规范化 dockerconfigjson 中的仓库地址：去掉协议与路径，Docker Hub 的各种写法统一为 docker.io
+func RegistryAuthKey(server string) string {
+	host := strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+	host, _, _ = strings.Cut(host, "/")
+	host = strings.ToLower(host)
+	switch host {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return "docker.io"
+	}
+	return host
+}
@@ -0,0 +1,149 @@
+package config
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+)
+
+// CertReloader 从文件加载证书、私钥与 CA，文件变化（如 Secret 轮换）时重新加载。
+// 握手时通过回调读取当前证书，重新加载失败时保留上次加载结果
+type CertReloader struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	pool *x509.CertPool
+}
+
+func NewCertReloader(certFile, keyFile, caFile string) *CertReloader {
+	return &CertReloader{CertFile: certFile, KeyFile: keyFile, CAFile: caFile}
+}
+
+// Load 加载证书、私钥与 CA
+func (r *CertReloader) Load() error {
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return fmt.Errorf("加载证书失败: %v", err)
+	}
+	data, err := os.ReadFile(r.CAFile)
+	if err != nil {
+		return fmt.Errorf("读取 CA 失败: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("CA 文件中没有有效证书: %s", r.CAFile)
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.pool = pool
+	r.mu.Unlock()
+	return nil
+}
+
+// Watch 监听证书所在目录，文件变化时重新加载，ctx 取消时退出。
+// 监听目录而非文件：Secret 挂载通过替换 ..data 符号链接更新
+func (r *CertReloader) Watch(ctx context.Context) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Error().Err(err).Msg("创建证书文件监视器失败，证书不会热加载")
+		return
+	}
+	defer watcher.Close()
+	dirs := make(map[string]bool)
+	for _, f := range []string{r.CertFile, r.KeyFile, r.CAFile} {
+		dir := filepath.Dir(f)
+		if dirs[dir] {
+			continue
+		}
+		dirs[dir] = true
+		if err := watcher.Add(dir); err != nil {
+			log.Error().Err(err).Str("dir", dir).Msg("添加证书监视路径失败")
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Remove|fsnotify.Rename) == 0 {
+				continue
+			}
+			if err := r.Load(); err != nil {
+				log.Warn().Err(err).Str("file", event.Name).Msg("证书文件变化但重新加载失败，沿用当前证书")
+				continue
+			}
+			log.Info().Str("file", event.Name).Msg("检测到证书文件变化，已重新加载")
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Error().Err(err).Msg("证书文件监视错误")
+		}
+	}
+}
+
+func (r *CertReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, r.pool
+}
+
+// ServerConfig 服务端 TLS 配置：校验客户端提供的证书（未提供时由调用方按接口决定是否拒绝）
+func (r *CertReloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := r.current()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				ClientCAs:    pool,
+				ClientAuth:   tls.VerifyClientCertIfGiven,
+			}, nil
+		},
+	}
+}
+
+// ClientConfig 客户端 TLS 配置：出示本端证书，并以当前 CA 校验服务端证书。
+// 节点间按 Pod IP 访问，serverName 非空时校验证书包含该 DNS 名称，否则只校验证书链
+func (r *CertReloader) ClientConfig(serverName string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// 由 VerifyConnection 以热加载的 CA 校验，标准校验无法替换 RootCAs 且要求证书包含 IP
+		InsecureSkipVerify: true,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		},
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("服务端未提供证书")
+			}
+			_, pool := r.current()
+			opts := x509.VerifyOptions{
+				Roots:         pool,
+				DNSName:       serverName,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, c := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(c)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		},
+	}
+}
@@ -0,0 +1,111 @@
+package docker
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"image-preheat/internal/config"
+
+	"github.com/rs/zerolog/log"
+	"k8s.io/client-go/kubernetes"
+)
+
+// 凭据缓存有效期，Secret 或挂载文件更新后最迟该时间后生效
+const registryAuthTTL = time.Minute
+
+// Docker Hub 在 dockerconfigjson 中的地址
+const dockerHubAuthServer = "https://index.docker.io/v1/"
+
+var registryKeychain *config.RegistryKeychain
+
+// InitRegistryAuth 按 REGISTRY_AUTH_SECRETS 与 REGISTRY_AUTH_FILE 初始化镜像仓库凭据；
+// 均未配置时回源拉取沿用容器运行时自身的凭据
+func InitRegistryAuth() error {
+	if len(config.RegistryAuthSecrets) == 0 && config.RegistryAuthFile == "" {
+		return nil
+	}
+	var clientset kubernetes.Interface
+	if len(config.RegistryAuthSecrets) > 0 {
+		cs, err := config.NewK8sClientset()
+		if err != nil {
+			return fmt.Errorf("初始化K8s客户端失败: %v", err)
+		}
+		clientset = cs
+	}
+	registryKeychain = config.NewRegistryKeychain(clientset, config.K8sNamespace, config.RegistryAuthSecrets, config.RegistryAuthFile, registryAuthTTL)
+	// 启动时读取一次，尽早暴露 Secret 不存在、无权限等配置问题
+	if _, err := registryKeychain.Lookup(context.Background(), defaultDomain); err != nil {
+		log.Warn().Err(err).Msg("读取镜像仓库凭据失败，将在拉取时重试")
+	}
+	log.Info().Strs("secrets", config.RegistryAuthSecrets).Str("file", config.RegistryAuthFile).Msg("镜像仓库凭据初始化完成")
+	return nil
+}
+
+// SetRegistryKeychain 替换镜像仓库凭据来源（便于测试注入），nil 表示不使用凭据
+func SetRegistryKeychain(keychain *config.RegistryKeychain) {
+	registryKeychain = keychain
+}
+
+// registryCredential 返回 image 所在仓库的域名与凭据，未配置或没有该仓库的凭据时返回 nil
+func registryCredential(ctx context.Context, image string) (string, *config.RegistryCredential) {
+	if registryKeychain == nil {
+		return "", nil
+	}
+	ref, err := ParseReference(image)
+	if err != nil {
+		return "", nil
+	}
+	cred, err := registryKeychain.Lookup(ctx, ref.Domain)
+	if err != nil {
+		log.Warn().Err(err).Str("registry", ref.Domain).Msg("读取镜像仓库凭据失败")
+	}
+	return ref.Domain, cred
+}
+
+// authServer 仓库域名在 docker 凭据中的地址
+func authServer(domain string) string {
+	if domain == defaultDomain {
+		return dockerHubAuthServer
+	}
+	return domain
+}
+
+// writeDockerConfig 将单个仓库的凭据写入临时目录下的 config.json，供 docker --config 使用，调用方负责删除目录
+func writeDockerConfig(domain string, cred *config.RegistryCredential) (string, error) {
+	dir, err := os.MkdirTemp("", "registry-auth-")
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(map[string]any{
+		"auths": map[string]*config.RegistryCredential{authServer(domain): cred},
+	})
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, "config.json"), data, 0o600)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// encodeAuthConfig Engine API X-Registry-Auth 头：base64url 编码的 AuthConfig JSON
+func encodeAuthConfig(domain string, cred *config.RegistryCredential) (string, error) {
+	authConfig := map[string]string{"serveraddress": authServer(domain)}
+	if cred.IdentityToken != "" {
+		authConfig["identitytoken"] = cred.IdentityToken
+	} else {
+		authConfig["username"] = cred.Username
+		authConfig["password"] = cred.Password
+	}
+	data, err := json.Marshal(authConfig)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(data), nil
+}
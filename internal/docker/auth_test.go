@@ -0,0 +1,86 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"image-preheat/internal/config"
+)
+
+// withTestRegistry 启动模拟镜像仓库的 TLS 服务，返回其域名
+func withTestRegistry(t *testing.T, handler http.HandlerFunc) string {
+	t.Helper()
+	srv := httptest.NewTLSServer(handler)
+	t.Cleanup(srv.Close)
+	client := registryHTTPClient
+	registryHTTPClient = srv.Client()
+	t.Cleanup(func() { registryHTTPClient = client })
+	return strings.TrimPrefix(srv.URL, "https://")
+}
+
+func TestRegistryAuthorization(t *testing.T) {
+	cred := &config.RegistryCredential{Username: "user", Password: "pass"}
+	ctx := context.Background()
+
+	// Basic
+	if auth, err := registryAuthorization(ctx, `Basic realm="registry"`, cred); err != nil || auth != "Basic dXNlcjpwYXNz" {
+		t.Fatalf("Basic 认证: %q %v", auth, err)
+	}
+
+	// Bearer：以凭据换取 pull 范围的 token
+	var scope, basic string
+	var realm string
+	domain := withTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			scope, basic = r.URL.Query().Get("scope"), r.Header.Get("Authorization")
+			fmt.Fprint(w, `{"token":"t0ken"}`)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm=%q,service="registry",scope="repository:team/app:pull"`, realm))
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	realm = "https://" + domain + "/token"
+	auth, err := registryAuthorization(ctx, fmt.Sprintf(`Bearer realm=%q,service="registry",scope="repository:team/app:pull"`, realm), cred)
+	if err != nil || auth != "Bearer t0ken" {
+		t.Fatalf("Bearer 认证: %q %v", auth, err)
+	}
+	if scope != "repository:team/app:pull" || basic != "Basic dXNlcjpwYXNz" {
+		t.Fatalf("token 请求 scope=%q authorization=%q", scope, basic)
+	}
+}
+
+func TestRegistryHostCredentials(t *testing.T) {
+	ctx := context.Background()
+	if f := registryHostCredentials(ctx, "nginx:1.25"); f != nil {
+		t.Fatal("未配置凭据时应匿名拉取")
+	}
+
+	dir := t.TempDir()
+	authFile := filepath.Join(dir, "config.json")
+	data := `{"auths":{"https://index.docker.io/v1/":{"auth":"dXNlcjpwYXNz"},"ghcr.io":{"identitytoken":"refresh"}}}`
+	if err := os.WriteFile(authFile, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	SetRegistryKeychain(config.NewRegistryKeychain(nil, "", nil, authFile, time.Minute))
+	t.Cleanup(func() { SetRegistryKeychain(nil) })
+
+	f := registryHostCredentials(ctx, "nginx:1.25")
+	if user, secret, _ := f("registry-1.docker.io"); user != "user" || secret != "pass" {
+		t.Fatalf("docker.io 凭据: %q %q", user, secret)
+	}
+	// 不向其他地址（如 blob 重定向的存储服务）提供凭据
+	if user, secret, _ := f("ghcr.io"); user != "" || secret != "" {
+		t.Fatalf("其他地址不应返回凭据: %q %q", user, secret)
+	}
+	f = registryHostCredentials(ctx, "ghcr.io/team/app:v1")
+	if user, secret, _ := f("ghcr.io"); user != "" || secret != "refresh" {
+		t.Fatalf("identitytoken 应作为 refresh token: %q %q", user, secret)
+	}
+}
@@ -1,33 +1,84 @@
 package docker
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"strings"
+
+	"image-preheat/internal/config"
+
+	"github.com/rs/zerolog/log"
 )
 
-// DockerClient 定义 Docker 操作接口
+// PullProgress 拉取进度事件（单层）
+type PullProgress struct {
+	Layer   string // 层 ID（短 digest）
+	Status  string // 状态，如 Downloading、Download complete、Pull complete、Already exists
+	Current int64  // 当前状态下已处理字节数，未知时为 0
+	Total   int64  // 当前状态下总字节数，未知时为 0
+}
+
+// PullOptions 拉取选项
+type PullOptions struct {
+	// 进度回调，可为 nil
+	Progress func(PullProgress)
+	// 镜像平台（os/arch[/variant]），为空时由运行时选择当前平台
+	Platform string
+}
+
+// 拉取进度状态
+const (
+	PullStatusDownloading      = "Downloading"
+	PullStatusDownloadComplete = "Download complete"
+	PullStatusPullComplete     = "Pull complete"
+	PullStatusAlreadyExists    = "Already exists"
+)
+
+// ErrLayerTransferUnsupported 当前运行时不支持层级节点间传输（加载时要求归档中的层文件齐全）
+var ErrLayerTransferUnsupported = errors.New("当前镜像运行时不支持层级传输")
+
+// ErrImageInUse 镜像仍被容器使用，拒绝删除
+var ErrImageInUse = errors.New("镜像正在被容器使用")
+
+// DockerClient 定义 Docker 操作接口，所有方法在 ctx 取消时中止底层操作
 type DockerClient interface {
 	// 拉取镜像
-	Pull(image string) error
+	Pull(ctx context.Context, image string, opts PullOptions) error
 	// 保存镜像到流
-	Save(image string, writer io.Writer) error
-	// 从流加载镜像
-	Load(reader io.Reader) error
+	Save(ctx context.Context, image string, writer io.Writer) error
+	// 从流加载镜像，platform 为归档中要导入的平台（docker 加载归档中的全部内容，忽略该参数）
+	Load(ctx context.Context, reader io.Reader, platform string) error
 	// 获取本地镜像列表
-	GetImages() (map[string]struct{}, error)
+	GetImages(ctx context.Context) (map[string]struct{}, error)
 	// 检查镜像是否存在
-	ImageExists(image string) (bool, error)
+	ImageExists(ctx context.Context, image string) (bool, error)
 	// 获取镜像的所有层digest
-	GetImageDigests(image string) ([]string, error)
+	GetImageDigests(ctx context.Context, image string) ([]string, error)
 	// 检查单个层是否存在
-	CheckLayerExists(digest string) (bool, error)
+	CheckLayerExists(ctx context.Context, digest string) (bool, error)
 	// 批量检查层是否存在
-	CheckLayersExist(digests []string) (exists, missing []string, err error)
+	CheckLayersExist(ctx context.Context, digests []string) (exists, missing []string, err error)
+	// 获取镜像的层 diffID 列表（RootFS.Layers，自底向上）
+	GetImageDiffIDs(ctx context.Context, image string) ([]string, error)
+	// 返回 diffIDs 中自底向上连续已存在于本地的层数，运行时不支持层级传输时返回 ErrLayerTransferUnsupported
+	LocalLayerChainLength(ctx context.Context, diffIDs []string) (int, error)
+	// 获取镜像在其仓库下的 manifest digest（RepoDigests 中与镜像同仓库的 digest），
+	// 节点间传输加载的镜像可能没有
+	GetRepoDigests(ctx context.Context, image string) ([]string, error)
+	// 删除镜像引用（不强制，镜像仍被容器使用时由运行时拒绝或由调用方预先检查）
+	RemoveImage(ctx context.Context, image string) error
+	// 获取容器（含已停止的）使用的镜像 ID 集合（与 GetImageID 的返回值可比较）
+	GetImagesInUse(ctx context.Context) (map[string]struct{}, error)
+	// 获取本地镜像的平台（os/arch[/variant]）
+	GetImagePlatform(ctx context.Context, image string) (string, error)
+	// 获取本地镜像 ID（镜像 config 的 digest）
+	GetImageID(ctx context.Context, image string) (string, error)
 }
 
 // CommandLineClient 基于命令行的 Docker 客户端实现
@@ -38,34 +89,68 @@ func NewCommandLineClient() *CommandLineClient {
 	return &CommandLineClient{}
 }
 
-// Pull 拉取镜像
-func (c *CommandLineClient) Pull(image string) error {
-	cmd := exec.Command("docker", "pull", image)
-	cmd.Stdout = os.Stdout
+// Pull 拉取镜像，配置了仓库凭据时通过 --config 传入
+// 非 TTY 下 docker pull 仅输出 "<layer>: <status>" 行，无字节级进度
+func (c *CommandLineClient) Pull(ctx context.Context, image string, opts PullOptions) error {
+	args := []string{"pull"}
+	if opts.Platform != "" {
+		args = append(args, "--platform", opts.Platform)
+	}
+	// 配置了该仓库的凭据时使用仅包含该凭据的临时配置目录
+	if domain, cred := registryCredential(ctx, image); cred != nil {
+		dir, err := writeDockerConfig(domain, cred)
+		if err != nil {
+			return fmt.Errorf("写入镜像仓库凭据失败: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		args = append([]string{"--config", dir}, args...)
+	}
+	cmd := exec.CommandContext(ctx, "docker", append(args, image)...)
 	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	if opts.Progress == nil {
+		cmd.Stdout = os.Stdout
+		return cmd.Run()
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fmt.Fprintln(os.Stdout, line)
+		if layer, status, ok := strings.Cut(line, ": "); ok && !strings.ContainsAny(layer, " /:") {
+			opts.Progress(PullProgress{Layer: layer, Status: status})
+		}
+	}
+	return cmd.Wait()
 }
 
 // Save 保存镜像到流
-func (c *CommandLineClient) Save(image string, writer io.Writer) error {
-	cmd := exec.Command("docker", "save", image)
+func (c *CommandLineClient) Save(ctx context.Context, image string, writer io.Writer) error {
+	cmd := exec.CommandContext(ctx, "docker", "save", image)
 	cmd.Stdout = writer
 	cmd.Stderr = os.Stderr
 	return cmd.Run()
 }
 
 // Load 从流加载镜像
-func (c *CommandLineClient) Load(reader io.Reader) error {
-	cmd := exec.Command("docker", "load")
+func (c *CommandLineClient) Load(ctx context.Context, reader io.Reader, platform string) error {
+	cmd := exec.CommandContext(ctx, "docker", "load")
 	cmd.Stdin = reader
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	return cmd.Run()
 }
 
-// GetImages 获取本地镜像列表
-func (c *CommandLineClient) GetImages() (map[string]struct{}, error) {
-	cmd := exec.Command("docker", "images", "--format", "{{.Repository}}:{{.Tag}}")
+// GetImages 获取本地镜像集合，包含 repo:tag、repo@digest（RepoDigest）的原始与规范形式及镜像 ID，
+// 使用 HasImage 查询
+func (c *CommandLineClient) GetImages(ctx context.Context) (map[string]struct{}, error) {
+	cmd := exec.CommandContext(ctx, "docker", "images", "--digests", "--no-trunc",
+		"--format", "{{.Repository}}\t{{.Tag}}\t{{.Digest}}\t{{.ID}}")
 	output, err := cmd.Output()
 	if err != nil {
 		return nil, err
@@ -73,144 +158,183 @@ func (c *CommandLineClient) GetImages() (map[string]struct{}, error) {
 
 	images := make(map[string]struct{})
 	for _, line := range strings.Split(string(output), "\n") {
-		if line != "" {
-			images[line] = struct{}{}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 4 {
+			continue
+		}
+		repo, tag, digest, id := fields[0], fields[1], fields[2], fields[3]
+		if repo != "<none>" {
+			if tag != "<none>" {
+				addImageKeys(images, repo+":"+tag)
+			}
+			if digest != "<none>" {
+				addImageKeys(images, repo+"@"+digest)
+			}
+		}
+		if id != "" {
+			images[id] = struct{}{}
 		}
 	}
 	return images, nil
 }
 
 // ImageExists 检查镜像是否存在
-func (c *CommandLineClient) ImageExists(image string) (bool, error) {
-	images, err := c.GetImages()
+func (c *CommandLineClient) ImageExists(ctx context.Context, image string) (bool, error) {
+	images, err := c.GetImages(ctx)
 	if err != nil {
 		return false, err
 	}
-	_, exists := images[image]
-	return exists, nil
+	return HasImage(images, image), nil
 }
 
-// GetImageDigests 获取镜像的所有层digest
-func (c *CommandLineClient) GetImageDigests(image string) ([]string, error) {
-	// 使用 docker inspect 获取镜像的RootFS.Layers（diffID）
-	cmd := exec.Command("docker", "inspect", "--format={{json .RootFS.Layers}}", image)
-	output, err := cmd.Output()
+// GetRepoDigests 获取镜像在其仓库下的 manifest digest（RepoDigests）
+func (c *CommandLineClient) GetRepoDigests(ctx context.Context, image string) ([]string, error) {
+	output, err := exec.CommandContext(ctx, "docker", "image", "inspect", "--format={{json .RepoDigests}}", image).Output()
 	if err != nil {
 		return nil, err
 	}
-
-	// 解析JSON数组，获取diffID列表
-	var diffIDs []string
-	if err := json.Unmarshal(output, &diffIDs); err != nil {
+	var repoDigests []string
+	if err := json.Unmarshal(output, &repoDigests); err != nil {
 		return nil, err
 	}
+	return digestsForRepo(image, repoDigests), nil
+}
 
-	var digests []string
-	for _, diffID := range diffIDs {
-		diffID = strings.TrimSpace(diffID)
-		if diffID == "" {
-			continue
-		}
-		// 从diffID获取digest
-		digest, err := c.getDigestFromDiffID(diffID)
-		if err != nil {
-			// log.Warn().Err(err).Str("diffID", diffID).Str("image", image).Msg("获取digest失败，跳过")
-			continue
-		}
-		digests = append(digests, digest)
+// GetImagePlatform 获取本地镜像的平台
+func (c *CommandLineClient) GetImagePlatform(ctx context.Context, image string) (string, error) {
+	output, err := exec.CommandContext(ctx, "docker", "image", "inspect",
+		"--format={{.Os}}/{{.Architecture}}{{if .Variant}}/{{.Variant}}{{end}}", image).Output()
+	if err != nil {
+		return "", err
 	}
-
-	return digests, nil
+	return strings.TrimSpace(string(output)), nil
 }
 
-// CheckLayerExists 检查单个层是否存在
-func (c *CommandLineClient) CheckLayerExists(digest string) (bool, error) {
-	// 构建overlay2存储路径
-	diffIDPath := filepath.Join("/var/lib/docker/image/overlay2/distribution/diffid-by-digest/sha256", digest)
-
-	// 检查diffid-by-digest文件是否存在
-	if _, err := os.Stat(diffIDPath); os.IsNotExist(err) {
-		return false, nil
+// GetImageID 获取本地镜像 ID
+func (c *CommandLineClient) GetImageID(ctx context.Context, image string) (string, error) {
+	output, err := exec.CommandContext(ctx, "docker", "image", "inspect", "--format={{.Id}}", image).Output()
+	if err != nil {
+		return "", err
 	}
+	return strings.TrimSpace(string(output)), nil
+}
 
-	// 读取diffID
-	diffIDBytes, err := os.ReadFile(diffIDPath)
+// GetImageDiffIDs 获取镜像的层 diffID 列表
+func (c *CommandLineClient) GetImageDiffIDs(ctx context.Context, image string) ([]string, error) {
+	// 使用 docker inspect 获取镜像的RootFS.Layers（diffID）
+	cmd := exec.CommandContext(ctx, "docker", "inspect", "--format={{json .RootFS.Layers}}", image)
+	output, err := cmd.Output()
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
-	diffID := strings.TrimSpace(string(diffIDBytes))
-	if diffID == "" {
-		return false, nil
+	// 解析JSON数组，获取diffID列表
+	var diffIDs []string
+	if err := json.Unmarshal(output, &diffIDs); err != nil {
+		return nil, err
 	}
+	return diffIDs, nil
+}
 
-	// 检查layerdb目录是否存在
-	layerdbPath := filepath.Join("/var/lib/docker/image/overlay2/layerdb/sha256", diffID)
-	if _, err := os.Stat(layerdbPath); os.IsNotExist(err) {
-		return false, nil
+// LocalLayerChainLength 按 chainID 检查 layerdb，返回自底向上连续已存在的层数
+func (c *CommandLineClient) LocalLayerChainLength(ctx context.Context, diffIDs []string) (int, error) {
+	return localLayerChainLength(diffIDs)
+}
+
+// GetImageDigests 获取镜像的所有层digest
+func (c *CommandLineClient) GetImageDigests(ctx context.Context, image string) ([]string, error) {
+	diffIDs, err := c.GetImageDiffIDs(ctx, image)
+	if err != nil {
+		return nil, err
 	}
+	return digestsFromDiffIDs(diffIDs), nil
+}
 
-	return true, nil
+// CheckLayerExists 检查单个层是否存在
+func (c *CommandLineClient) CheckLayerExists(ctx context.Context, digest string) (bool, error) {
+	return checkLayerExists(digest)
 }
 
 // CheckLayersExist 批量检查层是否存在
-func (c *CommandLineClient) CheckLayersExist(digests []string) (exists, missing []string, err error) {
-	for _, digest := range digests {
-		layerExists, err := c.CheckLayerExists(digest)
-		if err != nil {
-			return nil, nil, err
-		}
-		if layerExists {
-			exists = append(exists, digest)
-		} else {
-			missing = append(missing, digest)
-		}
-	}
-	return exists, missing, nil
+func (c *CommandLineClient) CheckLayersExist(ctx context.Context, digests []string) (exists, missing []string, err error) {
+	return checkLayersExist(digests)
 }
 
-// getDigestFromDiffID 从diffID获取对应的digest
-func (c *CommandLineClient) getDigestFromDiffID(diffID string) (string, error) {
-	// 只取sha256:后面的部分
-	parts := strings.SplitN(diffID, ":", 2)
-	if len(parts) != 2 {
-		return "", fmt.Errorf("diffID格式错误: %s", diffID)
+// RemoveImage 删除镜像标签（docker rmi，不加 -f，被容器使用时失败）
+func (c *CommandLineClient) RemoveImage(ctx context.Context, image string) error {
+	output, err := exec.CommandContext(ctx, "docker", "rmi", image).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("docker rmi 失败: %v: %s", err, strings.TrimSpace(string(output)))
 	}
-	diffIDShort := parts[1]
-
-	// 构建v2metadata-by-diffid文件路径
-	metadataPath := filepath.Join("/var/lib/docker/image/overlay2/distribution/v2metadata-by-diffid/sha256", diffIDShort)
+	return nil
+}
 
-	// 读取metadata文件
-	metadataBytes, err := os.ReadFile(metadataPath)
+// GetImagesInUse 获取所有容器（含已停止的）使用的镜像 ID：容器记录的镜像名可能已指向其他镜像，按 docker inspect 的 .Image 判断
+func (c *CommandLineClient) GetImagesInUse(ctx context.Context) (map[string]struct{}, error) {
+	output, err := exec.CommandContext(ctx, "docker", "ps", "-a", "-q", "--no-trunc").Output()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-
-	// 解析JSON获取digest
-	var metadata []struct {
-		Digest string `json:"Digest"`
+	ids := strings.Fields(string(output))
+	images := make(map[string]struct{})
+	if len(ids) == 0 {
+		return images, nil
 	}
-	if err := json.Unmarshal(metadataBytes, &metadata); err != nil {
-		return "", err
+	args := append([]string{"inspect", "--type", "container", "--format", "{{.Image}}"}, ids...)
+	output, err = exec.CommandContext(ctx, "docker", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("docker inspect 容器失败: %v", err)
 	}
-
-	if len(metadata) == 0 {
-		return "", fmt.Errorf("未找到digest信息")
+	for _, id := range strings.Fields(string(output)) {
+		images[id] = struct{}{}
 	}
-
-	return metadata[0].Digest, nil
+	return images, nil
 }
 
 // 全局 Docker 客户端实例
 var defaultClient DockerClient
 
-// InitDockerClient 初始化 Docker 客户端
+// Docker 客户端类型
+const (
+	ClientTypeCLI        = "cli"
+	ClientTypeAPI        = "api"
+	ClientTypeContainerd = "containerd"
+	ClientTypeAuto       = "auto"
+)
+
+// InitDockerClient 按配置初始化 Docker 客户端，auto 时按节点上存在的 socket 选择
 func InitDockerClient() error {
-	defaultClient = NewCommandLineClient()
+	clientType := config.DockerClientType
+	if clientType == ClientTypeAuto || clientType == "" {
+		clientType = detectClientType()
+	}
+	switch clientType {
+	case ClientTypeContainerd:
+		client, err := NewContainerdClient(config.ContainerdAddress, config.ContainerdNamespace, config.ContainerdSnapshotter)
+		if err != nil {
+			return err
+		}
+		defaultClient = client
+	case ClientTypeCLI:
+		defaultClient = NewCommandLineClient()
+	case ClientTypeAPI:
+		client, err := NewEngineAPIClient(config.DockerHost)
+		if err != nil {
+			return err
+		}
+		defaultClient = client
+	default:
+		return fmt.Errorf("未知的 Docker 客户端类型: %s", clientType)
+	}
+	log.Info().Str("type", clientType).Msg("镜像客户端初始化完成")
 	return nil
 }
 
+// SetClient 替换默认 Docker 客户端（便于测试注入 fake 实现）
+func SetClient(client DockerClient) {
+	defaultClient = client
+}
+
 // GetClient 获取默认 Docker 客户端
 func GetClient() DockerClient {
 	if defaultClient == nil {
@@ -221,35 +345,63 @@ func GetClient() DockerClient {
 }
 
 // 便捷函数，直接调用默认客户端
-func Pull(image string) error {
-	return GetClient().Pull(image)
+func Pull(ctx context.Context, image string, opts PullOptions) error {
+	return GetClient().Pull(ctx, image, opts)
 }
 
-func Save(image string, writer io.Writer) error {
-	return GetClient().Save(image, writer)
+func Save(ctx context.Context, image string, writer io.Writer) error {
+	return GetClient().Save(ctx, image, writer)
 }
 
-func Load(reader io.Reader) error {
-	return GetClient().Load(reader)
+func Load(ctx context.Context, reader io.Reader, platform string) error {
+	return GetClient().Load(ctx, reader, platform)
 }
 
-func GetImages() (map[string]struct{}, error) {
-	return GetClient().GetImages()
+func GetImages(ctx context.Context) (map[string]struct{}, error) {
+	return GetClient().GetImages(ctx)
 }
 
-func ImageExists(image string) (bool, error) {
-	return GetClient().ImageExists(image)
+func ImageExists(ctx context.Context, image string) (bool, error) {
+	return GetClient().ImageExists(ctx, image)
 }
 
 // 新增层状态查询便捷函数
-func GetImageDigests(image string) ([]string, error) {
-	return GetClient().GetImageDigests(image)
+func GetImageDigests(ctx context.Context, image string) ([]string, error) {
+	return GetClient().GetImageDigests(ctx, image)
+}
+
+func CheckLayerExists(ctx context.Context, digest string) (bool, error) {
+	return GetClient().CheckLayerExists(ctx, digest)
+}
+
+func CheckLayersExist(ctx context.Context, digests []string) (exists, missing []string, err error) {
+	return GetClient().CheckLayersExist(ctx, digests)
+}
+
+func GetImageDiffIDs(ctx context.Context, image string) ([]string, error) {
+	return GetClient().GetImageDiffIDs(ctx, image)
+}
+
+func LocalLayerChainLength(ctx context.Context, diffIDs []string) (int, error) {
+	return GetClient().LocalLayerChainLength(ctx, diffIDs)
+}
+
+func RemoveImage(ctx context.Context, image string) error {
+	return GetClient().RemoveImage(ctx, image)
+}
+
+func GetImagesInUse(ctx context.Context) (map[string]struct{}, error) {
+	return GetClient().GetImagesInUse(ctx)
+}
+
+func GetRepoDigests(ctx context.Context, image string) ([]string, error) {
+	return GetClient().GetRepoDigests(ctx, image)
 }
 
-func CheckLayerExists(digest string) (bool, error) {
-	return GetClient().CheckLayerExists(digest)
+func GetImagePlatform(ctx context.Context, image string) (string, error) {
+	return GetClient().GetImagePlatform(ctx, image)
 }
 
-func CheckLayersExist(digests []string) (exists, missing []string, err error) {
-	return GetClient().CheckLayersExist(digests)
+func GetImageID(ctx context.Context, image string) (string, error) {
+	return GetClient().GetImageID(ctx, image)
 }
@@ -0,0 +1,440 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"image-preheat/internal/config"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images/archive"
+	"github.com/containerd/containerd/remotes"
+	remotedocker "github.com/containerd/containerd/remotes/docker"
+	dockerconfig "github.com/containerd/containerd/remotes/docker/config"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rs/zerolog/log"
+)
+
+// 连接 containerd 的超时时间
+const containerdDialTimeout = 10 * time.Second
+
+// ContainerdClient 基于 containerd Go 客户端（镜像服务、内容存储、快照与 lease 服务）的实现，
+// 镜像与内容均位于 kubelet 使用的命名空间（默认 k8s.io），不依赖 ctr 二进制
+type ContainerdClient struct {
+	client      *containerd.Client
+	snapshotter string
+}
+
+// NewContainerdClient 连接 address 上的 containerd，默认命名空间为 namespace，拉取与导入时解包到 snapshotter
+func NewContainerdClient(address, namespace, snapshotter string) (*ContainerdClient, error) {
+	client, err := containerd.New(strings.TrimPrefix(address, "unix://"),
+		containerd.WithDefaultNamespace(namespace),
+		containerd.WithTimeout(containerdDialTimeout))
+	if err != nil {
+		return nil, fmt.Errorf("连接 containerd 失败: %v", err)
+	}
+	return &ContainerdClient{client: client, snapshotter: snapshotter}, nil
+}
+
+// Pull 拉取并解包镜像（不解析进度）。配置了仓库凭据时通过 resolver 的认证回调提供，凭据只在进程内存中
+func (c *ContainerdClient) Pull(ctx context.Context, image string, opts PullOptions) error {
+	remoteOpts := []containerd.RemoteOpt{
+		containerd.WithPullUnpack,
+		containerd.WithPullSnapshotter(c.snapshotter),
+		containerd.WithResolver(c.resolver(ctx, image)),
+	}
+	if opts.Platform != "" {
+		remoteOpts = append(remoteOpts, containerd.WithPlatform(opts.Platform))
+	}
+	_, err := c.client.Pull(ctx, NormalizeRef(image), remoteOpts...)
+	return err
+}
+
+// resolver 返回拉取 image 使用的 resolver，只向 image 所在仓库提供凭据
+func (c *ContainerdClient) resolver(ctx context.Context, image string) remotes.Resolver {
+	return remotedocker.NewResolver(remotedocker.ResolverOptions{
+		Hosts: dockerconfig.ConfigureHosts(ctx, dockerconfig.HostOptions{
+			Credentials: registryHostCredentials(ctx, image),
+		}),
+	})
+}
+
+// registryHostCredentials 返回 containerd resolver 的认证回调：仅对 image 所在仓库的 Registry API 地址返回凭据，
+// identitytoken 以 OAuth2 refresh token 方式使用（用户名为空）；没有凭据时返回 nil（匿名）
+func registryHostCredentials(ctx context.Context, image string) func(string) (string, string, error) {
+	domain, cred := registryCredential(ctx, image)
+	if cred == nil {
+		return nil
+	}
+	host := registryHost(domain)
+	return func(h string) (string, string, error) {
+		if h != host {
+			return "", "", nil
+		}
+		if cred.IdentityToken != "" {
+			return "", cred.IdentityToken, nil
+		}
+		return cred.Username, cred.Password, nil
+	}
+}
+
+// Save 导出镜像到流（OCI 归档，单一平台时包含兼容 docker load 的 manifest.json）。
+// 只导出镜像的本地平台，按其他平台拉取的镜像同样适用
+func (c *ContainerdClient) Save(ctx context.Context, image string, writer io.Writer) error {
+	platform, err := c.GetImagePlatform(ctx, image)
+	if err != nil {
+		return err
+	}
+	spec, err := platforms.Parse(platform)
+	if err != nil {
+		return err
+	}
+	return c.client.Export(ctx, writer,
+		archive.WithImage(c.client.ImageService(), NormalizeRef(image)),
+		archive.WithPlatform(platforms.OnlyStrict(spec)))
+}
+
+// Load 从流导入 platform 平台的镜像并解包（platform 为空时使用节点平台），导入与解包期间持有 lease，
+// 避免内容在解包完成前被 containerd 回收
+func (c *ContainerdClient) Load(ctx context.Context, reader io.Reader, platform string) error {
+	if platform == "" {
+		platform = config.NodePlatform
+	}
+	spec, err := platforms.Parse(platform)
+	if err != nil {
+		return err
+	}
+	matcher := platforms.Only(spec)
+	ctx, done, err := c.client.WithLease(ctx)
+	if err != nil {
+		return err
+	}
+	defer done(context.WithoutCancel(ctx))
+	imgs, err := c.client.Import(ctx, reader, containerd.WithImportPlatform(matcher), containerd.WithAllPlatforms(false))
+	if err != nil {
+		return err
+	}
+	for _, img := range imgs {
+		if err := containerd.NewImageWithPlatform(c.client, img, matcher).Unpack(ctx, c.snapshotter); err != nil {
+			return fmt.Errorf("解包镜像 %s 失败: %v", img.Name, err)
+		}
+	}
+	return nil
+}
+
+// GetImages 获取本地镜像集合，包含引用的完整形式与 docker 风格短名、<仓库>@<目标 digest> 及 CRI 记录的镜像 ID
+func (c *ContainerdClient) GetImages(ctx context.Context) (map[string]struct{}, error) {
+	list, err := c.client.ImageService().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	images := make(map[string]struct{})
+	for _, img := range list {
+		// CRI 会以 sha256:<id> 作为镜像引用
+		if strings.HasPrefix(img.Name, "sha256:") {
+			images[img.Name] = struct{}{}
+			continue
+		}
+		addImageKeys(images, img.Name)
+		if r, err := ParseReference(img.Name); err == nil {
+			addImageKeys(images, r.Name()+"@"+img.Target.Digest.String())
+		}
+	}
+	return images, nil
+}
+
+// ImageExists 检查镜像是否存在
+func (c *ContainerdClient) ImageExists(ctx context.Context, image string) (bool, error) {
+	images, err := c.GetImages(ctx)
+	if err != nil {
+		return false, err
+	}
+	return HasImage(images, image), nil
+}
+
+// GetRepoDigests 获取镜像引用指向的 manifest/index digest
+func (c *ContainerdClient) GetRepoDigests(ctx context.Context, image string) ([]string, error) {
+	digest, err := c.imageTarget(ctx, image)
+	if err != nil {
+		return nil, err
+	}
+	return []string{digest}, nil
+}
+
+// ociDescriptor OCI/Docker 描述符
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Platform  *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+		Variant      string `json:"variant"`
+	} `json:"platform,omitempty"`
+}
+
+// ociManifest 镜像 manifest 或 index（manifest list）
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Config    ociDescriptor   `json:"config"`
+	Layers    []ociDescriptor `json:"layers"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+// contentGet 读取内容存储中的 blob
+func (c *ContainerdClient) contentGet(ctx context.Context, d string) ([]byte, error) {
+	return content.ReadBlob(ctx, c.client.ContentStore(), ocispec.Descriptor{Digest: digest.Digest(d)})
+}
+
+// imageTarget 获取镜像引用指向的 manifest/index digest
+func (c *ContainerdClient) imageTarget(ctx context.Context, image string) (string, error) {
+	img, err := c.client.ImageService().Get(ctx, NormalizeRef(image))
+	if errdefs.IsNotFound(err) {
+		return "", fmt.Errorf("镜像不存在: %s", image)
+	}
+	if err != nil {
+		return "", err
+	}
+	return img.Target.Digest.String(), nil
+}
+
+// imageManifest 获取镜像的平台 manifest：manifest list 中优先选择节点平台，
+// 内容存储中没有该平台时（如按其他平台拉取）选择第一个本地存在的平台
+func (c *ContainerdClient) imageManifest(ctx context.Context, image string) (*ociManifest, error) {
+	digest, err := c.imageTarget(ctx, image)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.contentGet(ctx, digest)
+	if err != nil {
+		return nil, err
+	}
+	var m ociManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	if len(m.Manifests) == 0 {
+		return &m, nil
+	}
+	var preferred, others []ociDescriptor
+	for _, d := range m.Manifests {
+		if d.Platform == nil || d.Platform.OS == "unknown" {
+			continue // attestation 等非镜像 manifest
+		}
+		if config.PlatformMatches(d.Platform.OS+"/"+d.Platform.Architecture+"/"+d.Platform.Variant, config.NodePlatform) {
+			preferred = append(preferred, d)
+		} else {
+			others = append(others, d)
+		}
+	}
+	for _, d := range append(preferred, others...) {
+		data, err := c.contentGet(ctx, d.Digest)
+		if err != nil {
+			continue
+		}
+		var pm ociManifest
+		if err := json.Unmarshal(data, &pm); err != nil {
+			return nil, err
+		}
+		return &pm, nil
+	}
+	return nil, fmt.Errorf("镜像无本地可用的平台 manifest: %s", image)
+}
+
+// GetImagePlatform 从镜像配置中读取 os/architecture/variant
+func (c *ContainerdClient) GetImagePlatform(ctx context.Context, image string) (string, error) {
+	m, err := c.imageManifest(ctx, image)
+	if err != nil {
+		return "", err
+	}
+	data, err := c.contentGet(ctx, m.Config.Digest)
+	if err != nil {
+		return "", err
+	}
+	var cfg struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+		Variant      string `json:"variant"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return "", err
+	}
+	platform := cfg.OS + "/" + cfg.Architecture
+	if cfg.Variant != "" {
+		platform += "/" + cfg.Variant
+	}
+	return platform, nil
+}
+
+// GetImageID 返回平台 manifest 中的 config digest（与 CRI 记录的镜像 ID 一致）
+func (c *ContainerdClient) GetImageID(ctx context.Context, image string) (string, error) {
+	m, err := c.imageManifest(ctx, image)
+	if err != nil {
+		return "", err
+	}
+	return m.Config.Digest, nil
+}
+
+// GetImageDiffIDs 从镜像配置中读取 rootfs.diff_ids
+func (c *ContainerdClient) GetImageDiffIDs(ctx context.Context, image string) ([]string, error) {
+	m, err := c.imageManifest(ctx, image)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.contentGet(ctx, m.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	var cfg struct {
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	return cfg.RootFS.DiffIDs, nil
+}
+
+// GetImageDigests 获取镜像 manifest 中的层 digest
+func (c *ContainerdClient) GetImageDigests(ctx context.Context, image string) ([]string, error) {
+	m, err := c.imageManifest(ctx, image)
+	if err != nil {
+		return nil, err
+	}
+	digests := make([]string, 0, len(m.Layers))
+	for _, l := range m.Layers {
+		digests = append(digests, l.Digest)
+	}
+	return digests, nil
+}
+
+// CheckLayerExists 检查层 blob 是否存在于内容存储
+func (c *ContainerdClient) CheckLayerExists(ctx context.Context, d string) (bool, error) {
+	_, err := c.client.ContentStore().Info(ctx, digest.Digest(d))
+	if errdefs.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// CheckLayersExist 批量检查层 blob 是否存在于内容存储
+func (c *ContainerdClient) CheckLayersExist(ctx context.Context, digests []string) (exists, missing []string, err error) {
+	for _, d := range digests {
+		ok, err := c.CheckLayerExists(ctx, d)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			exists = append(exists, d)
+		} else {
+			missing = append(missing, d)
+		}
+	}
+	return exists, missing, nil
+}
+
+// LocalLayerChainLength containerd 导入归档时要求 manifest 引用的层文件齐全（即使快照已存在），
+// 不支持层级传输，返回 ErrLayerTransferUnsupported，请求方使用整镜像传输
+func (c *ContainerdClient) LocalLayerChainLength(ctx context.Context, diffIDs []string) (int, error) {
+	return 0, ErrLayerTransferUnsupported
+}
+
+// RemoveImage 删除镜像引用。镜像服务不检查容器引用，删除前先确认镜像 ID 不被任何容器使用，
+// 被使用时返回 ErrImageInUse；无法确定容器使用的镜像时拒绝删除
+func (c *ContainerdClient) RemoveImage(ctx context.Context, image string) error {
+	id, err := c.GetImageID(ctx, image)
+	if err != nil {
+		return err
+	}
+	inUse, err := c.GetImagesInUse(ctx)
+	if err != nil {
+		return fmt.Errorf("获取容器使用的镜像失败: %v", err)
+	}
+	if _, ok := inUse[id]; ok {
+		return fmt.Errorf("%w: %s", ErrImageInUse, image)
+	}
+	return c.client.ImageService().Delete(ctx, NormalizeRef(image))
+}
+
+// GetImagesInUse 获取命名空间内所有容器使用的镜像 ID：将容器记录的镜像引用解析为 config digest（与 CRI 镜像 ID 一致）。
+// 引用已被删除或改指其他镜像的容器按其根文件系统快照的父快照（镜像顶层的 chainID）匹配本地镜像；
+// 快照也无法读取时返回错误，调用方不应删除任何镜像
+func (c *ContainerdClient) GetImagesInUse(ctx context.Context) (map[string]struct{}, error) {
+	list, err := c.client.ContainerService().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	images := make(map[string]struct{})
+	// 镜像顶层 chainID -> 容器 ID
+	chains := make(map[string]string)
+	for _, ctr := range list {
+		if ctr.Image == "" {
+			continue
+		}
+		id, err := c.GetImageID(ctx, ctr.Image)
+		if err == nil {
+			images[id] = struct{}{}
+			continue
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if ctr.Snapshotter == "" || ctr.SnapshotKey == "" {
+			return nil, fmt.Errorf("无法确定容器 %s 使用的镜像 %s: %v", ctr.ID, ctr.Image, err)
+		}
+		info, serr := c.client.SnapshotService(ctr.Snapshotter).Stat(ctx, ctr.SnapshotKey)
+		if serr != nil {
+			return nil, fmt.Errorf("无法确定容器 %s 使用的镜像 %s: %v; 读取快照失败: %v", ctr.ID, ctr.Image, err, serr)
+		}
+		log.Debug().Str("container", ctr.ID).Str("image", ctr.Image).Str("chain_id", info.Parent).Msg("容器的镜像引用已失效，按快照匹配镜像")
+		chains[info.Parent] = ctr.ID
+	}
+	if len(chains) == 0 {
+		return images, nil
+	}
+	all, err := c.client.ImageService().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, img := range all {
+		id, err := c.GetImageID(ctx, img.Name)
+		if err != nil {
+			continue // 无法获取 ID 的镜像也不会被回收
+		}
+		diffIDs, err := c.GetImageDiffIDs(ctx, img.Name)
+		if err != nil {
+			// 无法计算 chainID，保守地视为使用中
+			images[id] = struct{}{}
+			continue
+		}
+		if _, ok := chains[ChainID(diffIDs)]; ok {
+			images[id] = struct{}{}
+		}
+	}
+	return images, nil
+}
+
+// detectClientType 根据节点上的 socket 自动选择客户端类型
+func detectClientType() string {
+	if socketExists(config.DockerHost) {
+		return ClientTypeCLI
+	}
+	if socketExists(config.ContainerdAddress) {
+		return ClientTypeContainerd
+	}
+	return ClientTypeCLI
+}
+
+func socketExists(address string) bool {
+	info, err := os.Stat(strings.TrimPrefix(address, "unix://"))
+	return err == nil && info.Mode()&os.ModeSocket != 0
+}
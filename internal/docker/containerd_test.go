@@ -0,0 +1,152 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type fakeImageStore struct {
+	images.Store
+	images map[string]images.Image
+}
+
+func (s *fakeImageStore) Get(ctx context.Context, name string) (images.Image, error) {
+	img, ok := s.images[name]
+	if !ok {
+		return images.Image{}, errdefs.ErrNotFound
+	}
+	return img, nil
+}
+
+func (s *fakeImageStore) List(ctx context.Context, filters ...string) ([]images.Image, error) {
+	var list []images.Image
+	for _, img := range s.images {
+		list = append(list, img)
+	}
+	return list, nil
+}
+
+type fakeContainerStore struct {
+	containers.Store
+	list []containers.Container
+}
+
+func (s *fakeContainerStore) List(ctx context.Context, filters ...string) ([]containers.Container, error) {
+	return s.list, nil
+}
+
+type fakeSnapshotter struct {
+	snapshots.Snapshotter
+	parents map[string]string
+}
+
+func (s *fakeSnapshotter) Stat(ctx context.Context, key string) (snapshots.Info, error) {
+	parent, ok := s.parents[key]
+	if !ok {
+		return snapshots.Info{}, errdefs.ErrNotFound
+	}
+	return snapshots.Info{Name: key, Parent: parent}, nil
+}
+
+// writeTestImage 将 config 与 manifest 写入内容存储，返回 manifest 描述符与镜像 ID
+func writeTestImage(t *testing.T, cs content.Store, diffIDs []string) (ocispec.Descriptor, string) {
+	t.Helper()
+	ctx := context.Background()
+	write := func(mediaType string, v any) ocispec.Descriptor {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(data), Size: int64(len(data))}
+		if err := content.WriteBlob(ctx, cs, desc.Digest.String(), bytes.NewReader(data), desc); err != nil {
+			t.Fatal(err)
+		}
+		return desc
+	}
+	cfg := write(ocispec.MediaTypeImageConfig, map[string]any{
+		"os": "linux", "architecture": "amd64",
+		"rootfs": map[string]any{"type": "layers", "diff_ids": diffIDs},
+	})
+	manifest := write(ocispec.MediaTypeImageManifest, map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     ocispec.MediaTypeImageManifest,
+		"config":        cfg,
+		"layers":        []ocispec.Descriptor{},
+	})
+	return manifest, cfg.Digest.String()
+}
+
+func newTestContainerdClient(t *testing.T, imgs map[string]images.Image, cs content.Store, ctrs []containers.Container, parents map[string]string) *ContainerdClient {
+	t.Helper()
+	client, err := containerd.New("", containerd.WithServices(
+		containerd.WithContentStore(cs),
+		containerd.WithImageStore(&fakeImageStore{images: imgs}),
+		containerd.WithContainerStore(&fakeContainerStore{list: ctrs}),
+		containerd.WithSnapshotters(map[string]snapshots.Snapshotter{"overlayfs": &fakeSnapshotter{parents: parents}}),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ContainerdClient{client: client, snapshotter: "overlayfs"}
+}
+
+func TestContainerdGetImagesInUse(t *testing.T) {
+	cs, err := local.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	appDiffIDs := []string{"sha256:" + string(bytes.Repeat([]byte("a"), 64))}
+	otherDiffIDs := []string{"sha256:" + string(bytes.Repeat([]byte("b"), 64)), "sha256:" + string(bytes.Repeat([]byte("c"), 64))}
+	unusedDiffIDs := []string{"sha256:" + string(bytes.Repeat([]byte("d"), 64))}
+	appManifest, appID := writeTestImage(t, cs, appDiffIDs)
+	otherManifest, otherID := writeTestImage(t, cs, otherDiffIDs)
+	unusedManifest, unusedID := writeTestImage(t, cs, unusedDiffIDs)
+	imgs := map[string]images.Image{
+		"docker.io/library/app:v1":    {Name: "docker.io/library/app:v1", Target: appManifest},
+		"docker.io/library/other:v2":  {Name: "docker.io/library/other:v2", Target: otherManifest},
+		"docker.io/library/unused:v1": {Name: "docker.io/library/unused:v1", Target: unusedManifest},
+	}
+	ctrs := []containers.Container{
+		{ID: "c1", Image: "docker.io/library/app:v1", Snapshotter: "overlayfs", SnapshotKey: "c1"},
+		// 引用已删除，按快照父层匹配到 other:v2
+		{ID: "c2", Image: "docker.io/library/gone:v1", Snapshotter: "overlayfs", SnapshotKey: "c2"},
+	}
+	parents := map[string]string{"c1": ChainID(appDiffIDs), "c2": ChainID(otherDiffIDs)}
+
+	c := newTestContainerdClient(t, imgs, cs, ctrs, parents)
+	inUse, err := c.GetImagesInUse(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{appID, otherID} {
+		if _, ok := inUse[id]; !ok {
+			t.Errorf("%s 应视为使用中: %v", id, inUse)
+		}
+	}
+	if _, ok := inUse[unusedID]; ok {
+		t.Errorf("unused:v1 不应视为使用中")
+	}
+
+	// 引用与快照都无法解析时返回错误，不能当作未使用
+	ctrs = append(ctrs, containers.Container{ID: "c3", Image: "docker.io/library/gone:v2", Snapshotter: "overlayfs", SnapshotKey: "c3"})
+	c = newTestContainerdClient(t, imgs, cs, ctrs, parents)
+	if _, err := c.GetImagesInUse(context.Background()); err == nil {
+		t.Fatal("无法确定容器使用的镜像时应返回错误")
+	}
+	if err := c.RemoveImage(context.Background(), "unused:v1"); err == nil || errors.Is(err, ErrImageInUse) {
+		t.Fatalf("无法确定容器使用的镜像时应拒绝删除: %v", err)
+	}
+}
@@ -0,0 +1,376 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// EngineAPIClient 基于 Docker Engine API（HTTP over unix socket）的客户端实现
+type EngineAPIClient struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewEngineAPIClient 创建 Engine API 客户端，host 支持 unix:///path、tcp://host:port 与 http(s)://host:port
+func NewEngineAPIClient(host string) (*EngineAPIClient, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("解析 Docker 地址失败: %v", err)
+	}
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+		return &EngineAPIClient{baseURL: "http://docker", httpClient: &http.Client{Transport: transport}}, nil
+	case "tcp":
+		return &EngineAPIClient{baseURL: "http://" + u.Host, httpClient: &http.Client{}}, nil
+	case "http", "https":
+		return &EngineAPIClient{baseURL: strings.TrimSuffix(host, "/"), httpClient: &http.Client{}}, nil
+	default:
+		return nil, fmt.Errorf("不支持的 Docker 地址协议: %s", u.Scheme)
+	}
+}
+
+// engineMessage Engine API 流式 JSON 消息（pull/load 输出）
+type engineMessage struct {
+	Status         string `json:"status"`
+	ID             string `json:"id"`
+	Stream         string `json:"stream"`
+	Error          string `json:"error"`
+	ProgressDetail struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+	ErrorDetail *struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+}
+
+// engineImage /images/json 与 /images/{name}/json 的响应字段子集
+type engineImage struct {
+	ID           string   `json:"Id"`
+	RepoTags     []string `json:"RepoTags"`
+	RepoDigests  []string `json:"RepoDigests"`
+	Os           string   `json:"Os"`
+	Architecture string   `json:"Architecture"`
+	Variant      string   `json:"Variant"`
+	RootFS       struct {
+		Layers []string `json:"Layers"`
+	} `json:"RootFS"`
+}
+
+// do 发送请求，非 2xx 响应转换为错误
+func (c *EngineAPIClient) do(ctx context.Context, method, path string, query url.Values, body io.Reader, header http.Header) (*http.Response, error) {
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&apiErr)
+		return nil, &EngineAPIError{StatusCode: resp.StatusCode, Message: apiErr.Message}
+	}
+	return resp, nil
+}
+
+// EngineAPIError Engine API 返回的非 2xx 错误
+type EngineAPIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *EngineAPIError) Error() string {
+	return fmt.Sprintf("docker API 返回 %d: %s", e.StatusCode, e.Message)
+}
+
+// readMessages 读取流式 JSON 消息，遇到 error 字段时返回错误
+func readMessages(r io.Reader, onMessage func(*engineMessage)) error {
+	dec := json.NewDecoder(r)
+	for {
+		var msg engineMessage
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if msg.ErrorDetail != nil && msg.ErrorDetail.Message != "" {
+			return fmt.Errorf("%s", msg.ErrorDetail.Message)
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("%s", msg.Error)
+		}
+		if onMessage != nil {
+			onMessage(&msg)
+		}
+	}
+}
+
+// imagePath 构造 /images/{name}{suffix}：镜像名按路径段转义（保留仓库路径中的 "/"），
+// 拒绝空段与 "."、".." 段，避免镜像名改写请求路径
+func imagePath(image, suffix string) (string, error) {
+	segments := strings.Split(image, "/")
+	for i, seg := range segments {
+		if seg == "" || seg == "." || seg == ".." {
+			return "", fmt.Errorf("无效的镜像名: %q", image)
+		}
+		segments[i] = url.PathEscape(seg)
+	}
+	return "/images/" + strings.Join(segments, "/") + suffix, nil
+}
+
+// inspect 获取镜像详情，镜像不存在时返回 nil
+func (c *EngineAPIClient) inspect(ctx context.Context, image string) (*engineImage, error) {
+	path, err := imagePath(image, "/json")
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(ctx, http.MethodGet, path, nil, nil, nil)
+	if err != nil {
+		if apiErr, ok := err.(*EngineAPIError); ok && apiErr.StatusCode == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var img engineImage
+	if err := json.NewDecoder(resp.Body).Decode(&img); err != nil {
+		return nil, err
+	}
+	return &img, nil
+}
+
+// Pull 拉取镜像（POST /images/create），按层上报字节级进度；配置了仓库凭据时通过 X-Registry-Auth 传入。
+// tag 为空时 Engine API 会拉取仓库的全部 tag，因此按解析后的引用分别传入仓库名与 tag（或 digest）
+func (c *EngineAPIClient) Pull(ctx context.Context, image string, opts PullOptions) error {
+	ref, err := ParseReference(image)
+	if err != nil {
+		return err
+	}
+	tag := ref.Tag
+	if ref.Digest != "" {
+		tag = ref.Digest
+	}
+	query := url.Values{"fromImage": {ref.Name()}, "tag": {tag}}
+	if opts.Platform != "" {
+		query.Set("platform", opts.Platform)
+	}
+	var header http.Header
+	if domain, cred := registryCredential(ctx, image); cred != nil {
+		auth, err := encodeAuthConfig(domain, cred)
+		if err != nil {
+			return err
+		}
+		header = http.Header{"X-Registry-Auth": {auth}}
+	}
+	resp, err := c.do(ctx, http.MethodPost, "/images/create", query, nil, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return readMessages(resp.Body, func(msg *engineMessage) {
+		if opts.Progress == nil || msg.ID == "" {
+			return
+		}
+		opts.Progress(PullProgress{
+			Layer:   msg.ID,
+			Status:  msg.Status,
+			Current: msg.ProgressDetail.Current,
+			Total:   msg.ProgressDetail.Total,
+		})
+	})
+}
+
+// Save 保存镜像到流（GET /images/get）
+func (c *EngineAPIClient) Save(ctx context.Context, image string, writer io.Writer) error {
+	resp, err := c.do(ctx, http.MethodGet, "/images/get", url.Values{"names": {image}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(writer, resp.Body)
+	return err
+}
+
+// Load 从流加载镜像（POST /images/load）
+func (c *EngineAPIClient) Load(ctx context.Context, reader io.Reader, platform string) error {
+	resp, err := c.do(ctx, http.MethodPost, "/images/load", url.Values{"quiet": {"1"}}, reader, http.Header{"Content-Type": {"application/x-tar"}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return readMessages(resp.Body, nil)
+}
+
+// GetImages 获取本地镜像集合（GET /images/json），包含 RepoTags、RepoDigests 的原始与规范形式及镜像 ID
+func (c *EngineAPIClient) GetImages(ctx context.Context) (map[string]struct{}, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/images/json", nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var list []engineImage
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	images := make(map[string]struct{})
+	for _, img := range list {
+		for _, tag := range img.RepoTags {
+			addImageKeys(images, tag)
+		}
+		for _, digest := range img.RepoDigests {
+			addImageKeys(images, digest)
+		}
+		if img.ID != "" {
+			images[img.ID] = struct{}{}
+		}
+	}
+	return images, nil
+}
+
+// ImageExists 检查镜像是否存在
+func (c *EngineAPIClient) ImageExists(ctx context.Context, image string) (bool, error) {
+	img, err := c.inspect(ctx, image)
+	if err != nil {
+		return false, err
+	}
+	return img != nil, nil
+}
+
+// GetRepoDigests 获取镜像在其仓库下的 manifest digest（RepoDigests）
+func (c *EngineAPIClient) GetRepoDigests(ctx context.Context, image string) ([]string, error) {
+	img, err := c.inspect(ctx, image)
+	if err != nil {
+		return nil, err
+	}
+	if img == nil {
+		return nil, fmt.Errorf("镜像不存在: %s", image)
+	}
+	return digestsForRepo(image, img.RepoDigests), nil
+}
+
+// GetImagePlatform 获取本地镜像的平台
+func (c *EngineAPIClient) GetImagePlatform(ctx context.Context, image string) (string, error) {
+	img, err := c.inspect(ctx, image)
+	if err != nil {
+		return "", err
+	}
+	if img == nil {
+		return "", fmt.Errorf("镜像不存在: %s", image)
+	}
+	platform := img.Os + "/" + img.Architecture
+	if img.Variant != "" {
+		platform += "/" + img.Variant
+	}
+	return platform, nil
+}
+
+// GetImageID 获取本地镜像 ID
+func (c *EngineAPIClient) GetImageID(ctx context.Context, image string) (string, error) {
+	img, err := c.inspect(ctx, image)
+	if err != nil {
+		return "", err
+	}
+	if img == nil {
+		return "", fmt.Errorf("镜像不存在: %s", image)
+	}
+	return img.ID, nil
+}
+
+// GetImageDiffIDs 获取镜像的层 diffID 列表
+func (c *EngineAPIClient) GetImageDiffIDs(ctx context.Context, image string) ([]string, error) {
+	img, err := c.inspect(ctx, image)
+	if err != nil {
+		return nil, err
+	}
+	if img == nil {
+		return nil, fmt.Errorf("镜像不存在: %s", image)
+	}
+	return img.RootFS.Layers, nil
+}
+
+// GetImageDigests 获取镜像的所有层digest
+func (c *EngineAPIClient) GetImageDigests(ctx context.Context, image string) ([]string, error) {
+	diffIDs, err := c.GetImageDiffIDs(ctx, image)
+	if err != nil {
+		return nil, err
+	}
+	return digestsFromDiffIDs(diffIDs), nil
+}
+
+// CheckLayerExists 检查单个层是否存在
+func (c *EngineAPIClient) CheckLayerExists(ctx context.Context, digest string) (bool, error) {
+	return checkLayerExists(digest)
+}
+
+// CheckLayersExist 批量检查层是否存在
+func (c *EngineAPIClient) CheckLayersExist(ctx context.Context, digests []string) (exists, missing []string, err error) {
+	return checkLayersExist(digests)
+}
+
+// LocalLayerChainLength 返回自底向上连续已存在的层数
+func (c *EngineAPIClient) LocalLayerChainLength(ctx context.Context, diffIDs []string) (int, error) {
+	return localLayerChainLength(diffIDs)
+}
+
+// RemoveImage 删除镜像标签（DELETE /images/{name}，不强制）
+func (c *EngineAPIClient) RemoveImage(ctx context.Context, image string) error {
+	path, err := imagePath(image, "")
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, http.MethodDelete, path, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// GetImagesInUse 获取所有容器（含已停止的）使用的镜像 ID（GET /containers/json?all=1）
+func (c *EngineAPIClient) GetImagesInUse(ctx context.Context) (map[string]struct{}, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/containers/json", url.Values{"all": {"1"}}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var list []struct {
+		Image   string `json:"Image"`
+		ImageID string `json:"ImageID"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	images := make(map[string]struct{})
+	for _, ctr := range list {
+		if ctr.ImageID != "" {
+			images[ctr.ImageID] = struct{}{}
+		}
+	}
+	return images, nil
+}
@@ -0,0 +1,205 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestEngineClient 启动模拟 Engine API 的 httptest.Server，返回指向它的客户端
+func newTestEngineClient(t *testing.T, handler http.HandlerFunc) *EngineAPIClient {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	client, err := NewEngineAPIClient(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestEnginePullQuery(t *testing.T) {
+	digest := "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	cases := []struct {
+		image, fromImage, tag string
+	}{
+		{"nginx", "docker.io/library/nginx", "latest"},
+		{"nginx:1.25", "docker.io/library/nginx", "1.25"},
+		{"registry.local:5000/team/app", "registry.local:5000/team/app", "latest"},
+		{"nginx@" + digest, "docker.io/library/nginx", digest},
+		{"nginx:1.25@" + digest, "docker.io/library/nginx", digest},
+	}
+	for _, tc := range cases {
+		var fromImage, tag, platform string
+		client := newTestEngineClient(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost || r.URL.Path != "/images/create" {
+				http.NotFound(w, r)
+				return
+			}
+			q := r.URL.Query()
+			fromImage, tag, platform = q.Get("fromImage"), q.Get("tag"), q.Get("platform")
+		})
+		if err := client.Pull(context.Background(), tc.image, PullOptions{Platform: "linux/arm64"}); err != nil {
+			t.Fatalf("%s: %v", tc.image, err)
+		}
+		if fromImage != tc.fromImage || tag != tc.tag || platform != "linux/arm64" {
+			t.Errorf("%s: fromImage=%q tag=%q platform=%q，期望 fromImage=%q tag=%q", tc.image, fromImage, tag, platform, tc.fromImage, tc.tag)
+		}
+	}
+}
+
+func TestEnginePullProgress(t *testing.T) {
+	client := newTestEngineClient(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"status":"Pulling from library/nginx","id":"latest"}`)
+		fmt.Fprintln(w, `{"status":"Pulling fs layer","progressDetail":{},"id":"a1"}`)
+		fmt.Fprintln(w, `{"status":"Downloading","progressDetail":{"current":512,"total":2048},"progress":"[==>  ]","id":"a1"}`)
+		fmt.Fprintln(w, `{"status":"Download complete","progressDetail":{},"id":"a1"}`)
+		fmt.Fprintln(w, `{"status":"Already exists","progressDetail":{},"id":"b2"}`)
+		fmt.Fprintln(w, `{"status":"Digest: sha256:abc"}`)
+		fmt.Fprintln(w, `{"status":"Status: Downloaded newer image for nginx:latest"}`)
+	})
+	var events []PullProgress
+	err := client.Pull(context.Background(), "nginx", PullOptions{Progress: func(ev PullProgress) { events = append(events, ev) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PullProgress{
+		{Layer: "latest", Status: "Pulling from library/nginx"},
+		{Layer: "a1", Status: "Pulling fs layer"},
+		{Layer: "a1", Status: PullStatusDownloading, Current: 512, Total: 2048},
+		{Layer: "a1", Status: PullStatusDownloadComplete},
+		{Layer: "b2", Status: PullStatusAlreadyExists},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("进度事件数 %d，期望 %d: %+v", len(events), len(want), events)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Errorf("第 %d 个事件 %+v，期望 %+v", i, events[i], want[i])
+		}
+	}
+}
+
+func TestEnginePullErrorInStream(t *testing.T) {
+	client := newTestEngineClient(t, func(w http.ResponseWriter, r *http.Request) {
+		// 拉取失败时 Engine API 仍返回 200，错误在消息流中
+		fmt.Fprintln(w, `{"status":"Pulling fs layer","progressDetail":{},"id":"a1"}`)
+		fmt.Fprintln(w, `{"errorDetail":{"message":"manifest for nginx:nope not found"},"error":"manifest for nginx:nope not found"}`)
+		fmt.Fprintln(w, `{"status":"Download complete","progressDetail":{},"id":"a1"}`)
+	})
+	var events int
+	err := client.Pull(context.Background(), "nginx:nope", PullOptions{Progress: func(PullProgress) { events++ }})
+	if err == nil || err.Error() != "manifest for nginx:nope not found" {
+		t.Fatalf("期望返回消息流中的错误，实际: %v", err)
+	}
+	if events != 1 {
+		t.Fatalf("错误之后不应再上报进度，实际 %d 个事件", events)
+	}
+}
+
+func TestEnginePullHTTPError(t *testing.T) {
+	client := newTestEngineClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"message":"pull access denied"}`)
+	})
+	err := client.Pull(context.Background(), "private/app", PullOptions{})
+	var apiErr *EngineAPIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound || apiErr.Message != "pull access denied" {
+		t.Fatalf("期望 EngineAPIError 404，实际: %v", err)
+	}
+}
+
+func TestEngineInspect(t *testing.T) {
+	var paths []string
+	client := newTestEngineClient(t, func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.EscapedPath())
+		if r.URL.Path == "/images/registry.local:5000/team/app:v1/json" {
+			fmt.Fprint(w, `{"Id":"sha256:abc","Os":"linux","Architecture":"arm64","Variant":"v8","RootFS":{"Layers":["sha256:l1"]}}`)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"message":"No such image"}`)
+	})
+	ctx := context.Background()
+	exists, err := client.ImageExists(ctx, "registry.local:5000/team/app:v1")
+	if err != nil || !exists {
+		t.Fatalf("镜像应存在: exists=%v err=%v", exists, err)
+	}
+	platform, err := client.GetImagePlatform(ctx, "registry.local:5000/team/app:v1")
+	if err != nil || platform != "linux/arm64/v8" {
+		t.Fatalf("平台 %q err=%v", platform, err)
+	}
+	// 404 视为不存在而不是错误
+	exists, err = client.ImageExists(ctx, "missing:v1")
+	if err != nil || exists {
+		t.Fatalf("404 应返回不存在: exists=%v err=%v", exists, err)
+	}
+	if _, err := client.GetImageID(ctx, "missing:v1"); err == nil {
+		t.Fatal("镜像不存在时 GetImageID 应返回错误")
+	}
+	// 镜像名中的特殊字符按路径段转义
+	if _, err := client.ImageExists(ctx, "app:v1?x=1#y"); err != nil {
+		t.Fatal(err)
+	}
+	if last := paths[len(paths)-1]; last != "/images/app:v1%3Fx=1%23y/json" {
+		t.Fatalf("镜像名未转义: %s", last)
+	}
+	// 不允许通过 ".." 改写请求路径
+	n := len(paths)
+	if _, err := client.ImageExists(ctx, "../containers/x"); err == nil {
+		t.Fatal("包含 .. 的镜像名应被拒绝")
+	}
+	if len(paths) != n {
+		t.Fatal("被拒绝的镜像名不应发出请求")
+	}
+}
+
+func TestEngineRemoveImage(t *testing.T) {
+	var method, path string
+	client := newTestEngineClient(t, func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		if r.URL.Path == "/images/busy:v1" {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, `{"message":"image is being used by running container"}`)
+			return
+		}
+		fmt.Fprint(w, `[{"Untagged":"team/app:v1"}]`)
+	})
+	if err := client.RemoveImage(context.Background(), "team/app:v1"); err != nil {
+		t.Fatal(err)
+	}
+	if method != http.MethodDelete || path != "/images/team/app:v1" {
+		t.Fatalf("请求 %s %s", method, path)
+	}
+	err := client.RemoveImage(context.Background(), "busy:v1")
+	var apiErr *EngineAPIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusConflict {
+		t.Fatalf("期望 EngineAPIError 409，实际: %v", err)
+	}
+}
+
+func TestEngineGetImagesInUse(t *testing.T) {
+	client := newTestEngineClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/containers/json" || r.URL.Query().Get("all") != "1" {
+			http.NotFound(w, r)
+			return
+		}
+		// 容器记录的镜像名可能是短名、digest 或已被改指的 tag，只有 ImageID 可靠
+		fmt.Fprint(w, `[{"Image":"nginx","ImageID":"sha256:aaa"},{"Image":"sha256:bbb","ImageID":"sha256:bbb"},{"Image":"app:v1","ImageID":""}]`)
+	})
+	inUse, err := client.GetImagesInUse(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inUse) != 2 {
+		t.Fatalf("期望只返回镜像 ID，实际: %v", inUse)
+	}
+	for _, id := range []string{"sha256:aaa", "sha256:bbb"} {
+		if _, ok := inUse[id]; !ok {
+			t.Errorf("缺少镜像 ID %s: %v", id, inUse)
+		}
+	}
+}
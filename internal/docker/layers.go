@@ -0,0 +1,158 @@
+package docker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"image-preheat/internal/config"
+)
+
+// ChainID 计算层链的 chainID：
+// ChainID(L0) = DiffID(L0)，ChainID(Ln) = sha256(ChainID(Ln-1) + " " + DiffID(Ln))
+func ChainID(diffIDs []string) string {
+	if len(diffIDs) == 0 {
+		return ""
+	}
+	chainID := diffIDs[0]
+	for _, diffID := range diffIDs[1:] {
+		sum := sha256.Sum256([]byte(chainID + " " + diffID))
+		chainID = "sha256:" + hex.EncodeToString(sum[:])
+	}
+	return chainID
+}
+
+// ChainIDs 计算每一层对应的 chainID
+func ChainIDs(diffIDs []string) []string {
+	chainIDs := make([]string, len(diffIDs))
+	for i := range diffIDs {
+		chainIDs[i] = ChainID(diffIDs[:i+1])
+	}
+	return chainIDs
+}
+
+// localLayerChainLength 检查 Docker layerdb 中是否存在各层 chainID 目录，
+// 层按链式依赖，因此只统计自底向上连续存在的部分
+func localLayerChainLength(diffIDs []string) (int, error) {
+	layerdb := filepath.Join(imageMetadataDir(), "layerdb", "sha256")
+	for i, chainID := range ChainIDs(diffIDs) {
+		parts := strings.SplitN(chainID, ":", 2)
+		if len(parts) != 2 {
+			return i, fmt.Errorf("chainID格式错误: %s", chainID)
+		}
+		if _, err := os.Stat(filepath.Join(layerdb, parts[1])); err != nil {
+			if os.IsNotExist(err) {
+				return i, nil
+			}
+			return i, err
+		}
+	}
+	return len(diffIDs), nil
+}
+
+// imageMetadataDir Docker 镜像元数据目录：<root>/image/<driver>
+func imageMetadataDir() string {
+	return filepath.Join(config.DockerRootDir, "image", config.DockerStorageDriver)
+}
+
+// digestsFromDiffIDs 将 diffID 列表转换为 registry 层 digest，无 distribution 元数据的层跳过
+func digestsFromDiffIDs(diffIDs []string) []string {
+	var digests []string
+	for _, diffID := range diffIDs {
+		diffID = strings.TrimSpace(diffID)
+		if diffID == "" {
+			continue
+		}
+		// 从diffID获取digest
+		digest, err := getDigestFromDiffID(diffID)
+		if err != nil {
+			continue
+		}
+		digests = append(digests, digest)
+	}
+	return digests
+}
+
+// checkLayerExists 通过 distribution 元数据与 layerdb 检查单个层是否存在
+func checkLayerExists(digest string) (bool, error) {
+	// 只取sha256:后面的部分
+	digest = strings.TrimPrefix(digest, "sha256:")
+	diffIDPath := filepath.Join(imageMetadataDir(), "distribution", "diffid-by-digest", "sha256", digest)
+
+	// 检查diffid-by-digest文件是否存在
+	if _, err := os.Stat(diffIDPath); os.IsNotExist(err) {
+		return false, nil
+	}
+
+	// 读取diffID
+	diffIDBytes, err := os.ReadFile(diffIDPath)
+	if err != nil {
+		return false, err
+	}
+
+	diffID := strings.TrimPrefix(strings.TrimSpace(string(diffIDBytes)), "sha256:")
+	if diffID == "" {
+		return false, nil
+	}
+
+	// 检查layerdb目录是否存在
+	layerdbPath := filepath.Join(imageMetadataDir(), "layerdb", "sha256", diffID)
+	if _, err := os.Stat(layerdbPath); os.IsNotExist(err) {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// checkLayersExist 批量检查层是否存在
+func checkLayersExist(digests []string) (exists, missing []string, err error) {
+	for _, digest := range digests {
+		layerExists, err := checkLayerExists(digest)
+		if err != nil {
+			return nil, nil, err
+		}
+		if layerExists {
+			exists = append(exists, digest)
+		} else {
+			missing = append(missing, digest)
+		}
+	}
+	return exists, missing, nil
+}
+
+// getDigestFromDiffID 从diffID获取对应的digest
+func getDigestFromDiffID(diffID string) (string, error) {
+	// 只取sha256:后面的部分
+	parts := strings.SplitN(diffID, ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("diffID格式错误: %s", diffID)
+	}
+	diffIDShort := parts[1]
+
+	// 构建v2metadata-by-diffid文件路径
+	metadataPath := filepath.Join(imageMetadataDir(), "distribution", "v2metadata-by-diffid", "sha256", diffIDShort)
+
+	// 读取metadata文件
+	metadataBytes, err := os.ReadFile(metadataPath)
+	if err != nil {
+		return "", err
+	}
+
+	// 解析JSON获取digest
+	var metadata []struct {
+		Digest string `json:"Digest"`
+	}
+	if err := json.Unmarshal(metadataBytes, &metadata); err != nil {
+		return "", err
+	}
+
+	if len(metadata) == 0 {
+		return "", fmt.Errorf("未找到digest信息")
+	}
+
+	return metadata[0].Digest, nil
+}
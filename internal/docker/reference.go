@@ -0,0 +1,193 @@
+package docker
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Docker Hub 默认仓库域名与官方镜像命名空间
+const (
+	defaultDomain    = "docker.io"
+	legacyDomain     = "index.docker.io"
+	officialRepoPath = "library/"
+)
+
+// Reference 解析后的镜像引用：<domain>/<path>[:tag][@digest]
+type Reference struct {
+	Domain string
+	Path   string
+	Tag    string
+	Digest string
+}
+
+// ParseReference 解析镜像引用并补全仓库域名（docker.io）与官方镜像命名空间（library/），
+// 既无 tag 也无 digest 时 tag 取 latest；digest 只接受小写十六进制的 sha256 与 sha512
+func ParseReference(image string) (Reference, error) {
+	var ref Reference
+	name := strings.TrimSpace(image)
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return ref, fmt.Errorf("无效的镜像引用: %q", image)
+	}
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, ref.Digest = name[:i], name[i+1:]
+		if !validDigest(ref.Digest) {
+			return ref, fmt.Errorf("无效的镜像 digest: %q", image)
+		}
+	}
+	// tag 只能出现在最后一个路径段中（域名中的冒号为端口）
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, ref.Tag = name[:i], name[i+1:]
+		if ref.Tag == "" {
+			return ref, fmt.Errorf("无效的镜像 tag: %q", image)
+		}
+	}
+	if i := strings.Index(name, "/"); i >= 0 && isDomain(name[:i]) {
+		ref.Domain, ref.Path = name[:i], name[i+1:]
+	} else {
+		ref.Domain, ref.Path = defaultDomain, name
+	}
+	if ref.Domain == legacyDomain {
+		ref.Domain = defaultDomain
+	}
+	if ref.Domain == defaultDomain && !strings.Contains(ref.Path, "/") {
+		ref.Path = officialRepoPath + ref.Path
+	}
+	if ref.Path == "" || ref.Path != strings.ToLower(ref.Path) {
+		return ref, fmt.Errorf("无效的镜像仓库名: %q", image)
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+	return ref, nil
+}
+
+// isDomain 首个路径段包含 "." 或 ":"（端口）或为 localhost 时视为仓库域名
+func isDomain(s string) bool {
+	return strings.ContainsAny(s, ".:") || s == "localhost"
+}
+
+// digestHexLengths 支持的 digest 算法及其十六进制长度
+var digestHexLengths = map[string]int{
+	"sha256": 64,
+	"sha512": 128,
+}
+
+// validDigest 校验 sha256:<64 位小写十六进制> 或 sha512:<128 位小写十六进制>
+func validDigest(d string) bool {
+	algo, hex, ok := strings.Cut(d, ":")
+	n, known := digestHexLengths[algo]
+	if !ok || !known || len(hex) != n {
+		return false
+	}
+	for _, r := range hex {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Name 完整仓库名，如 docker.io/library/nginx
+func (r Reference) Name() string {
+	return r.Domain + "/" + r.Path
+}
+
+// String 完整引用，如 docker.io/library/nginx:latest
+func (r Reference) String() string {
+	s := r.Name()
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// Familiar docker 风格短名，如 nginx:latest
+func (r Reference) Familiar() string {
+	name := r.Name()
+	if r.Domain == defaultDomain {
+		name = strings.TrimPrefix(r.Path, officialRepoPath)
+	}
+	if r.Tag != "" {
+		name += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		name += "@" + r.Digest
+	}
+	return name
+}
+
+// key 本地镜像匹配用的规范键：带 digest 时按 <仓库>@<digest>（忽略 tag），否则按 <仓库>:<tag>
+func (r Reference) key() string {
+	if r.Digest != "" {
+		return r.Name() + "@" + r.Digest
+	}
+	return r.Name() + ":" + r.Tag
+}
+
+// NormalizeRef 将 docker 风格的短镜像名补全为完整引用，无法解析时原样返回
+func NormalizeRef(image string) string {
+	ref, err := ParseReference(image)
+	if err != nil {
+		return image
+	}
+	return ref.String()
+}
+
+// FamiliarRef 将完整引用还原为 docker 风格的短名（docker.io/library/nginx:latest -> nginx:latest），无法解析时原样返回
+func FamiliarRef(image string) string {
+	ref, err := ParseReference(image)
+	if err != nil {
+		return image
+	}
+	return ref.Familiar()
+}
+
+// IsDigestReference 判断镜像是否按 digest 固定（name@sha256:...）
+func IsDigestReference(image string) bool {
+	ref, err := ParseReference(image)
+	return err == nil && ref.Digest != ""
+}
+
+// HasImage 判断本地镜像集合（GetImages 的返回值）中是否存在 image，
+// 支持短名/完整引用、<仓库>@<digest>（按 RepoDigest 匹配）与镜像 ID
+func HasImage(images map[string]struct{}, image string) bool {
+	if _, ok := images[image]; ok {
+		return true
+	}
+	ref, err := ParseReference(image)
+	if err != nil {
+		return false
+	}
+	_, ok := images[ref.key()]
+	return ok
+}
+
+// addImageKeys 将本地镜像的一个引用（repo:tag 或 repo@digest）加入集合：原始形式与规范键
+func addImageKeys(images map[string]struct{}, image string) {
+	if image == "" || strings.Contains(image, "<none>") {
+		return
+	}
+	images[image] = struct{}{}
+	if ref, err := ParseReference(image); err == nil {
+		images[ref.key()] = struct{}{}
+		images[ref.Familiar()] = struct{}{}
+	}
+}
+
+// digestsForRepo 从 RepoDigests（repo@digest 列表）中取出与 image 同仓库的 digest
+func digestsForRepo(image string, repoDigests []string) []string {
+	ref, err := ParseReference(image)
+	if err != nil {
+		return nil
+	}
+	var digests []string
+	for _, rd := range repoDigests {
+		if r, err := ParseReference(rd); err == nil && r.Name() == ref.Name() && r.Digest != "" {
+			digests = append(digests, r.Digest)
+		}
+	}
+	return digests
+}
@@ -0,0 +1,127 @@
+package docker
+
+import (
+	"strings"
+	"testing"
+)
+
+var (
+	testSHA256 = "sha256:" + strings.Repeat("a1", 32)
+	testSHA512 = "sha512:" + strings.Repeat("b2", 64)
+)
+
+func TestParseReference(t *testing.T) {
+	cases := []struct {
+		image  string
+		want   Reference
+		wantOK bool
+	}{
+		{"nginx", Reference{Domain: "docker.io", Path: "library/nginx", Tag: "latest"}, true},
+		{"nginx:1.25", Reference{Domain: "docker.io", Path: "library/nginx", Tag: "1.25"}, true},
+		{"bitnami/redis:7", Reference{Domain: "docker.io", Path: "bitnami/redis", Tag: "7"}, true},
+		{"docker.io/library/nginx:1.25", Reference{Domain: "docker.io", Path: "library/nginx", Tag: "1.25"}, true},
+		{"index.docker.io/nginx", Reference{Domain: "docker.io", Path: "library/nginx", Tag: "latest"}, true},
+		{"localhost/app", Reference{Domain: "localhost", Path: "app", Tag: "latest"}, true},
+		{"registry.example.com:5000/team/app", Reference{Domain: "registry.example.com:5000", Path: "team/app", Tag: "latest"}, true},
+		{"registry.example.com:5000/team/app:v1", Reference{Domain: "registry.example.com:5000", Path: "team/app", Tag: "v1"}, true},
+		{"localhost:5000/app:v1", Reference{Domain: "localhost:5000", Path: "app", Tag: "v1"}, true},
+		{"nginx@" + testSHA256, Reference{Domain: "docker.io", Path: "library/nginx", Digest: testSHA256}, true},
+		{"nginx:1.25@" + testSHA256, Reference{Domain: "docker.io", Path: "library/nginx", Tag: "1.25", Digest: testSHA256}, true},
+		{"registry.example.com:5000/app:v1@" + testSHA512, Reference{Domain: "registry.example.com:5000", Path: "app", Tag: "v1", Digest: testSHA512}, true},
+		{"", Reference{}, false},
+		{"nginx 1.25", Reference{}, false},
+		{"nginx:", Reference{}, false},
+		{"Nginx:1.25", Reference{}, false},
+		{"registry.example.com/Team/app", Reference{}, false},
+		{"nginx@sha256:" + strings.Repeat("A1", 32), Reference{}, false},
+		{"nginx@sha256:" + strings.Repeat("a", 63), Reference{}, false},
+		{"nginx@sha256:" + strings.Repeat("a", 65), Reference{}, false},
+		{"nginx@sha256:" + strings.Repeat("g", 64), Reference{}, false},
+		{"nginx@sha512:" + strings.Repeat("a", 64), Reference{}, false},
+		{"nginx@md5:" + strings.Repeat("a", 32), Reference{}, false},
+		{"nginx@:" + strings.Repeat("a", 64), Reference{}, false},
+		{"nginx@foo:", Reference{}, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.image, func(t *testing.T) {
+			got, err := ParseReference(tc.image)
+			if !tc.wantOK {
+				if err == nil {
+					t.Fatalf("应解析失败，实际 %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Fatalf("解析为 %+v，期望 %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReferenceFormats(t *testing.T) {
+	cases := []struct {
+		image, normalized, familiar string
+	}{
+		{"nginx", "docker.io/library/nginx:latest", "nginx:latest"},
+		{"docker.io/bitnami/redis:7", "docker.io/bitnami/redis:7", "bitnami/redis:7"},
+		{"registry.example.com:5000/app:v1", "registry.example.com:5000/app:v1", "registry.example.com:5000/app:v1"},
+		{"nginx:1.25@" + testSHA256, "docker.io/library/nginx:1.25@" + testSHA256, "nginx:1.25@" + testSHA256},
+	}
+	for _, tc := range cases {
+		if got := NormalizeRef(tc.image); got != tc.normalized {
+			t.Errorf("NormalizeRef(%q) = %q，期望 %q", tc.image, got, tc.normalized)
+		}
+		if got := FamiliarRef(tc.normalized); got != tc.familiar {
+			t.Errorf("FamiliarRef(%q) = %q，期望 %q", tc.normalized, got, tc.familiar)
+		}
+	}
+	if !IsDigestReference("nginx@"+testSHA256) || IsDigestReference("nginx:1.25") {
+		t.Error("IsDigestReference 判断错误")
+	}
+	if IsDigestReference("nginx@sha256:" + strings.Repeat("A", 64)) {
+		t.Error("大写 digest 不应视为按 digest 固定的引用")
+	}
+}
+
+func TestHasImage(t *testing.T) {
+	images := map[string]struct{}{}
+	for _, image := range []string{
+		"nginx:1.25",
+		"bitnami/redis:7",
+		"registry.example.com:5000/team/app:v1",
+		"busybox@" + testSHA256,
+		"sha256:" + strings.Repeat("c3", 32),
+	} {
+		addImageKeys(images, image)
+	}
+	cases := []struct {
+		image string
+		want  bool
+	}{
+		{"nginx:1.25", true},
+		{"docker.io/library/nginx:1.25", true},
+		{"index.docker.io/library/nginx:1.25", true},
+		{"library/nginx:1.25", true},
+		{"nginx", false},
+		{"nginx:1.26", false},
+		{"docker.io/bitnami/redis:7", true},
+		{"redis:7", false},
+		{"registry.example.com:5000/team/app:v1", true},
+		{"registry.example.com/team/app:v1", false},
+		{"registry.example.com:5001/team/app:v1", false},
+		{"busybox@" + testSHA256, true},
+		{"docker.io/library/busybox:1.36@" + testSHA256, true},
+		{"busybox@sha256:" + strings.Repeat("b1", 32), false},
+		{"busybox@sha256:" + strings.ToUpper(strings.Repeat("a1", 32)), false},
+		{"sha256:" + strings.Repeat("c3", 32), true},
+		{"NGINX:1.25", false},
+	}
+	for _, tc := range cases {
+		if got := HasImage(images, tc.image); got != tc.want {
+			t.Errorf("HasImage(%q) = %v，期望 %v", tc.image, got, tc.want)
+		}
+	}
+}
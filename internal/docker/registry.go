@@ -0,0 +1,270 @@
+package docker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"image-preheat/internal/config"
+)
+
+// manifest 相关媒体类型，优先返回 manifest list / index，与 docker pull 记录的 RepoDigest 一致
+var manifestAcceptTypes = []string{
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+}
+
+var registryHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// registryHost 仓库域名对应的 Registry API 地址
+func registryHost(domain string) string {
+	if domain == defaultDomain {
+		return "registry-1.docker.io"
+	}
+	return domain
+}
+
+// ResolveDigest 向镜像仓库查询 tag 当前指向的 manifest digest（HEAD /v2/<name>/manifests/<tag>），
+// 仓库要求认证时按 WWW-Authenticate 使用配置的仓库凭据（Basic，或以凭据获取 Bearer token），
+// 没有凭据时匿名获取 token。按 digest 固定的引用直接返回其 digest
+func ResolveDigest(ctx context.Context, image string) (string, error) {
+	ref, err := ParseReference(image)
+	if err != nil {
+		return "", err
+	}
+	if ref.Digest != "" {
+		return ref.Digest, nil
+	}
+	u := manifestURL(ref, ref.Tag)
+	resp, err := registryRequest(ctx, http.MethodHead, u, image)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("查询镜像 digest 失败: %s 返回 %d", u, resp.StatusCode)
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("镜像仓库未返回 Docker-Content-Digest: %s", u)
+	}
+	return digest, nil
+}
+
+// 单个 manifest 的大小上限
+const maxManifestSize = 4 << 20
+
+// ResolveImageConfig 向镜像仓库获取镜像 platform 平台 manifest 中的 config digest（即 docker 镜像 ID），
+// manifest list / index 按 platform 选择。按 digest 获取的 manifest 校验内容与 digest 一致，
+// 因此按 digest 固定的引用不依赖仓库返回内容的可信性
+func ResolveImageConfig(ctx context.Context, image, platform string) (string, error) {
+	ref, err := ParseReference(image)
+	if err != nil {
+		return "", err
+	}
+	reference := ref.Tag
+	if ref.Digest != "" {
+		reference = ref.Digest
+	}
+	m, err := fetchManifest(ctx, ref, reference, image)
+	if err != nil {
+		return "", err
+	}
+	if len(m.Manifests) > 0 {
+		var digest string
+		for _, d := range m.Manifests {
+			if d.Platform == nil || d.Platform.OS == "unknown" {
+				continue // attestation 等非镜像 manifest
+			}
+			if config.PlatformMatches(d.Platform.OS+"/"+d.Platform.Architecture+"/"+d.Platform.Variant, platform) {
+				digest = d.Digest
+				break
+			}
+		}
+		if digest == "" {
+			return "", fmt.Errorf("镜像 %s 没有 %s 平台的 manifest", image, platform)
+		}
+		if m, err = fetchManifest(ctx, ref, digest, image); err != nil {
+			return "", err
+		}
+	}
+	if m.Config.Digest == "" {
+		return "", fmt.Errorf("镜像 %s 的 manifest 缺少 config", image)
+	}
+	return m.Config.Digest, nil
+}
+
+// fetchManifest 获取 manifest，reference 为 digest 时校验内容的 sha256
+func fetchManifest(ctx context.Context, ref Reference, reference, image string) (*ociManifest, error) {
+	u := manifestURL(ref, reference)
+	resp, err := registryRequest(ctx, http.MethodGet, u, image)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("获取镜像 manifest 失败: %s 返回 %d", u, resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxManifestSize {
+		return nil, fmt.Errorf("镜像 manifest 超过大小上限: %s", u)
+	}
+	if strings.HasPrefix(reference, "sha256:") {
+		sum := sha256.Sum256(data)
+		if actual := "sha256:" + hex.EncodeToString(sum[:]); actual != reference {
+			return nil, fmt.Errorf("镜像 manifest 内容与 digest 不一致: %s 实际为 %s", reference, actual)
+		}
+	}
+	var m ociManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("解析镜像 manifest 失败: %v", err)
+	}
+	return &m, nil
+}
+
+func manifestURL(ref Reference, reference string) string {
+	return fmt.Sprintf("https://%s/v2/%s/manifests/%s", registryHost(ref.Domain), ref.Path, reference)
+}
+
+// registryRequest 发起 manifest 请求，仓库返回 401 时按 challenge 认证后重试一次；调用方负责关闭响应体
+func registryRequest(ctx context.Context, method, u, image string) (*http.Response, error) {
+	resp, err := doManifestRequest(ctx, method, u, "")
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	resp.Body.Close()
+	_, cred := registryCredential(ctx, image)
+	authorization, err := registryAuthorization(ctx, resp.Header.Get("WWW-Authenticate"), cred)
+	if err != nil {
+		return nil, err
+	}
+	return doManifestRequest(ctx, method, u, authorization)
+}
+
+func doManifestRequest(ctx context.Context, method, u, authorization string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestAcceptTypes, ", "))
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	return registryHTTPClient.Do(req)
+}
+
+// registryAuthorization 按 WWW-Authenticate challenge 生成 Authorization 头：
+// Basic 直接使用凭据，Bearer 获取 token（有凭据时以 Basic 认证或 identitytoken 换取，否则匿名）
+func registryAuthorization(ctx context.Context, challenge string, cred *config.RegistryCredential) (string, error) {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	switch {
+	case strings.EqualFold(scheme, "Basic"):
+		if cred == nil || cred.Username == "" {
+			return "", fmt.Errorf("仓库要求 Basic 认证但未配置凭据")
+		}
+		return "Basic " + basicAuth(cred), nil
+	case strings.EqualFold(scheme, "Bearer"):
+		token, err := fetchRegistryToken(ctx, params, cred)
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + token, nil
+	default:
+		return "", fmt.Errorf("不支持的仓库认证方式: %q", challenge)
+	}
+}
+
+func basicAuth(cred *config.RegistryCredential) string {
+	return base64.StdEncoding.EncodeToString([]byte(cred.Username + ":" + cred.Password))
+}
+
+// fetchRegistryToken 按 Bearer challenge 参数（realm、service、scope）获取 token：
+// 有 identitytoken 时以 OAuth2 refresh_token 方式换取，有用户名密码时附带 Basic 认证，否则匿名
+func fetchRegistryToken(ctx context.Context, params string, cred *config.RegistryCredential) (string, error) {
+	attrs := parseChallengeParams(params)
+	if attrs["realm"] == "" {
+		return "", fmt.Errorf("仓库认证缺少 realm: %q", params)
+	}
+	query := url.Values{}
+	for _, k := range []string{"service", "scope"} {
+		if attrs[k] != "" {
+			query.Set(k, attrs[k])
+		}
+	}
+	var req *http.Request
+	var err error
+	if cred != nil && cred.IdentityToken != "" {
+		query.Set("grant_type", "refresh_token")
+		query.Set("refresh_token", cred.IdentityToken)
+		query.Set("client_id", "image-preheat")
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, attrs["realm"], strings.NewReader(query.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, attrs["realm"]+"?"+query.Encode(), nil)
+		if err == nil && cred != nil && cred.Username != "" {
+			req.Header.Set("Authorization", "Basic "+basicAuth(cred))
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	resp, err := registryHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("获取仓库 token 失败: 返回 %d", resp.StatusCode)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	return body.AccessToken, nil
+}
+
+// parseChallengeParams 解析 key="value",key2="value2"
+func parseChallengeParams(s string) map[string]string {
+	attrs := make(map[string]string)
+	for s != "" {
+		key, rest, ok := strings.Cut(strings.TrimLeft(s, " ,"), "=")
+		if !ok {
+			break
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		attrs[strings.ToLower(strings.TrimSpace(key))] = value
+		s = rest
+	}
+	return attrs
+}
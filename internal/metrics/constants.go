@@ -4,37 +4,68 @@ const (
 	// Counter/Histogram/Gauge 名称
 	RegistryPullTotalName       = "registry_pull_total"
 	RegistryPullDurationName    = "registry_pull_duration_seconds"
+	RegistryPullBytesTotalName  = "registry_pull_bytes_total"
+	RegistryPullLayersTotalName = "registry_pull_layers_total"
 	P2PFetchTotalName           = "p2p_fetch_total"
 	P2PFetchDurationName        = "p2p_fetch_duration_seconds"
 	P2PFetchFailedTotalName     = "p2p_fetch_failed_total"
 	ImagePreheatTotalName       = "image_preheat_total"
 	ImagePreheatFailedTotalName = "image_preheat_failed_total"
 	RegistryPullingGaugeName    = "registry_pulling"
+	PeerWaitTotalName           = "peer_wait_total"
+	PeerWaitDurationName        = "peer_wait_duration_seconds"
+	P2PSkippedLayersTotalName   = "p2p_skipped_layers_total"
+	DiskFreeBytesName           = "disk_free_bytes"
+	DiskFreeRatioName           = "disk_free_ratio"
+	DiskCheckTotalName          = "disk_check_total"
 
 	// 帮助信息
 	RegistryPullTotalHelp       = "Total number of registry pulls"
 	RegistryPullDurationHelp    = "Duration of registry pulls"
+	RegistryPullBytesTotalHelp  = "Total number of bytes downloaded from registry"
+	RegistryPullLayersTotalHelp = "Total number of layers downloaded from registry"
 	P2PFetchTotalHelp           = "Total number of successful P2P fetches"
 	P2PFetchDurationHelp        = "Duration of P2P fetches"
 	P2PFetchFailedTotalHelp     = "Total number of failed P2P fetches"
 	ImagePreheatTotalHelp       = "Total number of image preheat tasks"
 	ImagePreheatFailedTotalHelp = "Total number of failed image preheat tasks"
 	RegistryPullingGaugeHelp    = "Current images being pulled from registry (value=1 means pulling, 0 means not pulling)"
+	PeerWaitTotalHelp           = "Total number of waits for another node holding the registry lock"
+	PeerWaitDurationHelp        = "Duration of waiting for the registry lock holder to finish pulling"
+	P2PSkippedLayersTotalHelp   = "Total number of layers skipped in P2P fetches because they already exist locally"
+	DiskFreeBytesHelp           = "Available bytes on the filesystem holding the image store"
+	DiskFreeRatioHelp           = "Available fraction of the filesystem holding the image store"
+	DiskCheckTotalHelp          = "Total number of disk space checks before preheating, by decision"
 
 	// label keys
-	LabelImage  = "image"
-	LabelResult = "result"
-	LabelPeer   = "peer"
-	LabelReason = "reason"
-	LabelSource = "source"
-	LabelNode   = "node"
+	LabelImage    = "image"
+	LabelResult   = "result"
+	LabelPeer     = "peer"
+	LabelReason   = "reason"
+	LabelSource   = "source"
+	LabelNode     = "node"
+	LabelDecision = "decision"
 
 	// 业务相关常量
 	SourceP2P       = "p2p"
 	SourceRegistry  = "registry"
+	SourcePeerWait  = "peer_wait"
 	ResultSuccess   = "success"
 	ResultFailed    = "failed"
+	ResultTimeout   = "timeout"
 	ReasonNetwork   = "network"
 	ReasonLoadError = "load_error"
 	ReasonHTTPError = "http_error"
+	ReasonTimeout   = "timeout"
+	// 节点间传输的镜像平台与请求不一致
+	ReasonPlatformMismatch = "platform_mismatch"
+	// 节点间传输的镜像归档未通过完整性校验（config digest、层 diffID 或镜像名不一致）
+	ReasonVerifyFailed = "verify_failed"
+
+	// 磁盘检查决策
+	DecisionAllowed    = "allowed"
+	DecisionDeferred   = "deferred"
+	DecisionBypassed   = "bypassed"
+	ReasonWatermark    = "watermark"
+	ReasonDiskPressure = "disk_pressure"
 )
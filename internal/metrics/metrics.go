@@ -21,6 +21,20 @@ var (
 		},
 		[]string{LabelImage},
 	)
+	RegistryPullBytesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: RegistryPullBytesTotalName,
+			Help: RegistryPullBytesTotalHelp,
+		},
+		[]string{LabelImage},
+	)
+	RegistryPullLayersTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: RegistryPullLayersTotalName,
+			Help: RegistryPullLayersTotalHelp,
+		},
+		[]string{LabelImage},
+	)
 
 	// P2P 分发相关
 	P2PFetchTotal = prometheus.NewCounterVec(
@@ -45,6 +59,13 @@ var (
 		},
 		[]string{LabelImage, LabelPeer, LabelReason},
 	)
+	P2PSkippedLayersTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: P2PSkippedLayersTotalName,
+			Help: P2PSkippedLayersTotalHelp,
+		},
+		[]string{LabelImage, LabelPeer},
+	)
 
 	// 预热任务相关
 	ImagePreheatTotal = prometheus.NewCounterVec(
@@ -70,17 +91,63 @@ var (
 		},
 		[]string{LabelImage, LabelNode},
 	)
+
+	// 等待其他节点回源完成
+	PeerWaitTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: PeerWaitTotalName,
+			Help: PeerWaitTotalHelp,
+		},
+		[]string{LabelImage, LabelResult}, // result: success/failed/timeout
+	)
+	PeerWaitDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    PeerWaitDurationName,
+			Help:    PeerWaitDurationHelp,
+			Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+		},
+		[]string{LabelImage},
+	)
+
+	// 磁盘空间检查
+	DiskFreeBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: DiskFreeBytesName,
+			Help: DiskFreeBytesHelp,
+		},
+	)
+	DiskFreeRatio = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: DiskFreeRatioName,
+			Help: DiskFreeRatioHelp,
+		},
+	)
+	DiskCheckTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: DiskCheckTotalName,
+			Help: DiskCheckTotalHelp,
+		},
+		[]string{LabelImage, LabelDecision, LabelReason}, // decision: allowed/deferred/bypassed
+	)
 )
 
 func InitMetrics() {
 	prometheus.MustRegister(
 		RegistryPullTotal,
 		RegistryPullDuration,
+		RegistryPullBytesTotal,
+		RegistryPullLayersTotal,
 		P2PFetchTotal,
 		P2PFetchDuration,
 		P2PFetchFailedTotal,
+		P2PSkippedLayersTotal,
 		ImagePreheatTotal,
 		ImagePreheatFailedTotal,
 		RegistryPullingGauge,
+		PeerWaitTotal,
+		PeerWaitDuration,
+		DiskFreeBytes,
+		DiskFreeRatio,
+		DiskCheckTotal,
 	)
 }
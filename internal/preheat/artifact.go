@@ -0,0 +1,287 @@
+package preheat
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"image-preheat/internal/config"
+	"image-preheat/internal/docker"
+
+	"github.com/rs/zerolog/log"
+)
+
+// 节点间下载产物缓存：/images/download 先将 docker save（或剔除 base 层链后）的归档写入 MOUNT_DIR/artifacts，
+// 再按文件提供（http.ServeContent），支持 Range 与 If-Range，请求方可从中断处续传。
+// 同一镜像 ID 与 base 复用同一产物，ETag 为产物内容的 sha256，请求方据此确认续传的内容与已下载部分属于同一份归档。
+// 索引只保存在内存中，启动时清空目录。产物在生成与提供期间被引用计数固定，不会被淘汰；
+// 缓存总大小同时受 DOWNLOAD_CACHE_MAX_BYTES 与所在文件系统的磁盘水位线限制。
+
+// imageArtifact 缓存的镜像归档
+type imageArtifact struct {
+	path     string
+	etag     string
+	size     int64
+	modTime  time.Time
+	lastUsed time.Time
+	// 正在提供该产物的请求数，大于 0 时不淘汰
+	refs int
+}
+
+// artifactCache 按 key（镜像 ID 与 base）缓存镜像归档，总大小超过上限时删除最久未使用的产物，
+// 超过 ttl 未使用的产物也会被删除，正在提供的产物除外
+type artifactCache struct {
+	dir      string
+	maxBytes int64
+	ttl      time.Duration
+
+	mu        sync.Mutex
+	artifacts map[string]*imageArtifact
+	// 正在生成的产物，生成结束时关闭
+	building map[string]chan struct{}
+}
+
+var downloadCache *artifactCache
+
+// InitDownloadCache 初始化节点间下载产物缓存（DOWNLOAD_CACHE_MAX_BYTES<=0 时不启用），清空上次运行留下的产物
+func InitDownloadCache() {
+	if config.DownloadCacheMaxBytes <= 0 {
+		return
+	}
+	dir := filepath.Join(config.MountDir, "artifacts")
+	if err := os.RemoveAll(dir); err != nil {
+		log.Warn().Err(err).Str("dir", dir).Msg("清理下载产物缓存目录失败")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Warn().Err(err).Str("dir", dir).Msg("创建下载产物缓存目录失败，节点间下载不支持续传")
+		return
+	}
+	downloadCache = &artifactCache{
+		dir:       dir,
+		maxBytes:  int64(config.DownloadCacheMaxBytes),
+		ttl:       config.DownloadCacheTTL,
+		artifacts: make(map[string]*imageArtifact),
+		building:  make(map[string]chan struct{}),
+	}
+	log.Info().Str("dir", dir).Int64("max_bytes", downloadCache.maxBytes).Dur("ttl", downloadCache.ttl).Msg("节点间下载产物缓存已启用")
+}
+
+// DownloadCacheEnabled 是否通过缓存产物提供节点间下载
+func DownloadCacheEnabled() bool {
+	return downloadCache != nil
+}
+
+// get 返回 key 对应的产物并固定，使用完毕后需调用 release；不存在时调用 build 生成，同一 key 同时只生成一次，其余请求等待。
+// 生成不随发起请求的 ctx 取消（等待方仍需要该产物），最长 PullingTimeout。
+// 淘汰未固定的产物后仍没有余量时返回 ErrDiskPressure，调用方应改为直接流式提供
+func (c *artifactCache) get(ctx context.Context, key string, build func(context.Context, io.Writer) error) (*imageArtifact, error) {
+	for {
+		c.mu.Lock()
+		c.evictLocked("")
+		if a, ok := c.artifacts[key]; ok && fileExists(a.path) {
+			a.lastUsed = time.Now()
+			a.refs++
+			c.mu.Unlock()
+			return a, nil
+		}
+		if a, ok := c.artifacts[key]; ok && a.refs == 0 {
+			delete(c.artifacts, key)
+		}
+		wait, building := c.building[key]
+		if !building {
+			// 淘汰后仍无余量：剩余产物都在提供中，或磁盘剩余空间低于水位线
+			if total := c.totalLocked(); total >= c.budgetLocked(total) {
+				c.mu.Unlock()
+				return nil, fmt.Errorf("%w: %s 没有可用于缓存下载产物的空间", ErrDiskPressure, c.dir)
+			}
+			done := make(chan struct{})
+			c.building[key] = done
+			c.mu.Unlock()
+
+			buildCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), config.PullingTimeout)
+			a, err := c.build(buildCtx, key, build)
+			cancel()
+			c.mu.Lock()
+			delete(c.building, key)
+			if err == nil {
+				a.refs = 1
+				c.artifacts[key] = a
+				c.evictLocked(key)
+			}
+			c.mu.Unlock()
+			close(done)
+			return a, err
+		}
+		c.mu.Unlock()
+		// 生成失败时由等待方重新生成
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// build 将归档写入临时文件并计算 sha256，完成后重命名为 <key>.tar
+func (c *artifactCache) build(ctx context.Context, key string, build func(context.Context, io.Writer) error) (*imageArtifact, error) {
+	tmp, err := os.CreateTemp(c.dir, key+"-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	err = build(ctx, io.MultiWriter(tmp, h))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(c.dir, key+".tar")
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &imageArtifact{
+		path:     path,
+		etag:     `"sha256:` + hex.EncodeToString(h.Sum(nil)) + `"`,
+		size:     info.Size(),
+		modTime:  info.ModTime(),
+		lastUsed: time.Now(),
+	}, nil
+}
+
+// release 取消 get 对产物的固定
+func (c *artifactCache) release(a *imageArtifact) {
+	c.mu.Lock()
+	a.refs--
+	a.lastUsed = time.Now()
+	c.mu.Unlock()
+}
+
+// totalLocked 返回已缓存产物的总大小。调用方需持有锁
+func (c *artifactCache) totalLocked() int64 {
+	var total int64
+	for _, a := range c.artifacts {
+		total += a.size
+	}
+	return total
+}
+
+// budgetLocked 返回产物总大小的上限：不超过 maxBytes，且产物全部计入时所在文件系统的剩余空间不低于磁盘水位线。
+// total 为当前产物总大小，获取磁盘空间失败时只按 maxBytes 限制。调用方需持有锁
+func (c *artifactCache) budgetLocked(total int64) int64 {
+	free, size, err := diskUsage(c.dir)
+	if err != nil {
+		return c.maxBytes
+	}
+	return min(c.maxBytes, total+int64(free)-int64(diskReserve(size)))
+}
+
+// evictLocked 删除过期的产物，再按最久未使用删除直到总大小不超过上限；keep 为刚生成的产物，不删除，
+// 正在提供的产物也不删除。调用方需持有锁
+func (c *artifactCache) evictLocked(keep string) {
+	var total int64
+	keys := make([]string, 0, len(c.artifacts))
+	for key, a := range c.artifacts {
+		if key != keep && a.refs == 0 && time.Since(a.lastUsed) > c.ttl {
+			c.removeLocked(key)
+			continue
+		}
+		total += a.size
+		keys = append(keys, key)
+	}
+	budget := c.budgetLocked(total)
+	sort.Slice(keys, func(i, j int) bool { return c.artifacts[keys[i]].lastUsed.Before(c.artifacts[keys[j]].lastUsed) })
+	for _, key := range keys {
+		if total <= budget {
+			break
+		}
+		if key == keep || c.artifacts[key].refs > 0 {
+			continue
+		}
+		total -= c.artifacts[key].size
+		c.removeLocked(key)
+	}
+}
+
+func (c *artifactCache) removeLocked(key string) {
+	a := c.artifacts[key]
+	delete(c.artifacts, key)
+	if err := os.Remove(a.path); err != nil && !os.IsNotExist(err) {
+		log.Warn().Err(err).Str("path", a.path).Msg("删除下载产物失败")
+	}
+	log.Debug().Str("path", a.path).Int64("size", a.size).Msg("已删除下载产物")
+}
+
+// rateLimitedResponseWriter 对响应体限速
+type rateLimitedResponseWriter struct {
+	http.ResponseWriter
+	w io.Writer
+}
+
+func (w rateLimitedResponseWriter) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+// ServeImageArtifact 通过缓存产物提供镜像下载（带限速），支持 Range、If-Range 与 If-None-Match；
+// base 非空时产物为剔除该层链后的归档。返回错误时尚未写出响应，磁盘空间不足时返回包装 ErrDiskPressure 的错误
+func ServeImageArtifact(w http.ResponseWriter, r *http.Request, image, base string) error {
+	ctx := r.Context()
+	if base != "" && !validChainID(base) {
+		return fmt.Errorf("base 格式错误: %q", base)
+	}
+	id, err := docker.GetImageID(ctx, image)
+	if err != nil {
+		return fmt.Errorf("获取镜像 ID 失败: %v", err)
+	}
+	key := strings.TrimPrefix(id, "sha256:")
+	if base != "" {
+		key += "-" + strings.TrimPrefix(base, "sha256:")
+	}
+	start := time.Now()
+	artifact, err := downloadCache.get(ctx, key, func(ctx context.Context, w io.Writer) error {
+		if base == "" {
+			return docker.Save(ctx, image, w)
+		}
+		_, _, err := saveImageLayers(ctx, image, base, w)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("生成镜像归档失败: %w", err)
+	}
+	defer downloadCache.release(artifact)
+	f, err := os.Open(artifact.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	log.Info().Str("image", image).Str("base", base).Str("etag", artifact.etag).Int64("size", artifact.size).Str("range", r.Header.Get("Range")).Dur("prepare", time.Since(start)).Msg("按缓存产物提供镜像下载")
+
+	w.Header().Set("ETag", artifact.etag)
+	w.Header().Set("Content-Type", "application/x-tar")
+	http.ServeContent(rateLimitedResponseWriter{ResponseWriter: w, w: RateLimitedWriter(w)}, r, "", artifact.modTime, f)
+	return nil
+}
+
+// validChainID 校验 sha256:<64 位十六进制> 格式，base 会作为产物文件名的一部分
+func validChainID(s string) bool {
+	h, ok := strings.CutPrefix(s, "sha256:")
+	if !ok || len(h) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(h)
+	return err == nil && h == strings.ToLower(h)
+}
@@ -0,0 +1,85 @@
+package preheat
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"image-preheat/internal/config"
+)
+
+func newTestArtifactCache(t *testing.T, maxBytes int64) *artifactCache {
+	t.Helper()
+	percent, bytes := config.DiskMinFreePercent, config.DiskMinFreeBytes
+	config.DiskMinFreePercent, config.DiskMinFreeBytes = 0, 0
+	t.Cleanup(func() { config.DiskMinFreePercent, config.DiskMinFreeBytes = percent, bytes })
+	return &artifactCache{
+		dir:       t.TempDir(),
+		maxBytes:  maxBytes,
+		ttl:       time.Hour,
+		artifacts: make(map[string]*imageArtifact),
+		building:  make(map[string]chan struct{}),
+	}
+}
+
+func writeArtifact(data string) func(context.Context, io.Writer) error {
+	return func(_ context.Context, w io.Writer) error {
+		_, err := io.WriteString(w, data)
+		return err
+	}
+}
+
+func TestArtifactCacheKeepsPinnedArtifacts(t *testing.T) {
+	c := newTestArtifactCache(t, 10)
+	ctx := context.Background()
+
+	a, err := c.get(ctx, "a", writeArtifact("aaaaaaaa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a 正在提供，生成 b 超过上限时不应被淘汰
+	b, err := c.get(ctx, "b", writeArtifact("bbbbbbbb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(a.path); err != nil {
+		t.Fatalf("正在提供的产物被删除: %v", err)
+	}
+	c.release(b)
+	c.release(a)
+
+	// a 释放后，再次淘汰时按最久未使用删除
+	c.mu.Lock()
+	c.artifacts["a"].lastUsed = time.Now().Add(-time.Minute)
+	c.evictLocked("")
+	c.mu.Unlock()
+	if _, err := os.Stat(a.path); !os.IsNotExist(err) {
+		t.Fatalf("未固定的产物应被淘汰: %v", err)
+	}
+	if _, err := os.Stat(b.path); err != nil {
+		t.Fatalf("b 不应被淘汰: %v", err)
+	}
+}
+
+func TestArtifactCacheBuildIgnoresRequestCancel(t *testing.T) {
+	c := newTestArtifactCache(t, 1<<20)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	a, err := c.get(ctx, "a", func(ctx context.Context, w io.Writer) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, "data")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("发起请求的 ctx 取消不应中止生成: %v", err)
+	}
+	c.release(a)
+	if a.size != 4 {
+		t.Fatalf("产物大小为 %d，期望 4", a.size)
+	}
+}
@@ -1,6 +1,7 @@
 package preheat
 
 import (
+	"context"
 	"image-preheat/internal/docker"
 	"sync"
 
@@ -21,8 +22,8 @@ func NewPreheatedDigestManager() *PreheatedDigestManager {
 }
 
 // UpdateDigests 更新指定镜像的digest信息
-func (p *PreheatedDigestManager) UpdateDigests(image string) {
-	digests, err := docker.GetImageDigests(image)
+func (p *PreheatedDigestManager) UpdateDigests(ctx context.Context, image string) {
+	digests, err := docker.GetImageDigests(ctx, image)
 	if err != nil {
 		log.Error().Err(err).Str("image", image).Msg("获取镜像digest失败")
 		return
@@ -0,0 +1,91 @@
+package preheat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"image-preheat/internal/config"
+	"image-preheat/internal/metrics"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrDiskPressure 节点磁盘空间低于水位线或处于 DiskPressure，镜像应推迟预热
+var ErrDiskPressure = errors.New("节点磁盘空间不足")
+
+// CheckDiskSpace 在回源拉取或节点间加载前检查镜像存储所在磁盘与 MOUNT_DIR（节点间下载暂存文件与产物缓存）所在磁盘：
+// 任一剩余空间低于水位线或 Node 处于 DiskPressure 时返回 ErrDiskPressure。priority 不低于 DISK_BYPASS_PRIORITY 的镜像不受限制；
+// 检查本身失败时放行
+func CheckDiskSpace(ctx context.Context, image string, priority int) error {
+	reason := ""
+	var detail string
+
+	paths := []string{config.DiskCheckPath}
+	if config.MountDir != config.DiskCheckPath {
+		paths = append(paths, config.MountDir)
+	}
+	for i, path := range paths {
+		free, total, err := diskUsage(path)
+		if err != nil {
+			log.Warn().Err(err).Str("path", path).Msg("获取磁盘空间失败，跳过水位检查")
+			continue
+		}
+		// 指标只反映镜像存储所在磁盘
+		if i == 0 {
+			metrics.DiskFreeBytes.Set(float64(free))
+			if total > 0 {
+				metrics.DiskFreeRatio.Set(float64(free) / float64(total))
+			}
+		}
+		if reason == "" && belowWatermark(free, total) {
+			reason = metrics.ReasonWatermark
+			detail = fmt.Sprintf("%s 剩余 %d 字节（共 %d 字节）", path, free, total)
+		}
+	}
+
+	if reason == "" && config.DiskPressureCheck && nodeLabels != nil {
+		pressure, err := nodeLabels.DiskPressure(ctx)
+		if err != nil {
+			log.Warn().Err(err).Msg("获取节点 DiskPressure 状态失败，使用缓存值")
+		}
+		if pressure {
+			reason = metrics.ReasonDiskPressure
+			detail = "节点处于 DiskPressure 状态"
+		}
+	}
+
+	switch {
+	case reason == "":
+		metrics.DiskCheckTotal.WithLabelValues(image, metrics.DecisionAllowed, "").Inc()
+		return nil
+	case priority >= config.DiskBypassPriority:
+		log.Warn().Str("image", image).Int("priority", priority).Str("reason", reason).Msg("磁盘空间不足，高优先级镜像仍继续预热")
+		metrics.DiskCheckTotal.WithLabelValues(image, metrics.DecisionBypassed, reason).Inc()
+		return nil
+	default:
+		log.Warn().Str("image", image).Int("priority", priority).Str("reason", reason).Str("detail", detail).Msg("磁盘空间不足，推迟预热")
+		metrics.DiskCheckTotal.WithLabelValues(image, metrics.DecisionDeferred, reason).Inc()
+		return fmt.Errorf("%w: %s", ErrDiskPressure, detail)
+	}
+}
+
+// belowWatermark 剩余空间低于 DISK_MIN_FREE_PERCENT 或 DISK_MIN_FREE_BYTES 任一水位线
+func belowWatermark(free, total uint64) bool {
+	if config.DiskMinFreeBytes > 0 && free < uint64(config.DiskMinFreeBytes) {
+		return true
+	}
+	return config.DiskMinFreePercent > 0 && total > 0 && free*100 < total*uint64(config.DiskMinFreePercent)
+}
+
+// diskReserve 返回总大小为 total 的文件系统按水位线需保留的剩余字节数
+func diskReserve(total uint64) uint64 {
+	var reserve uint64
+	if config.DiskMinFreeBytes > 0 {
+		reserve = uint64(config.DiskMinFreeBytes)
+	}
+	if config.DiskMinFreePercent > 0 {
+		reserve = max(reserve, total*uint64(config.DiskMinFreePercent)/100)
+	}
+	return reserve
+}
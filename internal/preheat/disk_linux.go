@@ -0,0 +1,14 @@
+//go:build linux
+
+package preheat
+
+import "syscall"
+
+// diskUsage 返回 path 所在文件系统的可用字节数（非 root 可用）与总字节数
+func diskUsage(path string) (free, total uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), st.Blocks * uint64(st.Bsize), nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package preheat
+
+import "errors"
+
+// diskUsage 非 Linux 平台不支持磁盘空间检查
+func diskUsage(path string) (free, total uint64, err error) {
+	return 0, 0, errors.New("当前平台不支持磁盘空间检查")
+}
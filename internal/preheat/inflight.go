@@ -0,0 +1,55 @@
+package preheat
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// inflightPull 进行中的一次镜像拉取，结束后关闭 done
+type inflightPull struct {
+	done   chan struct{}
+	source string
+	err    error
+}
+
+var (
+	inflightMu    sync.Mutex
+	inflightPulls = make(map[string]*inflightPull)
+)
+
+// dedupePull 同一镜像（同一平台）在本进程内同时只执行一次拉取，定时预热、刷新、按需任务与 PreheatJob 共用。
+// 重复的调用等待进行中的拉取并共享其结果，避免本节点等待自己持有的回源锁、从自己的 Pod 节点间拉取。
+// 进行中的拉取因其 ctx 取消而失败时，仍有效的等待方重新发起拉取
+func dedupePull(ctx context.Context, image, platform string, pull func() (string, error)) (string, error) {
+	key := image + "|" + platform
+	for {
+		inflightMu.Lock()
+		p, ok := inflightPulls[key]
+		if !ok {
+			p = &inflightPull{done: make(chan struct{})}
+			inflightPulls[key] = p
+			inflightMu.Unlock()
+			p.source, p.err = pull()
+			inflightMu.Lock()
+			delete(inflightPulls, key)
+			inflightMu.Unlock()
+			close(p.done)
+			return p.source, p.err
+		}
+		inflightMu.Unlock()
+
+		log.Info().Str("image", image).Str("platform", platform).Msg("镜像正在拉取中，等待其完成")
+		select {
+		case <-p.done:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		if (errors.Is(p.err, context.Canceled) || errors.Is(p.err, context.DeadlineExceeded)) && ctx.Err() == nil {
+			continue
+		}
+		return p.source, p.err
+	}
+}
@@ -0,0 +1,86 @@
+package preheat
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDedupePullSharesResult(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	started := make(chan struct{})
+	pull := func() (string, error) {
+		if calls.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		return "p2p", nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]string, 3)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0], _ = dedupePull(context.Background(), "nginx:1.25", "linux/amd64", pull)
+	}()
+	<-started
+	for i := 1; i < len(results); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = dedupePull(context.Background(), "nginx:1.25", "linux/amd64", pull)
+		}(i)
+	}
+	// 等待方进入等待后再结束拉取
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("同一镜像应只拉取一次，实际 %d 次", n)
+	}
+	for i, source := range results {
+		if source != "p2p" {
+			t.Errorf("第 %d 个调用的来源 %q，期望共享 p2p", i, source)
+		}
+	}
+}
+
+func TestDedupePullRetriesAfterLeaderCanceled(t *testing.T) {
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	leaderDone := make(chan error, 1)
+	go func() {
+		_, err := dedupePull(leaderCtx, "redis:7", "linux/amd64", func() (string, error) {
+			close(started)
+			<-leaderCtx.Done()
+			return "", leaderCtx.Err()
+		})
+		leaderDone <- err
+	}()
+	<-started
+
+	waiterDone := make(chan error, 1)
+	var source string
+	go func() {
+		var err error
+		source, err = dedupePull(context.Background(), "redis:7", "linux/amd64", func() (string, error) {
+			return "registry", nil
+		})
+		waiterDone <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	if err := <-leaderDone; !errors.Is(err, context.Canceled) {
+		t.Fatalf("发起方应返回 ctx 取消，实际: %v", err)
+	}
+	if err := <-waiterDone; err != nil || source != "registry" {
+		t.Fatalf("发起方取消后等待方应重新拉取: source=%q err=%v", source, err)
+	}
+}
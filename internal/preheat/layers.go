@@ -0,0 +1,229 @@
+package preheat
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"image-preheat/internal/docker"
+
+	"github.com/rs/zerolog/log"
+)
+
+// 层级节点间传输：请求方先获取 peer 上镜像的 diffID 列表，计算本地已存在的层链前缀，
+// 再以该前缀的 chainID 作为 base 请求下载；peer 在 docker save 输出中剔除 base 覆盖的层。
+// docker load 遇到本地已存在的 chainID 时不会读取对应的层文件，因此缺失这些层的归档仍可正常加载。
+
+// ImageLayersInfo 镜像层信息（/images/layers 响应）
+type ImageLayersInfo struct {
+	Image    string   `json:"image"`
+	Platform string   `json:"platform"`
+	DiffIDs  []string `json:"diff_ids"`
+}
+
+// GetImageLayersInfo 获取本地镜像的层信息，platform 非空且与本地镜像平台不一致时返回 ErrPlatformMismatch
+func GetImageLayersInfo(ctx context.Context, image, platform string) (*ImageLayersInfo, error) {
+	local, err := CheckImagePlatform(ctx, image, platform)
+	if err != nil {
+		return nil, err
+	}
+	diffIDs, err := docker.GetImageDiffIDs(ctx, image)
+	if err != nil {
+		return nil, err
+	}
+	return &ImageLayersInfo{Image: image, Platform: local, DiffIDs: diffIDs}, nil
+}
+
+// skipLayersForBase 根据 base chainID 计算可省略传输的层 diffID 集合
+func skipLayersForBase(diffIDs []string, base string) (map[string]bool, error) {
+	if base == "" {
+		return nil, nil
+	}
+	n := -1
+	for i, chainID := range docker.ChainIDs(diffIDs) {
+		if chainID == base {
+			n = i + 1
+			break
+		}
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("base 层链不属于该镜像: %s", base)
+	}
+	// 同一 diffID 可能在 base 之上再次出现，此时仍需传输
+	needed := make(map[string]bool)
+	for _, diffID := range diffIDs[n:] {
+		needed[diffID] = true
+	}
+	skip := make(map[string]bool)
+	for _, diffID := range diffIDs[:n] {
+		if !needed[diffID] {
+			skip[diffID] = true
+		}
+	}
+	return skip, nil
+}
+
+// filterImageTar 复制 docker save 归档，剔除 diffID 属于 skip 的层文件。
+// OCI 布局的层文件名即 diffID；旧布局的 <id>/layer.tar 需先落盘计算 sha256。
+func filterImageTar(r io.Reader, w io.Writer, skip map[string]bool) (skipped int, err error) {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return skipped, err
+		}
+
+		if hdr.Typeflag == tar.TypeReg && strings.HasPrefix(hdr.Name, "blobs/sha256/") {
+			if skip["sha256:"+path.Base(hdr.Name)] {
+				skipped++
+				continue
+			}
+		} else if hdr.Typeflag == tar.TypeReg && path.Base(hdr.Name) == "layer.tar" && len(skip) > 0 {
+			drop, err := copyLayerUnlessSkipped(tr, tw, hdr, skip)
+			if err != nil {
+				return skipped, err
+			}
+			if drop {
+				skipped++
+			}
+			continue
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return skipped, err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return skipped, err
+		}
+	}
+	return skipped, tw.Close()
+}
+
+// copyLayerUnlessSkipped 将旧布局层文件暂存到临时文件并计算 diffID，不在 skip 中时写出
+func copyLayerUnlessSkipped(tr *tar.Reader, tw *tar.Writer, hdr *tar.Header, skip map[string]bool) (bool, error) {
+	tmp, err := os.CreateTemp("", "layer-*.tar")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), tr); err != nil {
+		return false, err
+	}
+	if skip["sha256:"+hex.EncodeToString(h.Sum(nil))] {
+		return true, nil
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return false, err
+	}
+	_, err = io.Copy(tw, tmp)
+	return false, err
+}
+
+// StreamImageLayersToHTTPWithRateLimit 流式输出剔除 base 层链后的镜像归档（带限速），
+// ctx 取消（如客户端断开）时终止 docker save
+func StreamImageLayersToHTTPWithRateLimit(ctx context.Context, image, base string, writer io.Writer) error {
+	log.Info().Str("image", image).Str("base", base).Msg("收到层级镜像下载请求")
+	start := time.Now()
+	layers, skipped, err := saveImageLayers(ctx, image, base, RateLimitedWriter(writer))
+	if err != nil {
+		log.Error().Err(err).Str("image", image).Msg("层级镜像传输失败")
+		return err
+	}
+	log.Info().Str("image", image).Int("layers", layers).Int("skipped", skipped).Dur("duration", time.Since(start)).Msg("层级镜像流式传输完成")
+	return nil
+}
+
+// saveImageLayers 将剔除 base 层链后的镜像归档写入 w，返回镜像层数与省略的层数
+func saveImageLayers(ctx context.Context, image, base string, w io.Writer) (layers, skipped int, err error) {
+	diffIDs, err := docker.GetImageDiffIDs(ctx, image)
+	if err != nil {
+		log.Error().Err(err).Str("image", image).Msg("获取镜像层信息失败")
+		return 0, 0, fmt.Errorf("获取镜像层信息失败: %v", err)
+	}
+	skip, err := skipLayersForBase(diffIDs, base)
+	if err != nil {
+		return len(diffIDs), 0, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pr, pw := io.Pipe()
+	go func() {
+		err := docker.Save(ctx, image, pw)
+		if err != nil {
+			log.Error().Err(err).Str("image", image).Msg("docker.Save 失败")
+		}
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close()
+
+	skipped, err = filterImageTar(pr, w, skip)
+	return len(diffIDs), skipped, err
+}
+
+// fetchPeerLayersInfo 获取 peer 上 platform 平台镜像的层信息
+func fetchPeerLayersInfo(ctx context.Context, peer, image, platform string) (*ImageLayersInfo, error) {
+	query := url.Values{"image": {image}, "platform": {platform}}
+	if docker.IsDigestReference(image) {
+		if id, err := pinnedImageID(ctx, image, platform); err == nil {
+			query.Set("id", id)
+		}
+	}
+	resp, err := peerGet(ctx, peer, "/images/layers", query)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("层信息接口返回非200: %d", resp.StatusCode)
+	}
+	var info ImageLayersInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// localLayerBase 计算本地已有的层链前缀，返回其 chainID 与层数；无可复用层或运行时不支持层级传输时返回空
+func localLayerBase(ctx context.Context, peer, image, platform string) (string, int) {
+	// 不支持层级传输的运行时（containerd）无需查询 peer 的层信息
+	if _, err := docker.LocalLayerChainLength(ctx, nil); errors.Is(err, docker.ErrLayerTransferUnsupported) {
+		return "", 0
+	}
+	info, err := fetchPeerLayersInfo(ctx, peer, image, platform)
+	if err != nil {
+		log.Debug().Err(err).Str("image", image).Str("peer", peer).Msg("获取 peer 镜像层信息失败，使用整镜像传输")
+		return "", 0
+	}
+	n, err := docker.LocalLayerChainLength(ctx, info.DiffIDs)
+	if err != nil {
+		log.Debug().Err(err).Str("image", image).Msg("检查本地层失败，使用整镜像传输")
+		return "", 0
+	}
+	if n == 0 {
+		return "", 0
+	}
+	log.Info().Str("image", image).Str("peer", peer).Int("layers", len(info.DiffIDs)).Int("local", n).Msg("本地已存在部分镜像层，仅下载缺失层")
+	return docker.ChainID(info.DiffIDs[:n]), n
+}
@@ -0,0 +1,205 @@
+package preheat
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"image-preheat/internal/config"
+
+	"github.com/rs/zerolog/log"
+)
+
+// 节点间下载续传：请求方先将归档写入 MOUNT_DIR/downloads 下的暂存文件（按镜像、平台与 base 命名，与 peer 无关），
+// 同时记录响应的 ETag。下载中断时保留暂存文件，下次尝试（同一或其他 peer）携带 Range 与 If-Range 请求剩余部分，
+// peer 上产物的 ETag 不同时返回完整内容，从头写入。下载完成后校验内容 sha256 与 ETag 一致，再加载。
+
+// 暂存文件超过该时间未更新视为已放弃，删除
+const partialDownloadTTL = 24 * time.Hour
+
+// 正在使用的暂存文件，同一镜像的并发下载只有一个使用暂存文件
+var (
+	partialDownloadsMu    sync.Mutex
+	partialDownloadsInUse = make(map[string]bool)
+)
+
+// partialDownload 节点间下载的暂存文件
+type partialDownload struct {
+	path     string
+	etagPath string
+	etag     string
+	size     int64
+}
+
+// openPartialDownload 打开 image、platform、base 对应的暂存文件，读取已下载的字节数与 ETag；
+// 暂存文件正被其他下载使用时返回错误。使用完毕后需调用 release
+func openPartialDownload(image, platform, base string) (*partialDownload, error) {
+	dir := filepath.Join(config.MountDir, "downloads")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	removeStalePartialDownloads(dir)
+	sum := sha256.Sum256([]byte(image + "\n" + platform + "\n" + base))
+	name := hex.EncodeToString(sum[:16])
+	p := &partialDownload{
+		path:     filepath.Join(dir, name+".part"),
+		etagPath: filepath.Join(dir, name+".etag"),
+	}
+	partialDownloadsMu.Lock()
+	defer partialDownloadsMu.Unlock()
+	if partialDownloadsInUse[p.path] {
+		return nil, fmt.Errorf("暂存文件正被其他下载使用: %s", p.path)
+	}
+	partialDownloadsInUse[p.path] = true
+	if data, err := os.ReadFile(p.etagPath); err == nil {
+		p.etag = strings.TrimSpace(string(data))
+		if info, err := os.Stat(p.path); err == nil {
+			p.size = info.Size()
+		}
+	}
+	return p, nil
+}
+
+// removeStalePartialDownloads 删除长时间未更新的暂存文件
+func removeStalePartialDownloads(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < partialDownloadTTL {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, e.Name())); err == nil {
+			log.Info().Str("file", e.Name()).Msg("删除过期的节点间下载暂存文件")
+		}
+	}
+}
+
+// header 续传请求头：已有部分内容时请求剩余部分，If-Range 保证剩余部分与已下载部分属于同一份归档
+func (p *partialDownload) header() http.Header {
+	header := http.Header{}
+	if p.size > 0 && p.etag != "" {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", p.size))
+		header.Set("If-Range", p.etag)
+	}
+	return header
+}
+
+// resumable 响应是否可写入暂存文件：200 需带 ETag（不支持续传的 peer 不返回），206 需从已下载的位置开始，
+// 416 表示暂存文件已完整
+func (p *partialDownload) resumable(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Header.Get("ETag") != ""
+	case http.StatusPartialContent:
+		start, _, err := parseContentRange(resp.Header.Get("Content-Range"))
+		return err == nil && start == p.size
+	case http.StatusRequestedRangeNotSatisfiable:
+		_, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+		return err == nil && total == p.size
+	}
+	return false
+}
+
+// receive 将响应写入暂存文件，返回续传前已有的字节数：206 追加到已有内容之后，200 从头写入并记录 ETag。
+// 中途失败时保留已写入的内容供下次续传
+func (p *partialDownload) receive(resp *http.Response) (int64, error) {
+	var resumed int64
+	var f *os.File
+	var err error
+	switch resp.StatusCode {
+	case http.StatusRequestedRangeNotSatisfiable:
+		return p.size, nil
+	case http.StatusPartialContent:
+		resumed = p.size
+		f, err = os.OpenFile(p.path, os.O_WRONLY|os.O_APPEND, 0644)
+	default:
+		p.etag, p.size = resp.Header.Get("ETag"), 0
+		if f, err = os.Create(p.path); err == nil {
+			err = os.WriteFile(p.etagPath, []byte(p.etag), 0644)
+		}
+	}
+	if err != nil {
+		if f != nil {
+			f.Close()
+		}
+		return resumed, err
+	}
+	n, err := io.Copy(f, resp.Body)
+	p.size += n
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return resumed, err
+}
+
+// open 校验暂存文件内容的 sha256 与 ETag 一致（ETag 为 "sha256:<hex>" 时），返回从头读取的文件
+func (p *partialDownload) open() (*os.File, error) {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return nil, err
+	}
+	if digest, ok := strings.CutPrefix(strings.Trim(p.etag, `"`), "sha256:"); ok {
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if actual := hex.EncodeToString(h.Sum(nil)); actual != digest {
+			f.Close()
+			return nil, fmt.Errorf("%w: 下载内容的 sha256 为 %s，与 ETag %s 不一致", ErrVerifyFailed, actual, p.etag)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// release 释放暂存文件的使用权
+func (p *partialDownload) release() {
+	partialDownloadsMu.Lock()
+	delete(partialDownloadsInUse, p.path)
+	partialDownloadsMu.Unlock()
+}
+
+// remove 删除暂存文件
+func (p *partialDownload) remove() {
+	os.Remove(p.path)
+	os.Remove(p.etagPath)
+	p.etag, p.size = "", 0
+}
+
+// parseContentRange 解析 "bytes <start>-<end>/<total>" 或 "bytes */<total>"，start 未知时为 -1
+func parseContentRange(s string) (start, total int64, err error) {
+	r, ok := strings.CutPrefix(s, "bytes ")
+	if !ok {
+		return 0, 0, fmt.Errorf("Content-Range 格式错误: %q", s)
+	}
+	rng, size, ok := strings.Cut(r, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("Content-Range 格式错误: %q", s)
+	}
+	if total, err = strconv.ParseInt(size, 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("Content-Range 格式错误: %q", s)
+	}
+	if rng == "*" {
+		return -1, total, nil
+	}
+	first, _, _ := strings.Cut(rng, "-")
+	if start, err = strconv.ParseInt(first, 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("Content-Range 格式错误: %q", s)
+	}
+	return start, total, nil
+}
@@ -0,0 +1,249 @@
+package preheat
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"image-preheat/internal/config"
+)
+
+var partialTestArchive = bytes.Repeat([]byte("0123456789abcdef"), 64)
+
+func setupPartialDownload(t *testing.T) {
+	t.Helper()
+	dir := config.MountDir
+	config.MountDir = t.TempDir()
+	t.Cleanup(func() { config.MountDir = dir })
+}
+
+func archiveETag(data []byte) string {
+	return `"sha256:` + sha256Hex(data) + `"`
+}
+
+// serveArchive 按 ETag 与 Range 提供归档（与 ServeDownloadArtifact 相同，使用 http.ServeContent）
+func serveArchive(data []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", archiveETag(data))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}
+}
+
+// fetchPartial 携带暂存文件的续传请求头请求 handler
+func fetchPartial(t *testing.T, part *partialDownload, handler http.Handler) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/images/download", nil)
+	for k, v := range part.header() {
+		req.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w.Result()
+}
+
+// seedPartial 模拟上次下载中断：暂存文件只有 data 的前 n 字节
+func seedPartial(t *testing.T, etag string, data []byte) *partialDownload {
+	t.Helper()
+	part, err := openPartialDownload(verifyTestImage, "linux/amd64", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(part.path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(part.etagPath, []byte(etag), 0644); err != nil {
+		t.Fatal(err)
+	}
+	part.release()
+	part, err = openPartialDownload(verifyTestImage, "linux/amd64", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(part.release)
+	if part.size != int64(len(data)) || part.etag != etag {
+		t.Fatalf("暂存文件应记录已下载 %d 字节与 ETag，实际 %d %q", len(data), part.size, part.etag)
+	}
+	return part
+}
+
+func readPartial(t *testing.T, part *partialDownload) []byte {
+	t.Helper()
+	f, err := part.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestPartialDownloadResume(t *testing.T) {
+	setupPartialDownload(t)
+	half := len(partialTestArchive) / 2
+	part := seedPartial(t, archiveETag(partialTestArchive), partialTestArchive[:half])
+
+	resp := fetchPartial(t, part, serveArchive(partialTestArchive))
+	if resp.StatusCode != http.StatusPartialContent || !part.resumable(resp) {
+		t.Fatalf("ETag 一致时应续传剩余部分，实际 %d %q", resp.StatusCode, resp.Header.Get("Content-Range"))
+	}
+	resumed, err := part.receive(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed != int64(half) {
+		t.Fatalf("续传前已有 %d 字节，期望 %d", resumed, half)
+	}
+	if !bytes.Equal(readPartial(t, part), partialTestArchive) {
+		t.Fatal("续传后的内容与归档不一致")
+	}
+}
+
+func TestPartialDownloadRangeIgnored(t *testing.T) {
+	setupPartialDownload(t)
+	part := seedPartial(t, archiveETag(partialTestArchive), partialTestArchive[:100])
+
+	// peer 忽略 Range 返回完整内容：从头写入
+	ignoreRange := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", archiveETag(partialTestArchive))
+		w.Write(partialTestArchive)
+	})
+	resp := fetchPartial(t, part, ignoreRange)
+	if resp.StatusCode != http.StatusOK || !part.resumable(resp) {
+		t.Fatalf("带 ETag 的 200 响应应写入暂存文件，实际 %d", resp.StatusCode)
+	}
+	resumed, err := part.receive(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed != 0 {
+		t.Fatalf("200 响应应从头写入，实际续传 %d 字节", resumed)
+	}
+	if !bytes.Equal(readPartial(t, part), partialTestArchive) {
+		t.Fatal("从头写入后的内容与归档不一致")
+	}
+
+	// 不返回 ETag 的 peer 不支持续传，暂存内容保留
+	noETag := httptest.NewRecorder()
+	noETag.WriteHeader(http.StatusOK)
+	if part.resumable(noETag.Result()) {
+		t.Fatal("未返回 ETag 的 200 响应不应写入暂存文件")
+	}
+}
+
+func TestPartialDownloadIfRangeMismatch(t *testing.T) {
+	setupPartialDownload(t)
+	stale := bytes.Repeat([]byte("x"), 200)
+	part := seedPartial(t, archiveETag(stale), stale[:100])
+
+	// peer 上的产物已变化：If-Range 不匹配，返回完整的新归档
+	resp := fetchPartial(t, part, serveArchive(partialTestArchive))
+	if resp.StatusCode != http.StatusOK || !part.resumable(resp) {
+		t.Fatalf("If-Range 不匹配时应返回完整内容，实际 %d", resp.StatusCode)
+	}
+	if resumed, err := part.receive(resp); err != nil || resumed != 0 {
+		t.Fatalf("If-Range 不匹配时应从头写入: %d, %v", resumed, err)
+	}
+	if part.etag != archiveETag(partialTestArchive) {
+		t.Fatalf("应记录新归档的 ETag，实际 %q", part.etag)
+	}
+	if data, err := os.ReadFile(part.etagPath); err != nil || string(data) != part.etag {
+		t.Fatalf("ETag 文件未更新: %q, %v", data, err)
+	}
+	if !bytes.Equal(readPartial(t, part), partialTestArchive) {
+		t.Fatal("重新下载的内容与新归档不一致")
+	}
+}
+
+func TestPartialDownloadContentRange(t *testing.T) {
+	part := &partialDownload{size: 100}
+	response := func(status int, contentRange string) *http.Response {
+		resp := &http.Response{StatusCode: status, Header: http.Header{}}
+		if contentRange != "" {
+			resp.Header.Set("Content-Range", contentRange)
+		}
+		return resp
+	}
+	cases := []struct {
+		name   string
+		resp   *http.Response
+		resume bool
+	}{
+		{"206 from saved size", response(http.StatusPartialContent, "bytes 100-199/200"), true},
+		{"206 from other offset", response(http.StatusPartialContent, "bytes 50-199/200"), false},
+		{"206 missing Content-Range", response(http.StatusPartialContent, ""), false},
+		{"206 malformed unit", response(http.StatusPartialContent, "items 100-199/200"), false},
+		{"206 malformed total", response(http.StatusPartialContent, "bytes 100-199/abc"), false},
+		{"206 malformed start", response(http.StatusPartialContent, "bytes x-199/200"), false},
+		{"206 missing total", response(http.StatusPartialContent, "bytes 100-199"), false},
+		{"416 already complete", response(http.StatusRequestedRangeNotSatisfiable, "bytes */100"), true},
+		{"416 size mismatch", response(http.StatusRequestedRangeNotSatisfiable, "bytes */200"), false},
+		{"416 malformed", response(http.StatusRequestedRangeNotSatisfiable, "bytes */"), false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := part.resumable(tc.resp); got != tc.resume {
+				t.Fatalf("resumable = %v，期望 %v", got, tc.resume)
+			}
+		})
+	}
+}
+
+// redirectTransport 将节点间请求转发到测试服务
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (rt redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = rt.target.Scheme, rt.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestDownloadFromPeerChecksumMismatchRemovesPartial(t *testing.T) {
+	setupPartialDownload(t)
+	mode, resume := config.P2PVerifyMode, config.DownloadResumeEnabled
+	client := peerHTTPClient
+	t.Cleanup(func() {
+		config.P2PVerifyMode, config.DownloadResumeEnabled = mode, resume
+		peerHTTPClient = client
+	})
+	config.P2PVerifyMode, config.DownloadResumeEnabled = config.P2PVerifyOff, true
+
+	// ETag 声明的 sha256 与实际内容不一致
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", archiveETag([]byte("other")))
+		w.Write(partialTestArchive)
+	}))
+	defer srv.Close()
+	target, _ := url.Parse(srv.URL)
+	peerHTTPClient = &http.Client{Transport: redirectTransport{target: target}}
+
+	err := downloadFromPeer(context.Background(), "127.0.0.1", verifyTestImage, "linux/amd64", "")
+	if !errors.Is(err, ErrVerifyFailed) || !strings.Contains(err.Error(), "sha256") {
+		t.Fatalf("sha256 与 ETag 不一致时应校验失败，实际 %v", err)
+	}
+	part, err := openPartialDownload(verifyTestImage, "linux/amd64", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer part.release()
+	if part.size != 0 || part.etag != "" {
+		t.Fatalf("校验失败后应删除暂存文件，实际 %d 字节、ETag %q", part.size, part.etag)
+	}
+	for _, path := range []string{part.path, part.etagPath} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("%s 应已删除: %v", path, err)
+		}
+	}
+}
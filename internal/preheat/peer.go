@@ -1,12 +1,12 @@
 package preheat
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"image-preheat/internal/config"
 	"net"
 	"net/http"
-	"os"
 	"sync"
 	"time"
 
@@ -134,8 +134,8 @@ func discoverPreferredPeers(nodeName string) ([]string, error) {
 // getMyPodIP 获取当前 Pod 的 IP
 func getMyPodIP() string {
 	// 方法1: 从环境变量获取 (推荐)
-	if podIP := os.Getenv("POD_IP"); podIP != "" {
-		return podIP
+	if config.PodIP != "" {
+		return config.PodIP
 	}
 
 	// 方法2: 从网络接口获取
@@ -159,14 +159,19 @@ func getMyPodIP() string {
 // 全局 peer 选择器实例
 var peerSelector = NewPeerSelector()
 
-// 定期更新 peers 列表
-func StartPeerDiscovery() {
+// 定期更新 peers 列表，ctx 取消时退出
+func StartPeerDiscovery(ctx context.Context) {
 	log.Info().Msg("启动节点发现定时任务")
 	ticker := time.NewTicker(config.PeerDiscoveryInterval)
 	defer ticker.Stop()
 
 	for {
-		<-ticker.C
+		select {
+		case <-ctx.Done():
+			log.Info().Msg("节点发现定时任务已停止")
+			return
+		case <-ticker.C:
+		}
 		log.Debug().Msg("周期性刷新 peers 列表")
 		if err := peerSelector.UpdatePeers(); err != nil {
 			log.Error().Err(err).Msg("更新 peers 失败")
@@ -174,6 +179,41 @@ func StartPeerDiscovery() {
 	}
 }
 
+// 已发现 peer 的 IP 未命中时重新解析 headless service 的最小间隔
+const knownPeersRefreshInterval = 10 * time.Second
+
+// knownPeers headless service 解析到的 peer IP 缓存，用于节点间请求的身份校验
+var knownPeers struct {
+	mu      sync.Mutex
+	ips     map[string]bool
+	fetched time.Time
+}
+
+// IsKnownPeer 判断 ip 是否属于已发现的 peer（当前 peers 列表或 headless service 解析结果）。
+// 新加入的节点可能尚未出现在缓存中，未命中时按最小间隔重新解析 headless service
+func IsKnownPeer(ip string) bool {
+	for _, peer := range peerSelector.GetPeers() {
+		if peer == ip {
+			return true
+		}
+	}
+	knownPeers.mu.Lock()
+	defer knownPeers.mu.Unlock()
+	if !knownPeers.ips[ip] && time.Since(knownPeers.fetched) >= knownPeersRefreshInterval {
+		knownPeers.fetched = time.Now()
+		ips, err := net.LookupHost(config.PeerDiscoveryServiceName)
+		if err != nil {
+			log.Warn().Err(err).Msg("解析 headless service 失败，沿用缓存的 peer 列表")
+		} else {
+			knownPeers.ips = make(map[string]bool, len(ips))
+			for _, peer := range ips {
+				knownPeers.ips[peer] = true
+			}
+		}
+	}
+	return knownPeers.ips[ip]
+}
+
 // 获取 peers 列表 (供外部使用)
 func GetPeerIPs() []string {
 	return peerSelector.GetPeers()
@@ -0,0 +1,105 @@
+package preheat
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"image-preheat/internal/config"
+
+	"github.com/rs/zerolog/log"
+)
+
+// 节点间 HTTP 服务端口
+const peerPort = 8080
+
+// 节点间请求使用的客户端与协议，开启 PEER_TLS_ENABLED 后替换为 mTLS 客户端
+var (
+	peerHTTPClient = http.DefaultClient
+	peerScheme     = "http"
+)
+
+// InitPeerTLS 开启 PEER_TLS_ENABLED 时加载证书并监听文件变化，切换节点间客户端为 mTLS，
+// 返回 HTTP 服务使用的 TLS 配置；未开启时返回 nil
+func InitPeerTLS(ctx context.Context) (*tls.Config, error) {
+	if !config.PeerTLSEnabled {
+		return nil, nil
+	}
+	reloader := config.NewCertReloader(config.PeerTLSCertFile, config.PeerTLSKeyFile, config.PeerTLSCAFile)
+	if err := reloader.Load(); err != nil {
+		return nil, err
+	}
+	go reloader.Watch(ctx)
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = reloader.ClientConfig(config.PeerTLSServerName)
+	peerHTTPClient = &http.Client{Transport: transport}
+	peerScheme = "https"
+	log.Info().Str("cert", config.PeerTLSCertFile).Str("ca", config.PeerTLSCAFile).Str("server_name", config.PeerTLSServerName).Msg("节点间 mTLS 已启用")
+	return reloader.ServerConfig(), nil
+}
+
+// peerGet 向 peer 的节点间接口发起 GET 请求；开启 mTLS 时只访问已发现的 peer
+func peerGet(ctx context.Context, peer, path string, query url.Values) (*http.Response, error) {
+	return peerRequest(ctx, peer, path, query, nil)
+}
+
+// peerRequest 同 peerGet，附带额外的请求头（如续传的 Range）
+func peerRequest(ctx context.Context, peer, path string, query url.Values, header http.Header) (*http.Response, error) {
+	if config.PeerTLSEnabled && !IsKnownPeer(peer) {
+		return nil, fmt.Errorf("%s 不属于已发现的 peer", peer)
+	}
+	u := url.URL{
+		Scheme:   peerScheme,
+		Host:     net.JoinHostPort(peer, strconv.Itoa(peerPort)),
+		Path:     path,
+		RawQuery: query.Encode(),
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if token := peerToken(u.Scheme); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return peerHTTPClient.Do(req)
+}
+
+var insecureTokenOnce sync.Once
+
+// peerToken 节点间请求携带的 bearer token：优先使用共享 token，启用 tokenreview 鉴权时使用 audience 为
+// PEER_TOKEN_AUDIENCE 的 projected ServiceAccount token（每次读取文件，兼容 token 轮换）；均未启用时为空。
+// token 只通过 HTTPS 发送，未开启节点间 mTLS 时不携带
+func peerToken(scheme string) string {
+	if !config.APIAuthModeEnabled(config.APIAuthModeToken) && !config.APIAuthModeEnabled(config.APIAuthModeTokenReview) {
+		return ""
+	}
+	if scheme != "https" {
+		insecureTokenOnce.Do(func() {
+			log.Warn().Msg("未开启节点间 mTLS，节点间请求不携带 bearer token")
+		})
+		return ""
+	}
+	if config.APIAuthModeEnabled(config.APIAuthModeToken) && config.APIAuthToken != "" {
+		return config.APIAuthToken
+	}
+	if !config.APIAuthModeEnabled(config.APIAuthModeTokenReview) {
+		return ""
+	}
+	data, err := os.ReadFile(config.PeerTokenFile)
+	if err != nil {
+		log.Warn().Err(err).Str("file", config.PeerTokenFile).Msg("读取节点间 token 失败")
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
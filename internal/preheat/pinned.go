@@ -0,0 +1,86 @@
+package preheat
+
+import (
+	"context"
+	"regexp"
+	"sync"
+
+	"image-preheat/internal/config"
+	"image-preheat/internal/docker"
+
+	"github.com/rs/zerolog/log"
+)
+
+// 按 digest 固定的镜像（repo@sha256:...）经 docker save/load 后不保留 RepoDigest，节点间加载后本地只能按镜像 ID 找到。
+// 请求方从镜像仓库解析出目标平台的 config digest（即镜像 ID），向 peer 请求时通过 id 参数携带；
+// 本地与 peer 都先按名称、再按镜像 ID 判断镜像是否存在。digest 固定的引用与 config 的对应关系不会变化，解析结果常驻缓存
+
+var (
+	pinnedIDsMu sync.Mutex
+	pinnedIDs   = make(map[string]string)
+)
+
+var imageIDPattern = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// pinnedImageID 返回按 digest 固定的镜像在 platform 平台的 config digest（镜像 ID）
+func pinnedImageID(ctx context.Context, image, platform string) (string, error) {
+	platform = config.NormalizePlatform(platform)
+	key := image + "/" + platform
+	pinnedIDsMu.Lock()
+	id, ok := pinnedIDs[key]
+	pinnedIDsMu.Unlock()
+	if ok {
+		return id, nil
+	}
+	id, err := docker.ResolveImageConfig(ctx, image, platform)
+	if err != nil {
+		return "", err
+	}
+	pinnedIDsMu.Lock()
+	pinnedIDs[key] = id
+	pinnedIDsMu.Unlock()
+	return id, nil
+}
+
+// HasLocalImage 判断镜像是否在本地：按 digest 固定的镜像按名称找不到时，按解析出的镜像 ID 判断
+func HasLocalImage(ctx context.Context, localImages map[string]struct{}, image, platform string) bool {
+	if docker.HasImage(localImages, image) {
+		return true
+	}
+	if !docker.IsDigestReference(image) {
+		return false
+	}
+	id, err := pinnedImageID(ctx, image, platform)
+	if err != nil {
+		log.Debug().Err(err).Str("image", image).Msg("解析按 digest 固定的镜像 ID 失败")
+		return false
+	}
+	return docker.HasImage(localImages, id)
+}
+
+// LocalImageRef 返回镜像在本地可用于 inspect/save 的名称：按名称存在时返回 image；
+// 按 digest 固定的镜像按名称不存在、而 id（期望的镜像 ID）存在时返回 id
+func LocalImageRef(ctx context.Context, image, id string) string {
+	if id == "" || !imageIDPattern.MatchString(id) || !docker.IsDigestReference(image) {
+		return image
+	}
+	if exists, err := docker.ImageExists(ctx, image); err == nil && exists {
+		return image
+	}
+	if exists, err := docker.ImageExists(ctx, id); err == nil && exists {
+		return id
+	}
+	return image
+}
+
+// ResolveLocalImage 同 LocalImageRef，按 digest 固定的镜像的期望镜像 ID 由 image 解析得到
+func ResolveLocalImage(ctx context.Context, image, platform string) string {
+	if !docker.IsDigestReference(image) {
+		return image
+	}
+	id, err := pinnedImageID(ctx, image, platform)
+	if err != nil {
+		return image
+	}
+	return LocalImageRef(ctx, image, id)
+}
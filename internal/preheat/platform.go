@@ -0,0 +1,50 @@
+package preheat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"image-preheat/internal/config"
+	"image-preheat/internal/docker"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrPlatformMismatch 本地镜像平台与请求的平台不一致
+var ErrPlatformMismatch = errors.New("镜像平台不一致")
+
+// CheckImagePlatform 获取本地镜像的平台并与 platform 比较，不一致时返回 ErrPlatformMismatch；
+// platform 为空表示不限制
+func CheckImagePlatform(ctx context.Context, image, platform string) (string, error) {
+	local, err := docker.GetImagePlatform(ctx, image)
+	if err != nil {
+		return "", fmt.Errorf("获取镜像平台失败: %v", err)
+	}
+	if !config.PlatformMatches(local, platform) {
+		return local, fmt.Errorf("%w: %s 本地为 %s，请求 %s", ErrPlatformMismatch, image, local, platform)
+	}
+	return local, nil
+}
+
+// verifyLoadedImagePlatform 校验节点间加载的镜像平台，不一致时删除该镜像，避免错误平台的镜像被使用；
+// 无法获取平台时放行
+func verifyLoadedImagePlatform(ctx context.Context, image, platform string) error {
+	_, err := CheckImagePlatform(ctx, image, platform)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, ErrPlatformMismatch) {
+		log.Warn().Err(err).Str("image", image).Msg("获取加载镜像的平台失败，跳过平台校验")
+		return nil
+	}
+	if rmErr := docker.RemoveImage(ctx, image); rmErr != nil {
+		log.Warn().Err(rmErr).Str("image", image).Msg("删除平台不一致的镜像失败")
+	}
+	return err
+}
+
+// pullLockName 回源锁名称：同一镜像的不同平台各自回源
+func pullLockName(image, platform string) string {
+	return image + "/" + platform
+}
@@ -1,10 +1,14 @@
 package preheat
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"sync"
 	"time"
 
 	"image-preheat/internal/config"
@@ -16,39 +20,154 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-// 你需要实现 imageExistsLocally 和 preheatImage
-
 var (
-	k8sLock        *config.K8sConfigMapLock
+	k8sLock        config.Locker
 	k8sNodeName    = config.NodeName
 	k8sNamespace   = config.K8sNamespace
 	k8sCMName      = config.K8sLockCM
 	k8sLockTimeout = config.K8sLockTimeout
+	k8sLockMax     = config.K8sLockMaxImages
 	// 全局下载限速桶
 	downloadRateLimitBucket *ratelimit.Bucket
+
+	// 本节点 Node 标签，用于判断镜像是否面向本节点
+	nodeLabels *config.NodeLabels
+
+	// 本节点当前持有的回源锁（image -> fencing token），退出时统一释放
+	heldLocksMu sync.Mutex
+	heldLocks   = make(map[string]int64)
 )
 
+// Node 标签缓存有效期
+const nodeLabelsTTL = time.Minute
+
+// GetNodeLabels 获取本节点 Node 对象的标签；读取失败但有缓存时同时返回缓存与错误
+func GetNodeLabels(ctx context.Context) (map[string]string, error) {
+	if nodeLabels == nil {
+		return nil, fmt.Errorf("K8s客户端未初始化，无法获取节点标签")
+	}
+	return nodeLabels.Get(ctx)
+}
+
+func trackHeldLock(image string, token int64) {
+	heldLocksMu.Lock()
+	heldLocks[image] = token
+	heldLocksMu.Unlock()
+}
+
+func untrackHeldLock(image string, token int64) {
+	heldLocksMu.Lock()
+	if heldLocks[image] == token {
+		delete(heldLocks, image)
+	}
+	heldLocksMu.Unlock()
+}
+
+// ReleaseHeldLocks 释放本节点仍持有的全部回源锁，用于进程退出前让其他节点尽快接管
+func ReleaseHeldLocks() {
+	heldLocksMu.Lock()
+	locks := make(map[string]int64, len(heldLocks))
+	for image, token := range heldLocks {
+		locks[image] = token
+	}
+	heldLocksMu.Unlock()
+
+	for image, token := range locks {
+		if err := k8sLock.ReleaseLock(image, k8sNodeName, token); err != nil {
+			log.Warn().Err(err).Str("image", image).Int64("token", token).Msg("退出时释放回源锁失败")
+			continue
+		}
+		untrackHeldLock(image, token)
+		log.Info().Str("image", image).Int64("token", token).Msg("退出时已释放回源锁")
+	}
+}
+
 var maxConcurrentPreheat = config.PreheatConcurrency
 var preheatSemaphore = make(chan struct{}, maxConcurrentPreheat)
 
-func acquirePreheatSlot() { preheatSemaphore <- struct{}{} }
+// acquirePreheatSlot 等待预热并发槽位，ctx 取消时放弃等待
+func acquirePreheatSlot(ctx context.Context) error {
+	select {
+	case preheatSemaphore <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 func releasePreheatSlot() { <-preheatSemaphore }
 
-func preheatImageWithLimit(image string) error {
-	log.Info().Str("image", image).Msg("开始预热镜像任务")
-	acquirePreheatSlot()
-	defer releasePreheatSlot()
-	err := preheatImage(image)
+func preheatImageWithLimit(ctx context.Context, image, platform string) (string, error) {
+	platform = config.NormalizePlatform(platform)
+	log.Info().Str("image", image).Str("platform", platform).Msg("开始预热镜像任务")
+	source, err := dedupePull(ctx, image, platform, func() (string, error) {
+		if err := acquirePreheatSlot(ctx); err != nil {
+			return "", err
+		}
+		defer releasePreheatSlot()
+		return preheatImage(ctx, image, platform)
+	})
 	if err != nil {
 		log.Error().Err(err).Str("image", image).Msg("镜像预热失败")
 	} else {
-		log.Info().Str("image", image).Msg("镜像预热完成")
+		log.Info().Str("image", image).Str("source", source).Msg("镜像预热完成")
+	}
+	return source, err
+}
+
+// PreheatImageWithLimit 预热 platform（os/arch[/variant]，为空表示节点平台）的镜像，
+// 节点间拉取只接受相同平台的镜像
+func PreheatImageWithLimit(ctx context.Context, image, platform string) error {
+	_, err := preheatImageWithLimit(ctx, image, platform)
+	return err
+}
+
+// PreheatImageWithSource 同 PreheatImageWithLimit，同时返回镜像来源（p2p/registry/peer_wait）；
+// 与预热队列共用进行中拉取的去重，同一镜像正在拉取时等待并共享其结果
+func PreheatImageWithSource(ctx context.Context, image, platform string) (string, error) {
+	return preheatImageWithLimit(ctx, image, platform)
+}
+
+// RefreshImageWithLimit 跳过节点间拉取直接回源刷新镜像（拉取策略 Always），
+// 其他节点正在回源时等待其完成并从其节点间获取
+func RefreshImageWithLimit(ctx context.Context, image, platform string) error {
+	platform = config.NormalizePlatform(platform)
+	log.Info().Str("image", image).Str("platform", platform).Msg("开始刷新镜像任务")
+	_, err := dedupePull(ctx, image, platform, func() (string, error) {
+		if err := acquirePreheatSlot(ctx); err != nil {
+			return "", err
+		}
+		defer releasePreheatSlot()
+		return pullImageWithLock(ctx, image, platform)
+	})
+	if err != nil {
+		log.Error().Err(err).Str("image", image).Msg("镜像刷新失败")
+	} else {
+		log.Info().Str("image", image).Msg("镜像刷新完成")
 	}
 	return err
 }
 
-func PreheatImageWithLimit(image string) error {
-	return preheatImageWithLimit(image)
+// ImageDigestChanged 向镜像仓库查询 tag 当前的 manifest digest，与本地 RepoDigests 及 known（上次刷新到的 digest，
+// 用于节点间传输加载、没有 RepoDigest 的镜像）比较，返回远端 digest 与是否变化
+func ImageDigestChanged(ctx context.Context, image, known string) (string, bool, error) {
+	remote, err := docker.ResolveDigest(ctx, image)
+	if err != nil {
+		return "", false, fmt.Errorf("查询镜像仓库 digest 失败: %v", err)
+	}
+	if remote == known {
+		return remote, false, nil
+	}
+	local, err := docker.GetRepoDigests(ctx, image)
+	if err != nil {
+		return remote, false, fmt.Errorf("获取本地镜像 digest 失败: %v", err)
+	}
+	for _, d := range local {
+		if d == remote {
+			return remote, false, nil
+		}
+	}
+	log.Info().Str("image", image).Str("remote_digest", remote).Strs("local_digests", local).Msg("镜像 tag 已指向新的 digest")
+	return remote, true, nil
 }
 
 func fileExists(path string) bool {
@@ -56,13 +175,13 @@ func fileExists(path string) bool {
 	return err == nil && !info.IsDir()
 }
 
-// 用 reader 直接流式加载镜像到 docker
-func loadImageFromReader(reader io.Reader) error {
-	return docker.Load(reader)
+// 用 reader 直接流式加载 platform 平台的镜像到运行时
+func loadImageFromReader(ctx context.Context, reader io.Reader, platform string) error {
+	return docker.Load(ctx, reader, platform)
 }
 
-// 查询其他节点并直接流式加载镜像
-func fetchImageFromPeers(image string) error {
+// 查询其他节点并直接流式加载镜像，只接受 platform 平台的镜像
+func fetchImageFromPeers(ctx context.Context, image, platform string) error {
 	peers := GetPeerIPs() // 使用新的 peer 发现机制
 	log.Info().Str("image", image).Strs("peers", peers).Msg("尝试节点间拉取镜像")
 	if len(peers) == 0 {
@@ -70,46 +189,146 @@ func fetchImageFromPeers(image string) error {
 	}
 
 	// 尝试轮询方式
-	for i := 0; i < len(peers); i++ {
+	for i := 0; i < len(peers) && ctx.Err() == nil; i++ {
 		peer := peerSelector.GetNextPeer()
 		log.Debug().Str("image", image).Str("peer", peer).Msg("尝试从 peer 拉取镜像")
-		if err := tryDownloadFromPeer(peer, image); err == nil {
+		if err := tryDownloadFromPeer(ctx, peer, image, platform); err == nil {
 			log.Info().Str("image", image).Str("peer", peer).Msg("节点间拉取成功")
 			return nil // 成功加载
 		}
 	}
 
 	// 轮询失败，尝试随机选择
-	for i := 0; i < 3; i++ { // 最多尝试3次
+	for i := 0; i < 3 && ctx.Err() == nil; i++ { // 最多尝试3次
 		peer := peerSelector.GetRandomPeer()
 		log.Debug().Str("image", image).Str("peer", peer).Msg("随机尝试从 peer 拉取镜像")
-		if err := tryDownloadFromPeer(peer, image); err == nil {
+		if err := tryDownloadFromPeer(ctx, peer, image, platform); err == nil {
 			log.Info().Str("image", image).Str("peer", peer).Msg("节点间拉取成功")
 			return nil // 成功加载
 		}
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	log.Warn().Str("image", image).Msg("所有节点间拉取失败")
 	return fmt.Errorf("集群内无可用镜像")
 }
 
-// tryDownloadFromPeer 尝试从指定 peer 下载镜像
-func tryDownloadFromPeer(peer, image string) error {
+// tryDownloadFromPeer 尝试从指定 peer 下载镜像，本地已有部分层时仅下载缺失层
+func tryDownloadFromPeer(ctx context.Context, peer, image, platform string) error {
+	base, localLayers := localLayerBase(ctx, peer, image, platform)
+	err := downloadFromPeer(ctx, peer, image, platform, base)
+	if err != nil && base != "" && ctx.Err() == nil && !errors.Is(err, ErrPlatformMismatch) && !errors.Is(err, ErrVerifyFailed) {
+		log.Warn().Err(err).Str("image", image).Str("peer", peer).Msg("层级传输失败，回退到整镜像传输")
+		err = downloadFromPeer(ctx, peer, image, platform, "")
+	} else if err == nil && base != "" {
+		metrics.P2PSkippedLayersTotal.WithLabelValues(image, peer).Add(float64(localLayers))
+	}
+	return err
+}
+
+// downloadFromPeer 从 peer 下载镜像归档，校验完整性后加载，base 非空时 peer 省略该层链覆盖的层；
+// peer 上镜像平台与 platform 不一致时返回 409，加载后再次校验平台（兼容不校验平台的 peer）。
+// 开启续传时先写入暂存文件，中断后下次尝试从已下载的位置继续。单次下载（含加载）最长 PullingTimeout
+func downloadFromPeer(ctx context.Context, peer, image, platform, base string) error {
+	ctx, cancel := context.WithTimeout(ctx, config.PullingTimeout)
+	defer cancel()
 	start := time.Now()
-	url := fmt.Sprintf("http://%s:8080/images/download?image=%s", peer, image)
-	resp, err := http.Get(url)
-	if err != nil || resp.StatusCode != http.StatusOK {
+	configDigest, err := expectedImageConfig(ctx, image, platform)
+	if err != nil {
+		log.Warn().Err(err).Str("image", image).Msg("获取期望的镜像 digest 失败，跳过节点间拉取")
+		metrics.P2PFetchFailedTotal.WithLabelValues(image, peer, metrics.ReasonVerifyFailed).Inc()
+		return err
+	}
+	query := url.Values{"image": {image}, "platform": {platform}}
+	if docker.IsDigestReference(image) && configDigest != "" {
+		// 节点间加载的 digest 固定镜像在 peer 上只有镜像 ID
+		query.Set("id", configDigest)
+	}
+	if base != "" {
+		query.Set("base", base)
+	}
+	var part *partialDownload
+	var header http.Header
+	if config.DownloadResumeEnabled {
+		if part, err = openPartialDownload(image, platform, base); err != nil {
+			log.Warn().Err(err).Str("image", image).Msg("打开节点间下载暂存文件失败，直接流式加载")
+			part = nil
+		} else {
+			defer part.release()
+			header = part.header()
+		}
+	}
+	resp, err := peerRequest(ctx, peer, "/images/download", query, header)
+	if err == nil && part != nil && (resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusRequestedRangeNotSatisfiable) && !part.resumable(resp) {
+		// 续传范围与暂存文件不一致，丢弃暂存内容后重新下载
+		log.Warn().Str("image", image).Str("peer", peer).Str("content_range", resp.Header.Get("Content-Range")).Msg("续传范围与暂存文件不一致，重新下载")
+		resp.Body.Close()
+		part.remove()
+		resp, err = peerRequest(ctx, peer, "/images/download", query, nil)
+	}
+	if err == nil && part != nil && !part.resumable(resp) {
+		// 不支持续传的 peer（未返回 ETag）直接流式加载，暂存内容保留给其他 peer 续传
+		part = nil
+	}
+	if err != nil || (resp.StatusCode != http.StatusOK && part == nil) {
 		reason := metrics.ReasonHTTPError
 		if err != nil {
 			reason = metrics.ReasonNetwork
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				reason = metrics.ReasonTimeout
+			}
+		} else if resp.StatusCode == http.StatusConflict {
+			reason = metrics.ReasonPlatformMismatch
+			err = ErrPlatformMismatch
+			resp.Body.Close()
 		} else {
 			reason = fmt.Sprintf("http_%d", resp.StatusCode)
+			resp.Body.Close()
 		}
 		metrics.P2PFetchFailedTotal.WithLabelValues(image, peer, reason).Inc()
-		return fmt.Errorf("peer fetch failed: %v", err)
+		return fmt.Errorf("peer fetch failed: %w", err)
 	}
 	defer resp.Body.Close()
-	if err := loadImageFromReader(resp.Body); err != nil {
-		metrics.P2PFetchFailedTotal.WithLabelValues(image, peer, metrics.ReasonLoadError).Inc()
+	var reader io.Reader = resp.Body
+	if part != nil {
+		resumed, err := part.receive(resp)
+		if err != nil {
+			reason := metrics.ReasonNetwork
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				reason = metrics.ReasonTimeout
+			}
+			metrics.P2PFetchFailedTotal.WithLabelValues(image, peer, reason).Inc()
+			log.Warn().Err(err).Str("image", image).Str("peer", peer).Int64("saved_bytes", part.size).Msg("节点间下载中断，已下载部分保留供续传")
+			return fmt.Errorf("节点间下载中断: %w", err)
+		}
+		if resumed > 0 {
+			log.Info().Str("image", image).Str("peer", peer).Int64("resumed_bytes", resumed).Int64("size", part.size).Msg("节点间下载续传完成")
+		}
+		f, err := part.open()
+		part.remove()
+		if err != nil {
+			metrics.P2PFetchFailedTotal.WithLabelValues(image, peer, metrics.ReasonVerifyFailed).Inc()
+			return err
+		}
+		defer f.Close()
+		reader = f
+	}
+	if err := loadVerifiedImage(ctx, reader, image, platform, configDigest, base); err != nil {
+		reason := metrics.ReasonLoadError
+		if errors.Is(err, ErrVerifyFailed) {
+			reason = metrics.ReasonVerifyFailed
+			log.Warn().Err(err).Str("image", image).Str("peer", peer).Msg("节点间传输的镜像未通过完整性校验，已拒绝加载")
+		} else if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			reason = metrics.ReasonTimeout
+			err = fmt.Errorf("节点间下载超时（%s）: %v", config.PullingTimeout, err)
+		}
+		metrics.P2PFetchFailedTotal.WithLabelValues(image, peer, reason).Inc()
+		return err
+	}
+	if err := verifyLoadedImagePlatform(ctx, LocalImageRef(ctx, image, configDigest), platform); err != nil {
+		log.Warn().Err(err).Str("image", image).Str("peer", peer).Msg("节点间加载的镜像平台校验失败")
+		metrics.P2PFetchFailedTotal.WithLabelValues(image, peer, metrics.ReasonPlatformMismatch).Inc()
 		return err
 	}
 	duration := time.Since(start).Seconds()
@@ -118,19 +337,34 @@ func tryDownloadFromPeer(peer, image string) error {
 	return nil
 }
 
-func pullImageFromRegistry(image string) error {
+// pullImageFromRegistry 回源拉取 platform 平台的镜像，单次拉取最长 PullingTimeout
+func pullImageFromRegistry(ctx context.Context, image, platform string) error {
+	ctx, cancel := context.WithTimeout(ctx, config.PullingTimeout)
+	defer cancel()
 	node := config.NodeName
-	log.Info().Str("image", image).Str("node", node).Msg("开始回源拉取镜像")
+	log.Info().Str("image", image).Str("platform", platform).Str("node", node).Msg("开始回源拉取镜像")
 	metrics.RegistryPullingGauge.WithLabelValues(image, node).Set(1)
 	timer := prometheus.NewTimer(metrics.RegistryPullDuration.WithLabelValues(image))
 	defer func() {
 		timer.ObserveDuration()
 		metrics.RegistryPullingGauge.WithLabelValues(image, node).Set(0)
 	}()
-	err := docker.Pull(image)
+	pullProgressTracker.Start(image)
+	err := docker.Pull(ctx, image, docker.PullOptions{
+		Progress: func(ev docker.PullProgress) { pullProgressTracker.Update(image, ev) },
+		Platform: platform,
+	})
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("回源拉取超时（%s）: %v", config.PullingTimeout, err)
+	}
+	pullProgressTracker.Finish(image, err)
 	if err != nil {
+		result := metrics.ResultFailed
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			result = metrics.ResultTimeout
+		}
 		log.Error().Err(err).Str("image", image).Str("node", node).Msg("回源拉取镜像失败")
-		metrics.RegistryPullTotal.WithLabelValues(image, metrics.ResultFailed).Inc()
+		metrics.RegistryPullTotal.WithLabelValues(image, result).Inc()
 	} else {
 		log.Info().Str("image", image).Str("node", node).Msg("回源拉取镜像成功")
 		metrics.RegistryPullTotal.WithLabelValues(image, metrics.ResultSuccess).Inc()
@@ -144,66 +378,179 @@ func InitK8sLock() error {
 		return fmt.Errorf("NODE_NAME 环境变量未设置，无法初始化K8s锁")
 	}
 
-	lock, err := config.NewK8sConfigMapLock(k8sNamespace, k8sCMName, k8sLockTimeout)
+	clientset, err := config.NewK8sClientset()
+	if err != nil {
+		return fmt.Errorf("初始化K8s客户端失败: %v", err)
+	}
+	nodeLabels = config.NewNodeLabels(clientset, k8sNodeName, nodeLabelsTTL)
+	name := k8sCMName
+	if config.K8sLockBackend == config.LockBackendLease {
+		name = config.K8sLockLeasePrefix
+	}
+	lock, err := config.NewLocker(config.K8sLockBackend, clientset, k8sNamespace, name, k8sLockTimeout, k8sLockMax)
 	if err != nil {
 		return fmt.Errorf("初始化K8s锁失败: %v", err)
 	}
 
 	k8sLock = lock
-	log.Info().Str("namespace", k8sNamespace).Str("configmap", k8sCMName).Dur("timeout", k8sLockTimeout).Str("node", k8sNodeName).Msg("K8s锁初始化成功")
+	log.Info().Str("backend", config.K8sLockBackend).Str("namespace", k8sNamespace).Str("name", name).Dur("timeout", k8sLockTimeout).Int("max_images", k8sLockMax).Str("node", k8sNodeName).Msg("K8s锁初始化成功")
 	return nil
 }
 
 // 修改预热流程，拉取前抢锁，拉取后释放
-func preheatImage(image string) error {
-	log.Debug().Str("image", image).Msg("进入预热主流程")
-	// P2P
-	if err := fetchImageFromPeers(image); err == nil {
+func preheatImage(ctx context.Context, image, platform string) (string, error) {
+	log.Debug().Str("image", image).Str("platform", platform).Msg("进入预热主流程")
+	// P2P：按 digest 固定的镜像由 peer 按名称或镜像 ID 提供
+	if err := fetchImageFromPeers(ctx, image, platform); err == nil {
 		metrics.ImagePreheatTotal.WithLabelValues(image, metrics.SourceP2P).Inc()
-		return nil
+		return metrics.SourceP2P, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
 	}
+	return pullImageWithLock(ctx, image, platform)
+}
+
+// pullImageWithLock 抢占回源锁后回源拉取；锁被其他节点持有时进入跟随模式。返回镜像来源（registry/peer_wait）
+func pullImageWithLock(ctx context.Context, image, platform string) (string, error) {
 	// 回源前分布式锁抢占
 	if k8sLock == nil || k8sNodeName == "" {
 		log.Warn().Str("image", image).Str("node", k8sNodeName).Bool("k8sLock", k8sLock != nil).Msg("K8s锁未配置，跳过镜像拉取")
-		return fmt.Errorf("K8s锁未正确配置，无法安全拉取镜像")
+		return "", fmt.Errorf("K8s锁未正确配置，无法安全拉取镜像")
 	}
-	acquired, err := k8sLock.TryAcquireLock(image, k8sNodeName)
-	if err != nil {
-		log.Error().Err(err).Msg("获取锁失败")
-		return err
-	}
-	if !acquired {
-		log.Info().Str("image", image).Msg("有其他节点正在拉取镜像，跳过本次拉取")
-		return nil
+	lockName := pullLockName(image, platform)
+	var token int64
+	for attempt := 0; ; attempt++ {
+		var acquired bool
+		var err error
+		token, acquired, err = k8sLock.TryAcquireLock(lockName, k8sNodeName, getMyPodIP())
+		if errors.Is(err, config.ErrLockCapacity) {
+			log.Info().Str("image", image).Msg("集群回源并发已满，等待下一轮重试")
+			return "", fmt.Errorf("未获取到回源锁: %w", err)
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("获取锁失败")
+			return "", err
+		}
+		if acquired {
+			break
+		}
+		holder, err := k8sLock.GetLockInfo(lockName)
+		if err != nil {
+			log.Error().Err(err).Str("image", image).Msg("获取锁信息失败")
+			return "", err
+		}
+		if holder != nil {
+			return metrics.SourcePeerWait, waitForPeer(ctx, image, platform, holder)
+		}
+		// 抢锁与查询之间持锁节点已释放锁，重新抢锁
+		if attempt >= 2 {
+			return "", fmt.Errorf("回源锁频繁易主，等待下一轮重试: %s", image)
+		}
 	}
+	log.Info().Str("image", image).Int64("token", token).Msg("获取回源锁成功")
+	trackHeldLock(lockName, token)
+	// 锁丢失时通过 ctx 中止正在进行的拉取
+	pullCtx, cancelPull := context.WithCancelCause(ctx)
+	defer cancelPull(nil)
 	// 启动心跳 goroutine
 	stopCh := make(chan struct{})
 	go func() {
 		ticker := time.NewTicker(k8sLockTimeout / 3)
 		defer ticker.Stop()
+		lastRefresh := time.Now()
 		for {
 			select {
 			case <-ticker.C:
-				_ = k8sLock.RefreshLock(image, k8sNodeName)
+				err := k8sLock.RefreshLock(lockName, k8sNodeName, token)
+				if err == nil {
+					lastRefresh = time.Now()
+					continue
+				}
+				if errors.Is(err, config.ErrLockLost) {
+					log.Error().Err(err).Str("image", image).Int64("token", token).Msg("回源锁已被抢占，中止拉取")
+					cancelPull(config.ErrLockLost)
+					return
+				}
+				log.Warn().Err(err).Str("image", image).Msg("回源锁续期失败")
+				if time.Since(lastRefresh) >= k8sLockTimeout {
+					log.Error().Str("image", image).Dur("since_last_refresh", time.Since(lastRefresh)).Msg("回源锁续期持续失败，锁可能已过期，中止拉取")
+					cancelPull(config.ErrLockLost)
+					return
+				}
 			case <-stopCh:
 				return
 			}
 		}
 	}()
-	defer close(stopCh)
-	defer k8sLock.ReleaseLock(image, k8sNodeName)
+	defer func() {
+		close(stopCh)
+		if err := k8sLock.ReleaseLock(lockName, k8sNodeName, token); err != nil {
+			log.Warn().Err(err).Str("image", image).Msg("释放回源锁失败")
+			return // 保留记录，退出时再次尝试释放
+		}
+		untrackHeldLock(lockName, token)
+	}()
 	// 回源拉取
-	err = pullImageFromRegistry(image)
+	err := pullImageFromRegistry(pullCtx, image, platform)
 	if err == nil {
 		metrics.ImagePreheatTotal.WithLabelValues(image, metrics.SourceRegistry).Inc()
-		return nil
+		return metrics.SourceRegistry, nil
+	}
+	if errors.Is(context.Cause(pullCtx), config.ErrLockLost) {
+		err = fmt.Errorf("回源锁丢失，拉取已中止: %v", err)
 	}
 	metrics.ImagePreheatFailedTotal.WithLabelValues(image, metrics.ResultFailed).Inc()
-	return err
+	return metrics.SourceRegistry, err
 }
 
-func getAllLocalImages() (map[string]struct{}, error) {
-	return docker.GetImages()
+// waitForPeer 其他节点持有该镜像回源锁时进入跟随模式：
+// 等待持锁节点拉取完成（锁释放），再通过节点间下载获取镜像
+func waitForPeer(ctx context.Context, image, platform string, holder *config.K8sLockInfo) error {
+	log.Info().Str("image", image).Str("holder", holder.Node).Str("addr", holder.Addr).Dur("timeout", config.WaitForPeerTimeout).Msg("其他节点正在回源拉取镜像，等待其完成")
+	start := time.Now()
+	waitCtx, cancel := context.WithTimeout(ctx, config.WaitForPeerTimeout)
+	defer cancel()
+
+	last, err := k8sLock.WaitForLockRelease(waitCtx, pullLockName(image, platform))
+	metrics.PeerWaitDuration.WithLabelValues(image).Observe(time.Since(start).Seconds())
+	if err != nil {
+		result := metrics.ResultFailed
+		if errors.Is(waitCtx.Err(), context.DeadlineExceeded) {
+			result = metrics.ResultTimeout
+		}
+		log.Warn().Err(err).Str("image", image).Str("holder", holder.Node).Str("result", result).Msg("等待持锁节点回源失败")
+		metrics.PeerWaitTotal.WithLabelValues(image, result).Inc()
+		metrics.ImagePreheatFailedTotal.WithLabelValues(image, metrics.SourcePeerWait).Inc()
+		return fmt.Errorf("等待节点 %s 回源镜像失败: %v", holder.Node, err)
+	}
+	if last != nil {
+		holder = last
+	}
+
+	// 优先从持锁节点获取，失败再尝试其他节点
+	err = fmt.Errorf("持锁节点地址未知")
+	if holder.Addr != "" {
+		err = tryDownloadFromPeer(ctx, holder.Addr, image, platform)
+	}
+	if err != nil && ctx.Err() == nil {
+		log.Warn().Err(err).Str("image", image).Str("holder", holder.Node).Msg("从持锁节点拉取失败，尝试其他节点")
+		err = fetchImageFromPeers(ctx, image, platform)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("image", image).Str("holder", holder.Node).Msg("等待结束后节点间拉取失败")
+		metrics.PeerWaitTotal.WithLabelValues(image, metrics.ResultFailed).Inc()
+		metrics.ImagePreheatFailedTotal.WithLabelValues(image, metrics.SourcePeerWait).Inc()
+		return err
+	}
+	log.Info().Str("image", image).Str("holder", holder.Node).Dur("duration", time.Since(start)).Msg("等待持锁节点回源后节点间拉取成功")
+	metrics.PeerWaitTotal.WithLabelValues(image, metrics.ResultSuccess).Inc()
+	metrics.ImagePreheatTotal.WithLabelValues(image, metrics.SourcePeerWait).Inc()
+	return nil
+}
+
+func getAllLocalImages(ctx context.Context) (map[string]struct{}, error) {
+	return docker.GetImages(ctx)
 }
 
 var maxConcurrentDownloadsAPI = config.DownloadAPIConcurrency
@@ -211,8 +558,8 @@ var downloadAPISemaphore = make(chan struct{}, maxConcurrentDownloadsAPI)
 
 func releaseDownloadAPISlot() { <-downloadAPISemaphore }
 
-func GetAllLocalImages() (map[string]struct{}, error) {
-	return getAllLocalImages()
+func GetAllLocalImages(ctx context.Context) (map[string]struct{}, error) {
+	return getAllLocalImages(ctx)
 }
 
 func FileExists(path string) bool {
@@ -233,9 +580,9 @@ func ReleaseDownloadAPISlot() {
 }
 
 // 流式下载镜像到 HTTP 响应
-func StreamImageToHTTP(image string, writer io.Writer) error {
+func StreamImageToHTTP(ctx context.Context, image string, writer io.Writer) error {
 	// 检查镜像是否存在
-	exists, err := docker.ImageExists(image)
+	exists, err := docker.ImageExists(ctx, image)
 	if err != nil {
 		return fmt.Errorf("获取本地镜像列表失败: %v", err)
 	}
@@ -244,7 +591,7 @@ func StreamImageToHTTP(image string, writer io.Writer) error {
 	}
 
 	// 执行 docker save 并流式输出
-	return docker.Save(image, writer)
+	return docker.Save(ctx, image, writer)
 }
 
 // GetCurrentDownloadCount 获取当前下载并发数
@@ -257,9 +604,25 @@ func GetMaxDownloadConcurrency() int {
 	return cap(downloadAPISemaphore)
 }
 
+var maxConcurrentLayersCheck = config.LayersCheckConcurrency
+var layersCheckSemaphore = make(chan struct{}, maxConcurrentLayersCheck)
+
+// AcquireLayersCheckSlotNonBlock 非阻塞获取层状态查询接口并发槽位
+func AcquireLayersCheckSlotNonBlock() bool {
+	select {
+	case layersCheckSemaphore <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// ReleaseLayersCheckSlot 释放层状态查询接口并发槽位
+func ReleaseLayersCheckSlot() { <-layersCheckSemaphore }
+
 // CheckLayersExist 批量检查层是否存在
-func CheckLayersExist(digests []string) (exists, missing []string, err error) {
-	return docker.CheckLayersExist(digests)
+func CheckLayersExist(ctx context.Context, digests []string) (exists, missing []string, err error) {
+	return docker.CheckLayersExist(ctx, digests)
 }
 
 // 初始化下载限速桶
@@ -275,10 +638,18 @@ func RateLimitedReader(r io.Reader) io.Reader {
 	return ratelimit.Reader(r, downloadRateLimitBucket)
 }
 
-// 流式下载镜像到 HTTP 响应（带限速）
-func StreamImageToHTTPWithRateLimit(image string, writer io.Writer) error {
+// 获取限速 writer
+func RateLimitedWriter(w io.Writer) io.Writer {
+	if downloadRateLimitBucket == nil {
+		return w
+	}
+	return ratelimit.Writer(w, downloadRateLimitBucket)
+}
+
+// 流式下载镜像到 HTTP 响应（带限速），ctx 取消（如客户端断开）时终止 docker save
+func StreamImageToHTTPWithRateLimit(ctx context.Context, image string, writer io.Writer) error {
 	log.Info().Str("image", image).Msg("收到流式镜像下载请求")
-	exists, err := docker.ImageExists(image)
+	exists, err := docker.ImageExists(ctx, image)
 	if err != nil {
 		log.Error().Err(err).Str("image", image).Msg("本地镜像校验失败")
 		return fmt.Errorf("获取本地镜像列表失败: %v", err)
@@ -288,17 +659,21 @@ func StreamImageToHTTPWithRateLimit(image string, writer io.Writer) error {
 		return fmt.Errorf("镜像不存在: %s", image)
 	}
 
+	// 写出失败时取消 ctx 并关闭管道读端，避免 docker save 阻塞在写管道上
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	pr, pw := io.Pipe()
 	go func() {
 		log.Debug().Str("image", image).Msg("开始 docker.Save 镜像流式输出")
-		defer pw.Close()
-		err := docker.Save(image, pw)
+		err := docker.Save(ctx, image, pw)
 		if err != nil {
 			log.Error().Err(err).Str("image", image).Msg("docker.Save 失败")
 		} else {
 			log.Debug().Str("image", image).Msg("docker.Save 完成")
 		}
+		pw.CloseWithError(err)
 	}()
+	defer pr.Close()
 
 	start := time.Now()
 	n, err := io.Copy(writer, RateLimitedReader(pr))
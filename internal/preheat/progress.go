@@ -0,0 +1,154 @@
+package preheat
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"image-preheat/internal/docker"
+	"image-preheat/internal/metrics"
+)
+
+// 已结束的拉取进度保留时间
+const pullProgressRetention = 10 * time.Minute
+
+// LayerPullProgress 单层拉取进度
+type LayerPullProgress struct {
+	Status     string `json:"status"`
+	Downloaded int64  `json:"downloaded"` // 已下载字节数
+	Total      int64  `json:"total"`      // 层大小（压缩后），未知时为 0
+}
+
+// ImagePullProgress 单个镜像的回源拉取进度
+type ImagePullProgress struct {
+	Image      string                        `json:"image"`
+	StartedAt  time.Time                     `json:"started_at"`
+	FinishedAt *time.Time                    `json:"finished_at,omitempty"`
+	Error      string                        `json:"error,omitempty"`
+	Downloaded int64                         `json:"downloaded"`
+	Total      int64                         `json:"total"`
+	Layers     map[string]*LayerPullProgress `json:"layers"`
+}
+
+// PullProgressTracker 记录各镜像回源拉取进度并累计字节/层指标
+type PullProgressTracker struct {
+	mu     sync.RWMutex
+	images map[string]*ImagePullProgress
+}
+
+// NewPullProgressTracker 创建拉取进度记录器
+func NewPullProgressTracker() *PullProgressTracker {
+	return &PullProgressTracker{images: make(map[string]*ImagePullProgress)}
+}
+
+// Start 开始记录镜像拉取，并清理过期的已结束记录
+func (t *PullProgressTracker) Start(image string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for name, p := range t.images {
+		if p.FinishedAt != nil && time.Since(*p.FinishedAt) > pullProgressRetention {
+			delete(t.images, name)
+		}
+	}
+	t.images[image] = &ImagePullProgress{
+		Image:     image,
+		StartedAt: time.Now(),
+		Layers:    make(map[string]*LayerPullProgress),
+	}
+}
+
+// Update 处理一条拉取进度事件
+func (t *PullProgressTracker) Update(image string, ev docker.PullProgress) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.images[image]
+	if !ok {
+		return
+	}
+	layer, ok := p.Layers[ev.Layer]
+	if !ok {
+		layer = &LayerPullProgress{}
+		p.Layers[ev.Layer] = layer
+	}
+	prevStatus := layer.Status
+	layer.Status = ev.Status
+
+	switch ev.Status {
+	case docker.PullStatusDownloading:
+		if ev.Total > 0 && layer.Total == 0 {
+			layer.Total = ev.Total
+			p.Total += ev.Total
+		}
+		if delta := ev.Current - layer.Downloaded; delta > 0 {
+			layer.Downloaded = ev.Current
+			p.Downloaded += delta
+			metrics.RegistryPullBytesTotal.WithLabelValues(image).Add(float64(delta))
+		}
+	case docker.PullStatusDownloadComplete:
+		// 最后一段进度可能未上报，按层大小补齐
+		if delta := layer.Total - layer.Downloaded; delta > 0 {
+			layer.Downloaded = layer.Total
+			p.Downloaded += delta
+			metrics.RegistryPullBytesTotal.WithLabelValues(image).Add(float64(delta))
+		}
+		if prevStatus != docker.PullStatusDownloadComplete {
+			metrics.RegistryPullLayersTotal.WithLabelValues(image).Inc()
+		}
+	}
+}
+
+// Finish 结束记录镜像拉取
+func (t *PullProgressTracker) Finish(image string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.images[image]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	p.FinishedAt = &now
+	if err != nil {
+		p.Error = err.Error()
+	}
+}
+
+// Get 获取指定镜像的拉取进度快照
+func (t *PullProgressTracker) Get(image string) (*ImagePullProgress, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	p, ok := t.images[image]
+	if !ok {
+		return nil, false
+	}
+	return p.copy(), true
+}
+
+// List 获取全部拉取进度快照，按开始时间排序
+func (t *PullProgressTracker) List() []*ImagePullProgress {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	result := make([]*ImagePullProgress, 0, len(t.images))
+	for _, p := range t.images {
+		result = append(result, p.copy())
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].StartedAt.Before(result[j].StartedAt) })
+	return result
+}
+
+func (p *ImagePullProgress) copy() *ImagePullProgress {
+	c := *p
+	c.Layers = make(map[string]*LayerPullProgress, len(p.Layers))
+	for id, l := range p.Layers {
+		layer := *l
+		c.Layers[id] = &layer
+	}
+	return &c
+}
+
+// 全局拉取进度记录器
+var pullProgressTracker = NewPullProgressTracker()
+
+// GetPullProgressTracker 获取全局拉取进度记录器
+func GetPullProgressTracker() *PullProgressTracker {
+	return pullProgressTracker
+}
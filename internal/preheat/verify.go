@@ -0,0 +1,567 @@
+package preheat
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"image-preheat/internal/config"
+	"image-preheat/internal/docker"
+
+	"github.com/rs/zerolog/log"
+)
+
+// 节点间传输的完整性校验：请求方将 peer 返回的归档流式转发给加载命令，同时计算每个文件的 sha256；
+// 决定镜像名的元数据（manifest.json、index.json）暂存到归档末尾，校验 config digest、层 diffID 与镜像名
+// 全部通过后才写出。校验失败时中止数据流，加载命令因归档不完整而失败，不会以请求的镜像名加载错误的内容。
+
+// ErrVerifyFailed 节点间传输的镜像归档未通过完整性校验
+var ErrVerifyFailed = errors.New("镜像完整性校验失败")
+
+// 暂存到内存用于解析的文件大小上限（元数据、config、OCI manifest）
+const maxVerifyBlobSize = 4 << 20
+
+// 期望 config digest 缓存有效期，同一镜像的多次节点间尝试只查询一次镜像仓库；查询失败不缓存
+const expectedConfigTTL = time.Minute
+
+var (
+	expectedConfigMu    sync.Mutex
+	expectedConfigCache = make(map[string]expectedConfig)
+)
+
+type expectedConfig struct {
+	digest  string
+	fetched time.Time
+}
+
+// expectedImageConfig 返回校验使用的期望 config digest：按 digest 固定的引用在各模式下都按 digest 解析
+// （结果常驻缓存，同时作为向 peer 请求的镜像 ID）；其他引用仅 digest 与 digest-fallback 模式从镜像仓库获取。
+// 无法获取时 digest 模式返回包装 ErrVerifyFailed 的错误（跳过节点间拉取），
+// 其他模式返回空、只校验归档自洽（digest-fallback 需显式开启，不能防御恶意 peer）
+func expectedImageConfig(ctx context.Context, image, platform string) (string, error) {
+	pinned := docker.IsDigestReference(image)
+	mode := config.P2PVerifyMode
+	if !pinned && mode != config.P2PVerifyDigest && mode != config.P2PVerifyDigestFallback {
+		return "", nil
+	}
+	var digest string
+	var err error
+	if pinned {
+		digest, err = pinnedImageID(ctx, image, platform)
+	} else {
+		digest, err = resolveExpectedConfig(ctx, image, platform)
+	}
+	if err == nil {
+		return digest, nil
+	}
+	switch mode {
+	case config.P2PVerifyDigest:
+		return "", fmt.Errorf("%w: 无法从镜像仓库获取期望的 config digest: %v", ErrVerifyFailed, err)
+	case config.P2PVerifyDigestFallback:
+		log.Warn().Err(err).Str("image", image).Msg("无法从镜像仓库获取期望的 config digest，节点间传输只校验归档自洽")
+	}
+	return "", nil
+}
+
+// resolveExpectedConfig 从镜像仓库获取 platform 平台的 config digest，成功结果缓存 expectedConfigTTL
+func resolveExpectedConfig(ctx context.Context, image, platform string) (string, error) {
+	key := image + "/" + platform
+	expectedConfigMu.Lock()
+	cached, ok := expectedConfigCache[key]
+	expectedConfigMu.Unlock()
+	if ok && time.Since(cached.fetched) < expectedConfigTTL {
+		return cached.digest, nil
+	}
+	digest, err := docker.ResolveImageConfig(ctx, image, platform)
+	if err != nil {
+		return "", err
+	}
+	expectedConfigMu.Lock()
+	expectedConfigCache[key] = expectedConfig{digest: digest, fetched: time.Now()}
+	expectedConfigMu.Unlock()
+	return digest, nil
+}
+
+// loadVerifiedImage 校验并加载 peer 返回的 platform 平台镜像归档。configDigest 为期望的 config digest，
+// 为空时只校验归档自洽；base 为请求时携带的层链，仅该层链覆盖的层允许缺失。校验失败时返回包装 ErrVerifyFailed 的错误
+func loadVerifiedImage(ctx context.Context, r io.Reader, image, platform, configDigest, base string) error {
+	if config.P2PVerifyMode == config.P2PVerifyOff {
+		return loadImageFromReader(ctx, r, platform)
+	}
+	pr, pw := io.Pipe()
+	verifyErr := make(chan error, 1)
+	go func() {
+		err := newImageTarVerifier(image, platform, configDigest, base).copy(r, pw)
+		pw.CloseWithError(err)
+		verifyErr <- err
+	}()
+	err := loadImageFromReader(ctx, pr, platform)
+	// 加载命令提前退出时解除校验 goroutine 的写阻塞
+	pr.CloseWithError(io.ErrClosedPipe)
+	if vErr := <-verifyErr; vErr != nil && (errors.Is(vErr, ErrVerifyFailed) || err == nil) {
+		return vErr
+	}
+	return err
+}
+
+// imageTarVerifier 校验 docker save / ctr export 归档
+type imageTarVerifier struct {
+	image    string
+	platform string
+	config   string
+	base     string
+
+	// 归档内文件路径 -> sha256 digest
+	hashes map[string]string
+	// gzip 压缩的 blob 路径 -> 解压后的 sha256 digest（即 diffID）
+	diffIDs map[string]string
+	// 链接路径 -> 目标路径（旧格式中重复的层以符号链接保存）
+	links map[string]string
+	// 小文件内容，用于解析 config 与 OCI manifest
+	contents map[string][]byte
+	// 暂存的元数据
+	metadata []heldEntry
+}
+
+type heldEntry struct {
+	hdr  *tar.Header
+	data []byte
+}
+
+// docker save 的 manifest.json 条目
+type tarManifestEntry struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// OCI index / manifest 中校验用到的字段
+type verifyDescriptor struct {
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+		Variant      string `json:"variant"`
+	} `json:"platform,omitempty"`
+}
+
+type verifyManifest struct {
+	Config    verifyDescriptor   `json:"config"`
+	Layers    []verifyDescriptor `json:"layers"`
+	Manifests []verifyDescriptor `json:"manifests"`
+}
+
+// 决定镜像名的 index.json 注解
+var imageNameAnnotations = []string{"io.containerd.image.name", "org.opencontainers.image.ref.name"}
+
+func newImageTarVerifier(image, platform, configDigest, base string) *imageTarVerifier {
+	return &imageTarVerifier{
+		image:    image,
+		platform: platform,
+		config:   configDigest,
+		base:     base,
+		hashes:   make(map[string]string),
+		diffIDs:  make(map[string]string),
+		links:    make(map[string]string),
+		contents: make(map[string][]byte),
+	}
+}
+
+// copy 将归档从 r 复制到 w，校验通过后在末尾写出元数据
+func (v *imageTarVerifier) copy(r io.Reader, w io.Writer) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(hdr.Name)
+		switch name {
+		case "manifest.json", "index.json":
+			if hdr.Typeflag != tar.TypeReg || hdr.Size > maxVerifyBlobSize || v.held(name) {
+				return fmt.Errorf("%w: 归档中的 %s 无效", ErrVerifyFailed, name)
+			}
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			v.metadata = append(v.metadata, heldEntry{hdr: hdr, data: data})
+			continue
+		case "repositories":
+			// 仅旧格式在缺少 manifest.json 时使用，不转发
+			continue
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			h := sha256.New()
+			dst := io.MultiWriter(tw, h)
+			var buf *bytes.Buffer
+			if hdr.Size <= maxVerifyBlobSize {
+				buf = &bytes.Buffer{}
+				dst = io.MultiWriter(dst, buf)
+			}
+			var gz *gzipDigester
+			if strings.HasPrefix(name, "blobs/sha256/") {
+				gz = &gzipDigester{}
+				dst = io.MultiWriter(dst, gz)
+			}
+			if _, err := io.Copy(dst, tr); err != nil {
+				if gz != nil {
+					gz.sum()
+				}
+				return err
+			}
+			v.hashes[name] = "sha256:" + hex.EncodeToString(h.Sum(nil))
+			if buf != nil {
+				v.contents[name] = buf.Bytes()
+			}
+			if gz != nil {
+				if diffID, ok := gz.sum(); ok {
+					v.diffIDs[name] = diffID
+				}
+			}
+		case tar.TypeSymlink:
+			v.links[name] = path.Join(path.Dir(name), hdr.Linkname)
+		case tar.TypeLink:
+			v.links[name] = path.Clean(hdr.Linkname)
+		}
+	}
+	if err := v.verify(); err != nil {
+		return err
+	}
+	for _, e := range v.metadata {
+		if err := tw.WriteHeader(e.hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(e.data); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func (v *imageTarVerifier) held(name string) bool {
+	for _, e := range v.metadata {
+		if path.Clean(e.hdr.Name) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve 解析链接（最多 8 层）
+func (v *imageTarVerifier) resolve(name string) string {
+	name = path.Clean(name)
+	for i := 0; i < 8; i++ {
+		target, ok := v.links[name]
+		if !ok {
+			break
+		}
+		name = target
+	}
+	return name
+}
+
+func (v *imageTarVerifier) hash(name string) (string, bool) {
+	digest, ok := v.hashes[v.resolve(name)]
+	return digest, ok
+}
+
+func (v *imageTarVerifier) content(name string) ([]byte, bool) {
+	data, ok := v.contents[v.resolve(name)]
+	return data, ok
+}
+
+// verify 校验内容寻址的 blob、manifest.json 与 index.json
+func (v *imageTarVerifier) verify() error {
+	// blobs/sha256/<hex> 的内容必须与文件名一致
+	for name, digest := range v.hashes {
+		if hexDigest, ok := strings.CutPrefix(name, "blobs/sha256/"); ok && digest != "sha256:"+hexDigest {
+			return fmt.Errorf("%w: %s 内容与文件名不一致", ErrVerifyFailed, name)
+		}
+	}
+	var manifestJSON, indexJSON []byte
+	for _, e := range v.metadata {
+		if path.Clean(e.hdr.Name) == "manifest.json" {
+			manifestJSON = e.data
+		} else {
+			indexJSON = e.data
+		}
+	}
+	if manifestJSON == nil && indexJSON == nil {
+		return fmt.Errorf("%w: 归档缺少 manifest.json 与 index.json（数据流可能被截断）", ErrVerifyFailed)
+	}
+	configs := make(map[string]bool)
+	if v.config != "" {
+		configs[v.config] = true
+	}
+	if manifestJSON != nil {
+		if err := v.verifyManifestJSON(manifestJSON, configs); err != nil {
+			return err
+		}
+	}
+	if indexJSON != nil {
+		if err := v.verifyIndexJSON(indexJSON, configs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyManifestJSON 校验 docker save 格式的 manifest.json：镜像名必须是请求的镜像，config 与期望一致，
+// 每一层为 config 中对应 diffID 的未压缩层，或内容寻址的 blob 且属于引用该 config 的 OCI manifest。
+// 自洽校验模式下校验通过的 config 加入 configs，供 index.json 校验使用
+func (v *imageTarVerifier) verifyManifestJSON(data []byte, configs map[string]bool) error {
+	var entries []tarManifestEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("%w: 解析 manifest.json 失败: %v", ErrVerifyFailed, err)
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("%w: manifest.json 为空", ErrVerifyFailed)
+	}
+	for _, entry := range entries {
+		for _, tag := range entry.RepoTags {
+			if !v.isRequestedImage(tag) {
+				return fmt.Errorf("%w: 归档包含其他镜像名 %s", ErrVerifyFailed, tag)
+			}
+		}
+		configDigest, ok := v.hash(entry.Config)
+		if !ok {
+			return fmt.Errorf("%w: 归档缺少镜像 config %s", ErrVerifyFailed, entry.Config)
+		}
+		if v.config != "" && configDigest != v.config {
+			return fmt.Errorf("%w: config digest 为 %s，期望 %s", ErrVerifyFailed, configDigest, v.config)
+		}
+		// 旧格式 config 文件名为 <hex>.json
+		if hexDigest, ok := strings.CutSuffix(path.Base(v.resolve(entry.Config)), ".json"); ok && configDigest != "sha256:"+hexDigest {
+			return fmt.Errorf("%w: config %s 内容与文件名不一致", ErrVerifyFailed, entry.Config)
+		}
+		if err := v.verifyLayers(entry, configDigest); err != nil {
+			return err
+		}
+		if v.config == "" {
+			configs[configDigest] = true
+		}
+	}
+	return nil
+}
+
+// verifyLayers 校验层文件与 config 中的 rootfs.diff_ids 一致，仅 base 层链覆盖的层允许缺失
+func (v *imageTarVerifier) verifyLayers(entry tarManifestEntry, configDigest string) error {
+	data, ok := v.content(entry.Config)
+	if !ok {
+		return fmt.Errorf("%w: 镜像 config 超过大小上限", ErrVerifyFailed)
+	}
+	var cfg struct {
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("%w: 解析镜像 config 失败: %v", ErrVerifyFailed, err)
+	}
+	diffIDs := cfg.RootFS.DiffIDs
+	if len(entry.Layers) != len(diffIDs) {
+		return fmt.Errorf("%w: 层数 %d 与 config 中的 diffID 数 %d 不一致", ErrVerifyFailed, len(entry.Layers), len(diffIDs))
+	}
+	absent := 0
+	if v.base != "" {
+		for i, chainID := range docker.ChainIDs(diffIDs) {
+			if chainID == v.base {
+				absent = i + 1
+				break
+			}
+		}
+	}
+	blobLayers := v.manifestLayers(configDigest)
+	for i, layer := range entry.Layers {
+		digest, ok := v.hash(layer)
+		if !ok {
+			if i < absent {
+				continue
+			}
+			return fmt.Errorf("%w: 归档缺少层 %s", ErrVerifyFailed, layer)
+		}
+		if digest == diffIDs[i] {
+			continue
+		}
+		// ctr export 的层为压缩 blob，已按内容寻址校验，需属于引用该 config 的 manifest，且解压后与 diffID 一致
+		if i < len(blobLayers) && blobLayers[i] == digest {
+			if v.diffIDs[v.resolve(layer)] == diffIDs[i] {
+				continue
+			}
+			return fmt.Errorf("%w: 层 %s 解压后的 digest 与 diffID %s 不一致（或不是 gzip 压缩）", ErrVerifyFailed, layer, diffIDs[i])
+		}
+		return fmt.Errorf("%w: 层 %s 的 digest 为 %s，与 diffID %s 不一致", ErrVerifyFailed, layer, digest, diffIDs[i])
+	}
+	return nil
+}
+
+// manifestLayers 返回归档中引用 configDigest 的 OCI manifest 的层 digest 列表
+func (v *imageTarVerifier) manifestLayers(configDigest string) []string {
+	for name, data := range v.contents {
+		if !strings.HasPrefix(name, "blobs/sha256/") {
+			continue
+		}
+		var m verifyManifest
+		if json.Unmarshal(data, &m) != nil || m.Config.Digest != configDigest {
+			continue
+		}
+		layers := make([]string, 0, len(m.Layers))
+		for _, l := range m.Layers {
+			layers = append(layers, l.Digest)
+		}
+		return layers
+	}
+	return nil
+}
+
+// verifyIndexJSON 校验 OCI index.json：镜像名注解必须是请求的镜像，指向的 manifest 或 index 在归档中，
+// 且其中与目标平台一致的 manifest 引用期望的 config（configs 为空时不限制）
+func (v *imageTarVerifier) verifyIndexJSON(data []byte, configs map[string]bool) error {
+	var index verifyManifest
+	if err := json.Unmarshal(data, &index); err != nil {
+		return fmt.Errorf("%w: 解析 index.json 失败: %v", ErrVerifyFailed, err)
+	}
+	for _, d := range index.Manifests {
+		for _, key := range imageNameAnnotations {
+			if name := d.Annotations[key]; name != "" && !v.isRequestedImage(name) {
+				return fmt.Errorf("%w: 归档包含其他镜像名 %s", ErrVerifyFailed, name)
+			}
+		}
+		if err := v.verifyDescriptor(d.Digest, configs, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyDescriptor 校验 index.json 中的描述符：manifest 需引用期望的 config；
+// index 中与目标平台一致且在归档中的 manifest 都需校验，且至少有一个
+func (v *imageTarVerifier) verifyDescriptor(digest string, configs map[string]bool, top bool) error {
+	hexDigest, _ := strings.CutPrefix(digest, "sha256:")
+	data, ok := v.contents["blobs/sha256/"+hexDigest]
+	if !ok {
+		return fmt.Errorf("%w: 归档缺少 manifest %s", ErrVerifyFailed, digest)
+	}
+	var m verifyManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("%w: 解析 manifest %s 失败: %v", ErrVerifyFailed, digest, err)
+	}
+	if len(m.Manifests) == 0 {
+		if len(configs) > 0 && !configs[m.Config.Digest] {
+			return fmt.Errorf("%w: manifest %s 的 config 为 %s，与期望不一致", ErrVerifyFailed, digest, m.Config.Digest)
+		}
+		return nil
+	}
+	if !top {
+		return fmt.Errorf("%w: 不支持嵌套的 index %s", ErrVerifyFailed, digest)
+	}
+	found := 0
+	for _, d := range m.Manifests {
+		if d.Platform != nil && !config.PlatformMatches(d.Platform.OS+"/"+d.Platform.Architecture+"/"+d.Platform.Variant, v.platform) {
+			continue
+		}
+		hexDigest, _ := strings.CutPrefix(d.Digest, "sha256:")
+		if _, ok := v.contents["blobs/sha256/"+hexDigest]; !ok {
+			continue // 导出时未包含
+		}
+		if err := v.verifyDescriptor(d.Digest, configs, false); err != nil {
+			return err
+		}
+		found++
+	}
+	if found == 0 {
+		return fmt.Errorf("%w: index %s 中 %s 平台的 manifest 均不在归档中", ErrVerifyFailed, digest, v.platform)
+	}
+	return nil
+}
+
+// gzipDigester 计算写入内容 gzip 解压后的 sha256；内容不是 gzip 时不计算。
+// 解压在独立 goroutine 中进行，写入不返回错误，解压失败时 sum 返回 false
+type gzipDigester struct {
+	head []byte
+	pw   *io.PipeWriter
+	done chan string
+	// 已根据开头的魔数判断是否为 gzip
+	decided bool
+}
+
+func (g *gzipDigester) Write(p []byte) (int, error) {
+	n := len(p)
+	if !g.decided {
+		g.head = append(g.head, p...)
+		if len(g.head) < 2 {
+			return n, nil
+		}
+		g.decided = true
+		if g.head[0] != 0x1f || g.head[1] != 0x8b {
+			g.head = nil
+			return n, nil
+		}
+		p, g.head = g.head, nil
+		pr, pw := io.Pipe()
+		g.pw, g.done = pw, make(chan string, 1)
+		go func() {
+			defer pr.Close()
+			zr, err := gzip.NewReader(pr)
+			if err != nil {
+				g.done <- ""
+				return
+			}
+			h := sha256.New()
+			if _, err := io.Copy(h, zr); err != nil {
+				g.done <- ""
+				return
+			}
+			g.done <- "sha256:" + hex.EncodeToString(h.Sum(nil))
+		}()
+	}
+	if g.pw != nil {
+		// 解压 goroutine 提前结束时写入返回 ErrClosedPipe，忽略
+		g.pw.Write(p)
+	}
+	return n, nil
+}
+
+// sum 结束写入并返回解压后的 digest，内容不是 gzip 或解压失败时返回 false
+func (g *gzipDigester) sum() (string, bool) {
+	if g.pw == nil {
+		return "", false
+	}
+	g.pw.Close()
+	digest := <-g.done
+	g.pw = nil
+	return digest, digest != ""
+}
+
+// isRequestedImage 判断归档中的镜像名是否为请求的镜像；OCI ref.name 注解可能只是 tag
+func (v *imageTarVerifier) isRequestedImage(name string) bool {
+	want, err := docker.ParseReference(v.image)
+	if err != nil {
+		return false
+	}
+	if name == want.Tag {
+		return true
+	}
+	return docker.NormalizeRef(name) == want.String()
+}
@@ -0,0 +1,332 @@
+package preheat
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"image-preheat/internal/config"
+)
+
+const verifyTestImage = "nginx:1.25"
+
+type tarFile struct {
+	name string
+	data []byte
+}
+
+func buildTar(t *testing.T, files []tarFile) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.data)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func mustJSON(t *testing.T, v any) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// archiveSpec 描述测试归档，零值为两层的正常镜像
+type archiveSpec struct {
+	// manifest.json 的 RepoTags 与 index.json 的镜像名注解，为空时使用 verifyTestImage
+	repoTag string
+	// 覆盖 config 中的 diffID
+	diffIDs []string
+	// 不写入归档的层下标
+	omit map[int]bool
+	// 计算 digest 后篡改内容的层下标
+	tamper map[int]bool
+	// 只保留前 n 个条目（模拟截断的数据流），<=0 表示不截断
+	keep int
+}
+
+var verifyTestLayers = [][]byte{[]byte("layer-one"), []byte("layer-two")}
+
+func testDiffIDs() []string {
+	ids := make([]string, len(verifyTestLayers))
+	for i, l := range verifyTestLayers {
+		ids[i] = "sha256:" + sha256Hex(l)
+	}
+	return ids
+}
+
+func (s archiveSpec) tag() string {
+	if s.repoTag != "" {
+		return s.repoTag
+	}
+	return verifyTestImage
+}
+
+func (s archiveSpec) configBlob(t *testing.T) []byte {
+	diffIDs := s.diffIDs
+	if diffIDs == nil {
+		diffIDs = testDiffIDs()
+	}
+	return mustJSON(t, map[string]any{
+		"architecture": "amd64",
+		"os":           "linux",
+		"rootfs":       map[string]any{"type": "layers", "diff_ids": diffIDs},
+	})
+}
+
+func (s archiveSpec) finish(t *testing.T, files []tarFile) []byte {
+	if s.keep > 0 && s.keep < len(files) {
+		files = files[:s.keep]
+	}
+	return buildTar(t, files)
+}
+
+// legacyArchive 构造 docker save 格式的归档（<id>/layer.tar 与 <hex>.json），返回归档与 config digest
+func legacyArchive(t *testing.T, s archiveSpec) ([]byte, string) {
+	t.Helper()
+	cfg := s.configBlob(t)
+	cfgName := sha256Hex(cfg) + ".json"
+	files := []tarFile{{name: cfgName, data: cfg}}
+	var layers []string
+	for i, l := range verifyTestLayers {
+		name := fmt.Sprintf("layer%d/layer.tar", i)
+		layers = append(layers, name)
+		if s.omit[i] {
+			continue
+		}
+		if s.tamper[i] {
+			l = append([]byte("evil-"), l...)
+		}
+		files = append(files, tarFile{name: name, data: l})
+	}
+	manifest := mustJSON(t, []tarManifestEntry{{Config: cfgName, RepoTags: []string{s.tag()}, Layers: layers}})
+	files = append(files, tarFile{name: "manifest.json", data: manifest})
+	return s.finish(t, files), "sha256:" + sha256Hex(cfg)
+}
+
+// ociArchive 构造 ctr export 格式的归档（index.json、blobs/sha256 与兼容的 manifest.json），层为压缩 blob
+func ociArchive(t *testing.T, s archiveSpec) ([]byte, string) {
+	t.Helper()
+	cfg := s.configBlob(t)
+	cfgDigest := sha256Hex(cfg)
+	files := []tarFile{{name: "blobs/sha256/" + cfgDigest, data: cfg}}
+	var layers []string
+	var descs []map[string]string
+	for i, l := range verifyTestLayers {
+		blob := gzipBytes(t, l)
+		digest := sha256Hex(blob)
+		name := "blobs/sha256/" + digest
+		layers = append(layers, name)
+		descs = append(descs, map[string]string{"digest": "sha256:" + digest})
+		if s.omit[i] {
+			continue
+		}
+		if s.tamper[i] {
+			blob = append([]byte("evil-"), blob...)
+		}
+		files = append(files, tarFile{name: name, data: blob})
+	}
+	manifest := mustJSON(t, map[string]any{
+		"schemaVersion": 2,
+		"config":        map[string]string{"digest": "sha256:" + cfgDigest},
+		"layers":        descs,
+	})
+	manifestDigest := sha256Hex(manifest)
+	files = append(files, tarFile{name: "blobs/sha256/" + manifestDigest, data: manifest})
+	index := mustJSON(t, map[string]any{
+		"schemaVersion": 2,
+		"manifests": []map[string]any{{
+			"digest":      "sha256:" + manifestDigest,
+			"annotations": map[string]string{"io.containerd.image.name": "docker.io/library/" + s.tag()},
+		}},
+	})
+	files = append(files,
+		tarFile{name: "index.json", data: index},
+		tarFile{name: "manifest.json", data: mustJSON(t, []tarManifestEntry{{Config: "blobs/sha256/" + cfgDigest, RepoTags: []string{s.tag()}, Layers: layers}})},
+	)
+	return s.finish(t, files), "sha256:" + cfgDigest
+}
+
+// runVerifier 校验归档，返回错误与写出的条目名
+func runVerifier(archive []byte, configDigest, base string) ([]string, error) {
+	var out bytes.Buffer
+	err := newImageTarVerifier(verifyTestImage, "linux/amd64", configDigest, base).copy(bytes.NewReader(archive), &out)
+	var names []string
+	tr := tar.NewReader(&out)
+	for {
+		hdr, rerr := tr.Next()
+		if rerr != nil {
+			break
+		}
+		names = append(names, hdr.Name)
+	}
+	return names, err
+}
+
+func TestImageTarVerifier(t *testing.T) {
+	layouts := []struct {
+		name  string
+		build func(*testing.T, archiveSpec) ([]byte, string)
+	}{
+		{"legacy", legacyArchive},
+		{"oci", ociArchive},
+	}
+	firstLayer := testDiffIDs()[0]
+	cases := []struct {
+		name string
+		spec archiveSpec
+		// 期望的 config digest：expected 使用归档的真实 config，other 使用其他 digest，empty 不限制
+		config string
+		base   string
+		ok     bool
+	}{
+		{name: "valid", config: "expected", ok: true},
+		{name: "valid consistency only", config: "empty", ok: true},
+		{name: "tampered layer", spec: archiveSpec{tamper: map[int]bool{1: true}}, config: "expected"},
+		{name: "tampered layer consistency only", spec: archiveSpec{tamper: map[int]bool{0: true}}, config: "empty"},
+		{name: "config digest mismatch", config: "other"},
+		{name: "wrong diffIDs with expected config", spec: archiveSpec{diffIDs: []string{firstLayer, "sha256:" + strings.Repeat("0", 64)}}, config: "expected"},
+		{name: "wrong diffIDs", spec: archiveSpec{diffIDs: []string{firstLayer, "sha256:" + strings.Repeat("0", 64)}}, config: "empty"},
+		{name: "foreign repo tag", spec: archiveSpec{repoTag: "evil:latest"}, config: "expected"},
+		{name: "missing layer", spec: archiveSpec{omit: map[int]bool{1: true}}, config: "expected"},
+		{name: "missing layer outside base", spec: archiveSpec{omit: map[int]bool{1: true}}, config: "expected", base: firstLayer},
+		{name: "missing layer covered by base", spec: archiveSpec{omit: map[int]bool{0: true}}, config: "expected", base: firstLayer, ok: true},
+		{name: "truncated stream", spec: archiveSpec{keep: 2}, config: "expected"},
+	}
+	for _, layout := range layouts {
+		for _, tc := range cases {
+			t.Run(layout.name+"/"+tc.name, func(t *testing.T) {
+				archive, cfgDigest := layout.build(t, tc.spec)
+				expected := ""
+				switch tc.config {
+				case "expected":
+					expected = cfgDigest
+				case "other":
+					expected = "sha256:" + strings.Repeat("f", 64)
+				}
+				names, err := runVerifier(archive, expected, tc.base)
+				if tc.ok {
+					if err != nil {
+						t.Fatalf("校验应通过: %v", err)
+					}
+					return
+				}
+				if !errors.Is(err, ErrVerifyFailed) {
+					t.Fatalf("期望 ErrVerifyFailed，实际 %v", err)
+				}
+				for _, name := range names {
+					if name == "manifest.json" || name == "index.json" {
+						t.Fatalf("校验失败时不应写出 %s", name)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestImageTarVerifierTruncatedMidEntry(t *testing.T) {
+	archive, cfgDigest := legacyArchive(t, archiveSpec{})
+	// 截断在层文件中间：tar 读取出错，元数据不写出
+	names, err := runVerifier(archive[:1024+200], cfgDigest, "")
+	if err == nil {
+		t.Fatal("截断的数据流应校验失败")
+	}
+	for _, name := range names {
+		if name == "manifest.json" {
+			t.Fatal("截断时不应写出 manifest.json")
+		}
+	}
+}
+
+func TestImageTarVerifierHoldsMetadataUntilEnd(t *testing.T) {
+	archive, cfgDigest := legacyArchive(t, archiveSpec{})
+	// 将 manifest.json 放到最前面，写出时仍应在末尾
+	tr := tar.NewReader(bytes.NewReader(archive))
+	var files []tarFile
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(tr)
+		f := tarFile{name: hdr.Name, data: data}
+		if hdr.Name == "manifest.json" {
+			files = append([]tarFile{f}, files...)
+		} else {
+			files = append(files, f)
+		}
+	}
+	names, err := runVerifier(buildTar(t, files), cfgDigest, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names[len(names)-1] != "manifest.json" {
+		t.Fatalf("manifest.json 应在末尾写出，实际顺序 %v", names)
+	}
+}
+
+func TestExpectedImageConfigFailsClosed(t *testing.T) {
+	mode := config.P2PVerifyMode
+	t.Cleanup(func() { config.P2PVerifyMode = mode })
+	// 本地未监听的端口，连接立即被拒绝
+	image := "127.0.0.1:1/library/nginx:1.25"
+
+	config.P2PVerifyMode = config.P2PVerifyDigest
+	if _, err := expectedImageConfig(context.Background(), image, "linux/amd64"); !errors.Is(err, ErrVerifyFailed) {
+		t.Fatalf("digest 模式无法访问镜像仓库时应返回 ErrVerifyFailed，实际 %v", err)
+	}
+
+	config.P2PVerifyMode = config.P2PVerifyDigestFallback
+	digest, err := expectedImageConfig(context.Background(), image, "linux/amd64")
+	if err != nil || digest != "" {
+		t.Fatalf("digest-fallback 模式应退化为只校验归档自洽，实际 %q, %v", digest, err)
+	}
+
+	expectedConfigMu.Lock()
+	_, cached := expectedConfigCache[image+"/linux/amd64"]
+	expectedConfigMu.Unlock()
+	if cached {
+		t.Fatal("查询失败不应缓存")
+	}
+}
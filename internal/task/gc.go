@@ -0,0 +1,242 @@
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"image-preheat/internal/config"
+	"image-preheat/internal/docker"
+	"image-preheat/internal/preheat"
+
+	"github.com/rs/zerolog/log"
+)
+
+// 回收状态文件名（位于 MOUNT_DIR 下）
+const gcStateFile = "preheat-gc.json"
+
+// 回收候选状态
+const (
+	GCStatusGrace       = "grace"        // 仍在宽限期内
+	GCStatusInUse       = "in_use"       // 被容器引用，暂不删除
+	GCStatusWouldRemove = "would_remove" // dry-run：到期后将删除
+	GCStatusRemoved     = "removed"
+	GCStatusFailed      = "failed"
+)
+
+// GCCandidate 回收候选镜像
+type GCCandidate struct {
+	Image         string    `json:"image"`
+	Status        string    `json:"status"`
+	UnlistedSince time.Time `json:"unlisted_since"`
+	EligibleAt    time.Time `json:"eligible_at"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// GCReport 一轮回收的结果
+type GCReport struct {
+	GeneratedAt time.Time     `json:"generated_at"`
+	DryRun      bool          `json:"dry_run"`
+	GracePeriod string        `json:"grace_period"`
+	Candidates  []GCCandidate `json:"candidates"`
+}
+
+// gcState 持久化到磁盘的回收状态
+type gcState struct {
+	// 由镜像列表预热拉取到本节点的镜像 -> 拉取完成时间
+	Preheated map[string]time.Time `json:"preheated"`
+	// 已从镜像列表移除的镜像 -> 首次发现移除的时间
+	Unlisted map[string]time.Time `json:"unlisted"`
+}
+
+// GarbageCollector 回收由本服务按镜像列表拉取、但已从列表移除且不再被容器使用的镜像。
+// 本地原本就存在的镜像及按需预热（API、PreheatJob）拉取的镜像不在回收范围内
+type GarbageCollector struct {
+	mu     sync.Mutex
+	path   string
+	state  gcState
+	report *GCReport
+}
+
+func NewGarbageCollector(path string) *GarbageCollector {
+	return &GarbageCollector{
+		path:  path,
+		state: gcState{Preheated: make(map[string]time.Time), Unlisted: make(map[string]time.Time)},
+	}
+}
+
+// Load 从状态文件恢复，文件不存在时为空
+func (g *GarbageCollector) Load() error {
+	data, err := os.ReadFile(g.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state gcState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for image, t := range state.Preheated {
+		g.state.Preheated[image] = t
+	}
+	for image, t := range state.Unlisted {
+		g.state.Unlisted[image] = t
+	}
+	return nil
+}
+
+// Track 记录由镜像列表预热拉取的镜像
+func (g *GarbageCollector) Track(image string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.state.Preheated[image]; ok {
+		return
+	}
+	g.state.Preheated[image] = time.Now()
+	delete(g.state.Unlisted, image)
+	g.save()
+}
+
+// Report 返回最近一轮回收的结果，尚未执行过时返回 nil
+func (g *GarbageCollector) Report() *GCReport {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.report
+}
+
+// Reconcile 对比镜像列表与本地镜像：已移除且超过宽限期、未被容器引用的镜像被删除（dry-run 时只记录）
+func (g *GarbageCollector) Reconcile(ctx context.Context, listed map[string]bool, localImages map[string]struct{}) {
+	now := time.Now()
+	g.mu.Lock()
+	var due []string
+	for image := range g.state.Preheated {
+		if listed[image] {
+			delete(g.state.Unlisted, image)
+			continue
+		}
+		if !preheat.HasLocalImage(ctx, localImages, image, "") {
+			// 已被其他方式删除
+			log.Info().Str("image", image).Msg("已移除的预热镜像不在本地，停止跟踪")
+			g.forget(image)
+			continue
+		}
+		if _, ok := g.state.Unlisted[image]; !ok {
+			log.Info().Str("image", image).Dur("grace_period", config.GCGracePeriod).Msg("预热镜像已从列表移除，宽限期后回收")
+			g.state.Unlisted[image] = now
+		}
+		due = append(due, image)
+	}
+	g.save()
+	g.mu.Unlock()
+	sort.Strings(due)
+
+	report := &GCReport{GeneratedAt: now, DryRun: config.GCDryRun, GracePeriod: config.GCGracePeriod.String()}
+	var inUse map[string]struct{}
+	for _, image := range due {
+		g.mu.Lock()
+		since := g.state.Unlisted[image]
+		g.mu.Unlock()
+		candidate := GCCandidate{Image: image, UnlistedSince: since, EligibleAt: since.Add(config.GCGracePeriod)}
+		if now.Before(candidate.EligibleAt) {
+			candidate.Status = GCStatusGrace
+			report.Candidates = append(report.Candidates, candidate)
+			continue
+		}
+		if inUse == nil {
+			var err error
+			if inUse, err = docker.GetImagesInUse(ctx); err != nil {
+				log.Error().Err(err).Msg("获取容器使用的镜像失败，跳过本轮回收")
+				return
+			}
+		}
+		// 节点间加载的 digest 固定镜像只能按镜像 ID 查找与删除
+		local := preheat.ResolveLocalImage(ctx, image, "")
+		id, err := docker.GetImageID(ctx, local)
+		if err != nil {
+			candidate.Status = GCStatusFailed
+			candidate.Error = err.Error()
+			log.Error().Err(err).Str("image", image).Msg("获取镜像 ID 失败，跳过回收")
+			report.Candidates = append(report.Candidates, candidate)
+			continue
+		}
+		switch {
+		case isImageInUse(id, inUse):
+			candidate.Status = GCStatusInUse
+		case config.GCDryRun:
+			candidate.Status = GCStatusWouldRemove
+			log.Info().Str("image", image).Msg("[dry-run] 将回收已移除的预热镜像")
+		default:
+			if err := docker.RemoveImage(ctx, local); err != nil {
+				candidate.Status = GCStatusFailed
+				candidate.Error = err.Error()
+				log.Error().Err(err).Str("image", image).Msg("回收镜像失败")
+				break
+			}
+			candidate.Status = GCStatusRemoved
+			log.Info().Str("image", image).Msg("已回收从列表移除的预热镜像")
+			g.mu.Lock()
+			g.forget(image)
+			g.save()
+			g.mu.Unlock()
+		}
+		report.Candidates = append(report.Candidates, candidate)
+	}
+
+	g.mu.Lock()
+	g.report = report
+	g.mu.Unlock()
+}
+
+// forget 停止跟踪镜像并移除其 digest 记录，调用方需持有锁
+func (g *GarbageCollector) forget(image string) {
+	delete(g.state.Preheated, image)
+	delete(g.state.Unlisted, image)
+	preheat.GetPreheatedDigestManager().RemoveImage(image)
+}
+
+// save 将回收状态写入文件（先写临时文件再重命名），调用方需持有锁
+func (g *GarbageCollector) save() {
+	if g.path == "" {
+		return
+	}
+	data, err := json.Marshal(g.state)
+	if err != nil {
+		log.Error().Err(err).Msg("序列化回收状态失败")
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(g.path), 0755); err != nil {
+		log.Warn().Err(err).Str("path", g.path).Msg("创建回收状态目录失败")
+		return
+	}
+	tmp := g.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		log.Warn().Err(err).Str("path", tmp).Msg("写入回收状态失败")
+		return
+	}
+	if err := os.Rename(tmp, g.path); err != nil {
+		log.Warn().Err(err).Str("path", g.path).Msg("保存回收状态失败")
+	}
+}
+
+// isImageInUse 按镜像 ID 判断镜像是否被容器使用：容器可能通过其他名称、digest 或 ID 引用同一镜像
+func isImageInUse(id string, inUse map[string]struct{}) bool {
+	_, ok := inUse[id]
+	return ok
+}
+
+// 全局镜像回收器
+var garbageCollector = NewGarbageCollector(filepath.Join(config.MountDir, gcStateFile))
+
+// GetGarbageCollector 获取全局镜像回收器
+func GetGarbageCollector() *GarbageCollector {
+	return garbageCollector
+}
@@ -0,0 +1,264 @@
+package task
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"image-preheat/internal/config"
+	"image-preheat/internal/preheat"
+
+	"github.com/rs/zerolog/log"
+)
+
+// 已结束的按需预热任务保留时间
+const jobRetention = time.Hour
+
+// 最多保留的按需预热任务数，超出时先淘汰最早结束的任务
+const maxJobs = 1000
+
+var (
+	// ErrTooManyJobs 进行中的按需预热任务数达到上限
+	ErrTooManyJobs = errors.New("进行中的按需预热任务过多")
+	// ErrQueueNotReady 预热队列尚未启动
+	ErrQueueNotReady = errors.New("预热队列尚未启动")
+)
+
+// 按需预热任务状态
+const (
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// Job 按需预热任务（POST /images/preheat 创建）
+type Job struct {
+	ID         string      `json:"id"`
+	Phase      string      `json:"phase"`
+	CreatedAt  time.Time   `json:"created_at"`
+	FinishedAt *time.Time  `json:"finished_at,omitempty"`
+	Images     []*JobImage `json:"images"`
+}
+
+// JobImage 任务中单个镜像的状态，phase 取值同 PreheatJob：pending/fetching/done/failed
+type JobImage struct {
+	Image      string     `json:"image"`
+	Phase      string     `json:"phase"`
+	Source     string     `json:"source,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// 回源拉取进度（仅在本节点回源拉取时存在）
+	Progress *preheat.ImagePullProgress `json:"progress,omitempty"`
+}
+
+// JobManager 管理按需预热任务：本地缺失的镜像以 ON_DEMAND_PRIORITY 加入预热队列，
+// 与定时预热共用去重、失败退避与磁盘空间不足推迟
+type JobManager struct {
+	mu    sync.RWMutex
+	ctx   context.Context
+	queue *WorkQueue
+	jobs  map[string]*Job
+}
+
+func NewJobManager() *JobManager {
+	return &JobManager{ctx: context.Background(), jobs: make(map[string]*Job)}
+}
+
+// Submit 创建任务并将本地缺失的镜像加入预热队列，返回任务快照；
+// 预热队列未启动或进行中的任务数达到上限时返回错误
+func (m *JobManager) Submit(images []string) (*Job, error) {
+	now := time.Now()
+	job := &Job{ID: newJobID(), Phase: JobRunning, CreatedAt: now}
+	seen := make(map[string]bool, len(images))
+	for _, image := range images {
+		if image == "" || seen[image] {
+			continue
+		}
+		seen[image] = true
+		job.Images = append(job.Images, &JobImage{Image: image, Phase: PreheatJobImagePending})
+	}
+
+	m.mu.Lock()
+	queue := m.queue
+	if queue == nil {
+		m.mu.Unlock()
+		return nil, ErrQueueNotReady
+	}
+	m.cleanupLocked(now)
+	if len(m.jobs) >= maxJobs {
+		m.mu.Unlock()
+		return nil, ErrTooManyJobs
+	}
+	m.jobs[job.ID] = job
+	ctx := m.ctx
+	snapshot := job.copy()
+	m.mu.Unlock()
+
+	log.Info().Str("job_id", job.ID).Strs("images", images).Msg("创建按需预热任务")
+	go m.run(ctx, queue, job)
+	return snapshot, nil
+}
+
+// Get 获取任务快照，正在回源拉取的镜像附带拉取进度
+func (m *JobManager) Get(id string) (*Job, bool) {
+	m.mu.RLock()
+	job, ok := m.jobs[id]
+	if !ok {
+		m.mu.RUnlock()
+		return nil, false
+	}
+	snapshot := job.copy()
+	m.mu.RUnlock()
+
+	tracker := preheat.GetPullProgressTracker()
+	for _, img := range snapshot.Images {
+		if img.Phase != PreheatJobImagePending && img.StartedAt != nil {
+			if progress, ok := tracker.Get(img.Image); ok && !progress.StartedAt.Before(*img.StartedAt) {
+				img.Progress = progress
+			}
+		}
+	}
+	return snapshot, true
+}
+
+// run 本地已存在的镜像直接完成，其余加入预热队列，按队列通知的进展更新镜像状态
+func (m *JobManager) run(ctx context.Context, queue *WorkQueue, job *Job) {
+	localImages, err := preheat.GetAllLocalImages(ctx)
+	if err != nil {
+		log.Warn().Err(err).Str("job_id", job.ID).Msg("获取本地镜像列表失败，全部按缺失处理")
+	}
+	for _, img := range job.Images {
+		if preheat.HasLocalImage(ctx, localImages, img.Image, "") {
+			m.update(job, func() {
+				now := time.Now()
+				img.Phase = PreheatJobImageDone
+				img.Source = PreheatJobSourceLocal
+				img.StartedAt, img.FinishedAt = &now, &now
+			})
+			continue
+		}
+		queue.AddOnDemand(img.Image, config.OnDemandPriority, func(event QueueEvent) {
+			m.update(job, func() { img.apply(event) })
+		})
+	}
+	// 全部镜像本地已存在时直接结束
+	m.update(job, func() {})
+}
+
+// apply 按预热队列通知的进展更新镜像状态，已结束的镜像不再变化
+func (img *JobImage) apply(event QueueEvent) {
+	if img.Phase == PreheatJobImageDone || img.Phase == PreheatJobImageFailed {
+		return
+	}
+	now := time.Now()
+	switch {
+	case event.Started:
+		img.Phase = PreheatJobImageFetching
+		img.StartedAt = &now
+	case event.Done:
+		img.Phase = PreheatJobImageDone
+		img.Source = event.Source
+		img.Error = ""
+		img.FinishedAt = &now
+	case event.Dropped || (!event.Deferred && event.Attempts >= onDemandMaxAttempts):
+		img.Phase = PreheatJobImageFailed
+		img.Error = event.Err.Error()
+		img.FinishedAt = &now
+	default:
+		// 失败退避或磁盘空间不足推迟，等待队列重试
+		img.Phase = PreheatJobImagePending
+		img.Error = event.Err.Error()
+	}
+}
+
+// update 修改任务状态，全部镜像结束后任务结束
+func (m *JobManager) update(job *Job, fn func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fn()
+	if job.FinishedAt != nil {
+		return
+	}
+	phase := JobSucceeded
+	for _, img := range job.Images {
+		switch img.Phase {
+		case PreheatJobImageDone:
+		case PreheatJobImageFailed:
+			phase = JobFailed
+		default:
+			return
+		}
+	}
+	now := time.Now()
+	job.FinishedAt = &now
+	job.Phase = phase
+	log.Info().Str("job_id", job.ID).Str("phase", phase).Msg("按需预热任务结束")
+}
+
+// cleanupLocked 清理过期的已结束任务，任务数仍达到 maxJobs 时按结束时间淘汰最早结束的任务；调用方需持有写锁
+func (m *JobManager) cleanupLocked(now time.Time) {
+	var finished []*Job
+	for id, job := range m.jobs {
+		if job.FinishedAt == nil {
+			continue
+		}
+		if now.Sub(*job.FinishedAt) > jobRetention {
+			delete(m.jobs, id)
+			continue
+		}
+		finished = append(finished, job)
+	}
+	if len(m.jobs) < maxJobs {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].FinishedAt.Before(*finished[j].FinishedAt) })
+	for _, job := range finished {
+		if len(m.jobs) < maxJobs {
+			return
+		}
+		delete(m.jobs, job.ID)
+	}
+}
+
+// SetQueue 设置按需预热使用的预热队列，设置前提交的任务返回 ErrQueueNotReady
+func (m *JobManager) SetQueue(queue *WorkQueue) {
+	m.mu.Lock()
+	m.queue = queue
+	m.mu.Unlock()
+}
+
+// SetContext 设置任务执行使用的 ctx，进程退出时取消进行中的任务
+func (m *JobManager) SetContext(ctx context.Context) {
+	m.mu.Lock()
+	m.ctx = ctx
+	m.mu.Unlock()
+}
+
+func (j *Job) copy() *Job {
+	c := *j
+	c.Images = make([]*JobImage, len(j.Images))
+	for i, img := range j.Images {
+		imgCopy := *img
+		c.Images[i] = &imgCopy
+	}
+	return &c
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// 全局按需预热任务管理器
+var jobManager = NewJobManager()
+
+// GetJobManager 获取全局按需预热任务管理器
+func GetJobManager() *JobManager {
+	return jobManager
+}
@@ -0,0 +1,179 @@
+package task
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"image-preheat/internal/config"
+)
+
+func newTestJobManager(t *testing.T) (*JobManager, *WorkQueue) {
+	t.Helper()
+	setupJobDocker(t, false)
+	m := NewJobManager()
+	q := newTestQueue(t)
+	m.SetQueue(q)
+	return m, q
+}
+
+// waitQueued 等待任务将镜像加入预热队列
+func waitQueued(t *testing.T, q *WorkQueue, image string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		q.mu.Lock()
+		_, ok := q.items[image]
+		q.mu.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s 未加入预热队列", image)
+}
+
+// waitFinished 等待任务结束
+func waitFinished(t *testing.T, m *JobManager, id string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if job, ok := m.Get(id); ok && job.FinishedAt != nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("任务 %s 未结束", id)
+}
+
+func jobImage(t *testing.T, m *JobManager, id, image string) (*Job, *JobImage) {
+	t.Helper()
+	job, ok := m.Get(id)
+	if !ok {
+		t.Fatalf("任务 %s 不存在", id)
+	}
+	for _, img := range job.Images {
+		if img.Image == image {
+			return job, img
+		}
+	}
+	t.Fatalf("任务中没有镜像 %s", image)
+	return nil, nil
+}
+
+func TestJobManagerRequiresQueue(t *testing.T) {
+	if _, err := NewJobManager().Submit([]string{"redis:7"}); !errors.Is(err, ErrQueueNotReady) {
+		t.Fatalf("预热队列未启动时应返回 ErrQueueNotReady，实际 %v", err)
+	}
+}
+
+func TestJobManagerRoutesThroughQueue(t *testing.T) {
+	m, q := newTestJobManager(t)
+	job, err := m.Submit([]string{"nginx:1.25", "redis:7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitQueued(t, q, "redis:7")
+
+	q.mu.Lock()
+	item := q.items["redis:7"]
+	if item.Priority != config.OnDemandPriority || !item.OnDemand {
+		t.Errorf("按需预热镜像应以 ON_DEMAND_PRIORITY 入队: %+v", item)
+	}
+	_, local := q.items["nginx:1.25"]
+	q.mu.Unlock()
+	if local {
+		t.Error("本地已存在的镜像不应入队")
+	}
+	if _, img := jobImage(t, m, job.ID, "nginx:1.25"); img.Phase != PreheatJobImageDone || img.Source != PreheatJobSourceLocal {
+		t.Errorf("本地已存在的镜像应直接完成: %+v", img)
+	}
+
+	// 列表移除不影响按需预热的项
+	q.Retain(map[string]bool{})
+	popped, _ := q.pop(time.Now())
+	if popped == nil || popped.Image != "redis:7" {
+		t.Fatalf("按需预热的项应保留在队列中: %+v", popped)
+	}
+	if _, img := jobImage(t, m, job.ID, "redis:7"); img.Phase != PreheatJobImageFetching {
+		t.Errorf("出队后应为 fetching: %+v", img)
+	}
+
+	// 失败后退避重试，任务仍在进行中
+	q.finish(m.ctx, popped, "", "", errors.New("pull failed"))
+	got, img := jobImage(t, m, job.ID, "redis:7")
+	if img.Phase != PreheatJobImagePending || img.Error != "pull failed" || got.Phase != JobRunning {
+		t.Fatalf("失败后应等待重试: %+v %+v", got, img)
+	}
+
+	q.items["redis:7"].NextAttempt = time.Now()
+	popped, _ = q.pop(time.Now())
+	q.finish(m.ctx, popped, "", "registry", nil)
+	got, img = jobImage(t, m, job.ID, "redis:7")
+	if img.Phase != PreheatJobImageDone || img.Source != "registry" || got.Phase != JobSucceeded || got.FinishedAt == nil {
+		t.Fatalf("重试成功后任务应完成: %+v %+v", got, img)
+	}
+}
+
+func TestJobManagerDropsAfterMaxAttempts(t *testing.T) {
+	m, q := newTestJobManager(t)
+	job, err := m.Submit([]string{"missing:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitQueued(t, q, "missing:1")
+	for i := 0; i < onDemandMaxAttempts; i++ {
+		q.items["missing:1"].NextAttempt = time.Now()
+		popped, _ := q.pop(time.Now())
+		q.finish(m.ctx, popped, "", "", errors.New("not found"))
+	}
+	if _, ok := q.items["missing:1"]; ok {
+		t.Fatal("失败次数达到上限后应出队")
+	}
+	got, img := jobImage(t, m, job.ID, "missing:1")
+	if img.Phase != PreheatJobImageFailed || got.Phase != JobFailed {
+		t.Fatalf("失败次数达到上限后任务应失败: %+v %+v", got, img)
+	}
+}
+
+func TestJobManagerEviction(t *testing.T) {
+	m, _ := newTestJobManager(t)
+	now := time.Now()
+	for i := 0; i < maxJobs; i++ {
+		finished := now.Add(-time.Duration(maxJobs-i) * time.Second)
+		id := newJobID()
+		m.jobs[id] = &Job{ID: id, Phase: JobSucceeded, FinishedAt: &finished}
+	}
+	expired := now.Add(-2 * jobRetention)
+	m.jobs["expired"] = &Job{ID: "expired", Phase: JobSucceeded, FinishedAt: &expired}
+	var oldest string
+	for id, job := range m.jobs {
+		if id != "expired" && (oldest == "" || job.FinishedAt.Before(*m.jobs[oldest].FinishedAt)) {
+			oldest = id
+		}
+	}
+
+	job, err := m.Submit([]string{"nginx:1.25"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFinished(t, m, job.ID)
+	m.mu.RLock()
+	_, hasExpired := m.jobs["expired"]
+	_, hasOldest := m.jobs[oldest]
+	count := len(m.jobs)
+	m.mu.RUnlock()
+	if hasExpired || hasOldest || count != maxJobs {
+		t.Fatalf("应淘汰过期与最早结束的任务，剩余 %d 个", count)
+	}
+
+	// 全部为进行中的任务时拒绝新任务
+	m.mu.Lock()
+	for id := range m.jobs {
+		m.jobs[id] = &Job{ID: id, Phase: JobRunning}
+	}
+	m.mu.Unlock()
+	if _, err := m.Submit([]string{"nginx:1.25"}); !errors.Is(err, ErrTooManyJobs) {
+		t.Fatalf("进行中的任务达到上限时应返回 ErrTooManyJobs，实际 %v", err)
+	}
+}
@@ -0,0 +1,358 @@
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"image-preheat/internal/config"
+	"image-preheat/internal/preheat"
+
+	"github.com/rs/zerolog/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// PreheatJobGVR PreheatJob 自定义资源
+var PreheatJobGVR = schema.GroupVersionResource{Group: "imagepreheat.io", Version: "v1alpha1", Resource: "preheatjobs"}
+
+// PreheatJob 单镜像状态
+const (
+	PreheatJobImagePending  = "pending"
+	PreheatJobImageFetching = "fetching"
+	PreheatJobImageDone     = "done"
+	PreheatJobImageFailed   = "failed"
+)
+
+// PreheatJob 节点状态
+const (
+	PreheatJobNodeRunning   = "Running"
+	PreheatJobNodeSucceeded = "Succeeded"
+	PreheatJobNodeFailed    = "Failed"
+)
+
+// PreheatJobSourceLocal 镜像在任务开始前已存在于本节点
+const PreheatJobSourceLocal = "local"
+
+// PreheatJob 预热任务：在匹配的节点上预热一组镜像，各节点将结果写回 status.nodes.<节点名>
+type PreheatJob struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              PreheatJobSpec   `json:"spec"`
+	Status            PreheatJobStatus `json:"status,omitempty"`
+}
+
+type PreheatJobSpec struct {
+	Images []string `json:"images"`
+	// 目标节点标签，为空表示所有节点
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// 截止时间，超过后未完成的镜像标记为 failed
+	Deadline *metav1.Time `json:"deadline,omitempty"`
+}
+
+type PreheatJobStatus struct {
+	Nodes map[string]*PreheatJobNodeStatus `json:"nodes,omitempty"`
+}
+
+type PreheatJobNodeStatus struct {
+	Phase              string                            `json:"phase"`
+	ObservedGeneration int64                             `json:"observedGeneration"`
+	StartTime          *metav1.Time                      `json:"startTime,omitempty"`
+	CompletionTime     *metav1.Time                      `json:"completionTime,omitempty"`
+	Images             map[string]*PreheatJobImageStatus `json:"images,omitempty"`
+}
+
+type PreheatJobImageStatus struct {
+	Phase string `json:"phase"`
+	// 镜像来源：p2p、registry、peer_wait 或 local
+	Source     string      `json:"source"`
+	Message    string      `json:"message"`
+	UpdateTime metav1.Time `json:"updateTime"`
+}
+
+// PreheatJobController 监听 PreheatJob 并在本节点执行
+type PreheatJobController struct {
+	client   dynamic.Interface
+	nodeName string
+
+	mu sync.Mutex
+	// 本进程已开始执行（含已完成）的任务 -> 最新 generation 的执行；informer 的滞后事件仍显示 Running 时据此跳过，
+	// 任务更新时取消旧 generation 的执行，任务删除时取消并清理
+	started map[types.UID]*startedJob
+}
+
+// startedJob 任务在本进程的一次执行
+type startedJob struct {
+	generation int64
+	cancel     context.CancelFunc
+	// 执行结束后关闭
+	done chan struct{}
+}
+
+func NewPreheatJobController(client dynamic.Interface, nodeName string) *PreheatJobController {
+	return &PreheatJobController{client: client, nodeName: nodeName, started: make(map[types.UID]*startedJob)}
+}
+
+// StartPreheatJobController 创建 dynamic 客户端并启动 PreheatJob 监听，ctx 取消时退出
+func StartPreheatJobController(ctx context.Context) {
+	client, err := config.NewK8sDynamicClient()
+	if err != nil {
+		log.Error().Err(err).Msg("创建 dynamic 客户端失败，PreheatJob 监听未启动")
+		return
+	}
+	NewPreheatJobController(client, config.NodeName).Run(ctx)
+}
+
+// Run 监听全部命名空间的 PreheatJob，直到 ctx 取消
+func (c *PreheatJobController) Run(ctx context.Context) {
+	log.Info().Str("resource", PreheatJobGVR.String()).Msg("启动 PreheatJob 监听")
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(c.client, 5*time.Minute, metav1.NamespaceAll, nil)
+	informer := factory.ForResource(PreheatJobGVR).Informer()
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { c.handle(ctx, obj) },
+		UpdateFunc: func(_, obj interface{}) { c.handle(ctx, obj) },
+		DeleteFunc: c.forget,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("注册 PreheatJob 事件处理失败")
+		return
+	}
+	factory.Start(ctx.Done())
+	<-ctx.Done()
+	factory.Shutdown()
+	log.Info().Msg("PreheatJob 监听已停止")
+}
+
+// handle 判断任务是否需要在本节点执行：节点匹配、本节点尚未完成当前 generation、且本进程未执行过该 generation。
+// 本进程正在执行旧 generation 时先取消，等其结束后再开始新的执行
+func (c *PreheatJobController) handle(ctx context.Context, obj interface{}) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	var job PreheatJob
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &job); err != nil {
+		log.Warn().Err(err).Str("job", u.GetNamespace()+"/"+u.GetName()).Msg("解析 PreheatJob 失败")
+		return
+	}
+	if status := job.Status.Nodes[c.nodeName]; status != nil && status.ObservedGeneration == job.Generation &&
+		status.Phase != PreheatJobNodeRunning {
+		return // 本节点已完成
+	}
+	if !c.targetsThisNode(ctx, &job) {
+		return
+	}
+
+	c.mu.Lock()
+	prev, ok := c.started[job.UID]
+	if ok && prev.generation >= job.Generation {
+		c.mu.Unlock()
+		return
+	}
+	runCtx, cancel := context.WithCancel(ctx)
+	current := &startedJob{generation: job.Generation, cancel: cancel, done: make(chan struct{})}
+	c.started[job.UID] = current
+	c.mu.Unlock()
+
+	go func() {
+		defer close(current.done)
+		defer cancel()
+		if prev != nil {
+			log.Info().Str("job", job.Namespace+"/"+job.Name).Int64("old_generation", prev.generation).
+				Int64("generation", job.Generation).Msg("PreheatJob 已更新，取消旧 generation 的执行")
+			prev.cancel()
+			<-prev.done
+		}
+		c.runJob(runCtx, &job)
+	}()
+}
+
+// current 判断 generation 是否仍是任务在本进程的最新执行，任务已更新或删除时返回 false
+func (c *PreheatJobController) current(uid types.UID, generation int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	run, ok := c.started[uid]
+	return ok && run.generation == generation
+}
+
+// forget 任务删除后取消执行并清理执行记录
+func (c *PreheatJobController) forget(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	if run, ok := c.started[u.GetUID()]; ok {
+		run.cancel()
+		delete(c.started, u.GetUID())
+	}
+	c.mu.Unlock()
+}
+
+func (c *PreheatJobController) targetsThisNode(ctx context.Context, job *PreheatJob) bool {
+	if len(job.Spec.NodeSelector) == 0 {
+		return true
+	}
+	return labels.SelectorFromSet(job.Spec.NodeSelector).Matches(labels.Set(nodeLabels(ctx)))
+}
+
+// runJob 在本节点执行任务，各镜像并发预热（受预热并发数限制），状态逐个写回
+func (c *PreheatJobController) runJob(ctx context.Context, job *PreheatJob) {
+	name := job.Namespace + "/" + job.Name
+	log.Info().Str("job", name).Int64("generation", job.Generation).Strs("images", job.Spec.Images).Msg("开始执行 PreheatJob")
+	if job.Spec.Deadline != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, job.Spec.Deadline.Time)
+		defer cancel()
+	}
+
+	now := metav1.Now()
+	run := &preheatJobRun{controller: c, job: job, status: &PreheatJobNodeStatus{
+		Phase:              PreheatJobNodeRunning,
+		ObservedGeneration: job.Generation,
+		StartTime:          &now,
+		Images:             make(map[string]*PreheatJobImageStatus, len(job.Spec.Images)),
+	}}
+	for _, image := range job.Spec.Images {
+		run.status.Images[image] = &PreheatJobImageStatus{Phase: PreheatJobImagePending, UpdateTime: now}
+	}
+	if !c.current(job.UID, job.Generation) {
+		return
+	}
+	// 先删除本节点上一 generation 的状态，避免合并后残留已移除镜像的记录
+	c.patchStatus(job, nil)
+	run.update(nil)
+
+	localImages, err := preheat.GetAllLocalImages(ctx)
+	if err != nil {
+		log.Warn().Err(err).Str("job", name).Msg("获取本地镜像列表失败，全部按缺失处理")
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := false
+	for _, image := range job.Spec.Images {
+		wg.Add(1)
+		go func(image string) {
+			defer wg.Done()
+			result := run.preheat(ctx, image, localImages)
+			mu.Lock()
+			if result.Phase == PreheatJobImageFailed {
+				failed = true
+			}
+			mu.Unlock()
+		}(image)
+	}
+	wg.Wait()
+	if errors.Is(ctx.Err(), context.Canceled) {
+		if !c.current(job.UID, job.Generation) {
+			log.Info().Str("job", name).Int64("generation", job.Generation).Msg("PreheatJob 已更新或删除，旧 generation 的执行已停止")
+			return
+		}
+		log.Info().Str("job", name).Msg("进程退出，PreheatJob 保持 Running 状态，重启后继续执行")
+		return
+	}
+
+	phase := PreheatJobNodeSucceeded
+	if failed {
+		phase = PreheatJobNodeFailed
+	}
+	run.update(func(status *PreheatJobNodeStatus) {
+		completion := metav1.Now()
+		status.Phase = phase
+		status.CompletionTime = &completion
+	})
+	log.Info().Str("job", name).Str("phase", phase).Msg("PreheatJob 执行结束")
+}
+
+// preheatJobRun 一次任务执行在本节点的完整状态，每次变更整体写回 status.nodes.<本节点>
+type preheatJobRun struct {
+	controller *PreheatJobController
+	job        *PreheatJob
+
+	mu     sync.Mutex
+	status *PreheatJobNodeStatus
+}
+
+// update 修改状态并写回；持锁写回，保证并发预热的镜像按修改顺序落盘。
+// 任务已更新或删除后不再写回，避免旧 generation 的结果覆盖新 generation 的状态
+func (r *preheatJobRun) update(modify func(*PreheatJobNodeStatus)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if modify != nil {
+		modify(r.status)
+	}
+	if !r.controller.current(r.job.UID, r.job.Generation) {
+		log.Debug().Str("job", r.job.Namespace+"/"+r.job.Name).Int64("generation", r.job.Generation).Msg("忽略旧 generation 的状态写回")
+		return
+	}
+	r.controller.patchStatus(r.job, r.status)
+}
+
+func (r *preheatJobRun) setImage(image string, status *PreheatJobImageStatus) {
+	r.update(func(s *PreheatJobNodeStatus) { s.Images[image] = status })
+}
+
+// preheat 预热单个镜像并写回状态
+func (r *preheatJobRun) preheat(ctx context.Context, image string, localImages map[string]struct{}) *PreheatJobImageStatus {
+	if preheat.HasLocalImage(ctx, localImages, image, "") {
+		result := &PreheatJobImageStatus{Phase: PreheatJobImageDone, Source: PreheatJobSourceLocal, UpdateTime: metav1.Now()}
+		r.setImage(image, result)
+		return result
+	}
+	if err := preheat.CheckDiskSpace(ctx, image, 0); err != nil {
+		result := &PreheatJobImageStatus{Phase: PreheatJobImageFailed, Message: err.Error(), UpdateTime: metav1.Now()}
+		r.setImage(image, result)
+		return result
+	}
+	r.setImage(image, &PreheatJobImageStatus{Phase: PreheatJobImageFetching, UpdateTime: metav1.Now()})
+	source, err := preheat.PreheatImageWithSource(ctx, image, "")
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+		// 进程退出：保留 fetching 状态，重启后重新执行
+		return &PreheatJobImageStatus{Phase: PreheatJobImageFetching}
+	}
+	result := &PreheatJobImageStatus{Phase: PreheatJobImageDone, Source: source, UpdateTime: metav1.Now()}
+	if err != nil {
+		result.Phase = PreheatJobImageFailed
+		result.Message = err.Error()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			result.Message = fmt.Sprintf("超过任务截止时间: %v", err)
+		}
+	} else {
+		preheat.GetPreheatedDigestManager().UpdateDigests(ctx, image)
+	}
+	r.setImage(image, result)
+	return result
+}
+
+// patchStatus 以 merge patch 更新 status.nodes.<本节点>，各节点只写自己的 key，互不冲突；
+// status 为 nil 时删除本节点的状态
+func (c *PreheatJobController) patchStatus(job *PreheatJob, status *PreheatJobNodeStatus) {
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{"nodes": map[string]*PreheatJobNodeStatus{c.nodeName: status}},
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("序列化 PreheatJob 状态失败")
+		return
+	}
+	// 状态写回不受任务截止时间影响
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = c.client.Resource(PreheatJobGVR).Namespace(job.Namespace).
+		Patch(ctx, job.Name, types.MergePatchType, patch, metav1.PatchOptions{}, "status")
+	if err != nil {
+		log.Warn().Err(err).Str("job", job.Namespace+"/"+job.Name).Msg("更新 PreheatJob 状态失败")
+	}
+}
@@ -0,0 +1,223 @@
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"image-preheat/internal/docker"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const testNodeName = "node-1"
+
+// fakeJobDockerClient 镜像均已存在于本地；blockFirst 时第一次 GetImages 阻塞到 ctx 取消，模拟执行中的任务
+type fakeJobDockerClient struct {
+	docker.DockerClient
+	images     map[string]struct{}
+	blockFirst bool
+	entered    chan struct{}
+	once       sync.Once
+}
+
+func (f *fakeJobDockerClient) GetImages(ctx context.Context) (map[string]struct{}, error) {
+	blocked := false
+	f.once.Do(func() { blocked = f.blockFirst })
+	if blocked {
+		close(f.entered)
+		<-ctx.Done()
+	}
+	return f.images, nil
+}
+
+func (f *fakeJobDockerClient) ImageExists(ctx context.Context, image string) (bool, error) {
+	return docker.HasImage(f.images, image), nil
+}
+
+func setupJobDocker(t *testing.T, blockFirst bool) *fakeJobDockerClient {
+	t.Helper()
+	f := &fakeJobDockerClient{images: map[string]struct{}{"nginx:1.25": {}}, blockFirst: blockFirst, entered: make(chan struct{})}
+	docker.SetClient(f)
+	t.Cleanup(func() { docker.SetClient(nil) })
+	return f
+}
+
+func newTestPreheatJob(generation int64, status map[string]interface{}) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": PreheatJobGVR.GroupVersion().String(),
+		"kind":       "PreheatJob",
+		"metadata": map[string]interface{}{
+			"name":       "warmup",
+			"namespace":  "default",
+			"uid":        "job-uid",
+			"generation": generation,
+		},
+		"spec": map[string]interface{}{"images": []interface{}{"nginx:1.25"}},
+	}}
+	if status != nil {
+		u.Object["status"] = status
+	}
+	return u
+}
+
+func newTestJobController(objs ...runtime.Object) (*PreheatJobController, *fake.FakeDynamicClient) {
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{PreheatJobGVR: "PreheatJobList"}, objs...)
+	return NewPreheatJobController(client, testNodeName), client
+}
+
+// statusPatches 返回写回的本节点状态，nil 表示删除本节点状态
+func statusPatches(t *testing.T, client *fake.FakeDynamicClient) []*PreheatJobNodeStatus {
+	t.Helper()
+	var patches []*PreheatJobNodeStatus
+	for _, action := range client.Actions() {
+		patch, ok := action.(k8stesting.PatchAction)
+		if !ok || patch.GetSubresource() != "status" {
+			continue
+		}
+		var body struct {
+			Status struct {
+				Nodes map[string]*PreheatJobNodeStatus `json:"nodes"`
+			} `json:"status"`
+		}
+		if err := json.Unmarshal(patch.GetPatch(), &body); err != nil {
+			t.Fatal(err)
+		}
+		patches = append(patches, body.Status.Nodes[testNodeName])
+	}
+	return patches
+}
+
+// waitStarted 返回任务当前执行的 done
+func waitStarted(t *testing.T, c *PreheatJobController, generation int64) chan struct{} {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	run, ok := c.started["job-uid"]
+	if !ok || run.generation != generation {
+		t.Fatalf("generation %d 应已开始执行: %+v", generation, run)
+	}
+	return run.done
+}
+
+func waitDone(t *testing.T, done chan struct{}) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("等待任务执行结束超时")
+	}
+}
+
+func TestPreheatJobRunsLocalImages(t *testing.T) {
+	setupJobDocker(t, false)
+	job := newTestPreheatJob(1, nil)
+	c, client := newTestJobController(job)
+	ctx := context.Background()
+
+	c.handle(ctx, job)
+	waitDone(t, waitStarted(t, c, 1))
+	patches := statusPatches(t, client)
+	last := patches[len(patches)-1]
+	if last == nil || last.Phase != PreheatJobNodeSucceeded || last.ObservedGeneration != 1 {
+		t.Fatalf("本节点应完成 generation 1: %+v", last)
+	}
+	if img := last.Images["nginx:1.25"]; img == nil || img.Phase != PreheatJobImageDone || img.Source != PreheatJobSourceLocal {
+		t.Fatalf("已存在的镜像应标记为 local: %+v", img)
+	}
+
+	// informer 的滞后事件仍显示 Running 时不重复执行
+	client.ClearActions()
+	c.handle(ctx, job)
+	if patches := statusPatches(t, client); len(patches) != 0 {
+		t.Fatalf("同一 generation 不应重复执行: %+v", patches)
+	}
+}
+
+func TestPreheatJobNewGenerationCancelsStaleRun(t *testing.T) {
+	f := setupJobDocker(t, true)
+	job := newTestPreheatJob(1, nil)
+	c, client := newTestJobController(job)
+	ctx := context.Background()
+
+	c.handle(ctx, job)
+	stale := waitStarted(t, c, 1)
+	<-f.entered
+
+	c.handle(ctx, newTestPreheatJob(2, nil))
+	waitDone(t, stale)
+	waitDone(t, waitStarted(t, c, 2))
+
+	// generation 2 开始写回后不应再出现 generation 1 的状态
+	patches := statusPatches(t, client)
+	newRun := -1
+	for i, p := range patches {
+		if p != nil && p.ObservedGeneration == 2 {
+			newRun = i
+			break
+		}
+	}
+	if newRun < 0 {
+		t.Fatalf("generation 2 未写回状态: %+v", patches)
+	}
+	for _, p := range patches[newRun:] {
+		if p != nil && p.ObservedGeneration != 2 {
+			t.Fatalf("旧 generation 的状态覆盖了新状态: %+v", p)
+		}
+	}
+	if last := patches[len(patches)-1]; last.Phase != PreheatJobNodeSucceeded {
+		t.Fatalf("generation 2 应执行完成: %+v", last)
+	}
+	for _, p := range patches {
+		if p != nil && p.ObservedGeneration == 1 && p.Phase != PreheatJobNodeRunning {
+			t.Fatalf("被取消的 generation 1 不应写回结束状态: %+v", p)
+		}
+	}
+}
+
+func TestPreheatJobDeleteCancelsRun(t *testing.T) {
+	f := setupJobDocker(t, true)
+	job := newTestPreheatJob(1, nil)
+	c, client := newTestJobController(job)
+
+	c.handle(context.Background(), job)
+	done := waitStarted(t, c, 1)
+	<-f.entered
+	before := len(statusPatches(t, client))
+
+	c.forget(job)
+	waitDone(t, done)
+	if after := len(statusPatches(t, client)); after != before {
+		t.Fatalf("任务删除后不应再写回状态，写回次数 %d -> %d", before, after)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.started["job-uid"]; ok {
+		t.Fatal("任务删除后应清理执行记录")
+	}
+}
+
+func TestPreheatJobSkipsCompletedGeneration(t *testing.T) {
+	setupJobDocker(t, false)
+	job := newTestPreheatJob(1, map[string]interface{}{
+		"nodes": map[string]interface{}{
+			testNodeName: map[string]interface{}{"phase": PreheatJobNodeSucceeded, "observedGeneration": int64(1), "completionTime": metav1.Now().UTC().Format(time.RFC3339)},
+		},
+	})
+	c, client := newTestJobController(job)
+	c.handle(context.Background(), job)
+	c.mu.Lock()
+	_, started := c.started["job-uid"]
+	c.mu.Unlock()
+	if started || len(client.Actions()) != 0 {
+		t.Fatal("本节点已完成当前 generation 时不应执行")
+	}
+}
@@ -0,0 +1,493 @@
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"image-preheat/internal/config"
+	"image-preheat/internal/preheat"
+
+	"github.com/rs/zerolog/log"
+)
+
+// 队列状态快照文件名（位于 MOUNT_DIR 下）
+const queueStateFile = "preheat-queue.json"
+
+// 按需预热的镜像失败达到该次数后出队，不再重试
+const onDemandMaxAttempts = 3
+
+// QueueItem 待预热镜像
+type QueueItem struct {
+	Image    string `json:"image"`
+	Priority int    `json:"priority"`
+	// 拉取的镜像平台，为空表示节点平台
+	Platform string `json:"platform,omitempty"`
+	// 本地已存在但拉取策略为 Always/IfChanged，需回源刷新
+	Refresh bool `json:"refresh,omitempty"`
+	// 拉取策略为 IfChanged：刷新前先比较镜像仓库与本地的 digest
+	CheckDigest bool `json:"check_digest,omitempty"`
+	// 由按需预热加入、不在镜像列表中：不随列表移除，失败 onDemandMaxAttempts 次后出队
+	OnDemand    bool      `json:"on_demand,omitempty"`
+	Attempts    int       `json:"attempts,omitempty"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+	EnqueuedAt  time.Time `json:"enqueued_at"`
+
+	inFlight bool
+	// 执行中再次入队且平台或拉取策略变化：执行结束后按新的参数重新执行
+	requeue bool
+	// 处理进展的回调（按需预热任务），不持久化
+	watchers []func(QueueEvent)
+}
+
+// QueueEvent 排队项的处理进展，在持有队列锁时通知回调，回调不能再调用队列
+type QueueEvent struct {
+	// 开始执行
+	Started bool
+	// 处理成功并出队，Source 为镜像来源
+	Done   bool
+	Source string
+	// 处理失败或推迟的原因
+	Err error
+	// 磁盘空间不足推迟，不计入失败次数
+	Deferred bool
+	// 已失败次数
+	Attempts int
+	// 失败次数达到上限并出队，不再重试
+	Dropped bool
+}
+
+func (item *QueueItem) notify(event QueueEvent) {
+	for _, watch := range item.watchers {
+		watch(event)
+	}
+}
+
+// sameSpec 判断两项的拉取参数（平台、是否刷新、是否比较 digest）是否一致
+func (item *QueueItem) sameSpec(other *QueueItem) bool {
+	return item.Platform == other.Platform && item.Refresh == other.Refresh && item.CheckDigest == other.CheckDigest
+}
+
+// queueState 持久化到磁盘的队列状态
+type queueState struct {
+	Items   []*QueueItem         `json:"items"`
+	LastRun map[string]time.Time `json:"last_run"`
+	Digests map[string]string    `json:"digests,omitempty"`
+}
+
+// WorkQueue 预热工作队列：同一镜像只保留一项（含执行中），按优先级出队，失败后按指数退避重试。
+// 状态在每次变更后写入快照文件，重启后恢复
+type WorkQueue struct {
+	mu    sync.Mutex
+	path  string
+	items map[string]*QueueItem
+	// 各镜像上次成功处理的时间，用于按调度计划判断是否到期
+	lastRun map[string]time.Time
+	// IfChanged 镜像上次刷新到的远端 digest
+	digests map[string]string
+	wake    chan struct{}
+	// 镜像由本队列从无到有拉取成功后回调，可为 nil
+	OnPreheated func(image string)
+}
+
+func NewWorkQueue(path string) *WorkQueue {
+	return &WorkQueue{
+		path:    path,
+		items:   make(map[string]*QueueItem),
+		lastRun: make(map[string]time.Time),
+		digests: make(map[string]string),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Load 从快照文件恢复队列，文件不存在时为空队列
+func (q *WorkQueue) Load() error {
+	data, err := os.ReadFile(q.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state queueState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, item := range state.Items {
+		if item.Image != "" {
+			q.items[item.Image] = item
+		}
+	}
+	for image, t := range state.LastRun {
+		q.lastRun[image] = t
+	}
+	for image, d := range state.Digests {
+		q.digests[image] = d
+	}
+	q.signal()
+	return nil
+}
+
+// Add 入队，exists 表示本地已存在（按拉取策略刷新）。镜像已在队列中（含执行中、退避中）时不重复入队，
+// 提升优先级；平台或拉取策略变化时改用新的参数并立即重试，执行中的项在结束后按新的参数重新执行
+func (q *WorkQueue) Add(entry config.ImageEntry, exists bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	next := &QueueItem{
+		Image:       entry.Image,
+		Priority:    entry.Priority,
+		Platform:    entry.TargetPlatform(),
+		Refresh:     exists,
+		CheckDigest: exists && entry.PullPolicy == config.PullPolicyIfChanged,
+		NextAttempt: now,
+		EnqueuedAt:  now,
+	}
+	if item, ok := q.items[entry.Image]; ok {
+		changed := false
+		if item.OnDemand {
+			// 镜像已加入列表，改由列表管理
+			item.OnDemand = false
+			changed = true
+		}
+		if next.Priority > item.Priority {
+			item.Priority = next.Priority
+			changed = true
+		}
+		if !item.sameSpec(next) {
+			log.Info().Str("image", entry.Image).Str("platform", next.Platform).Bool("refresh", next.Refresh).
+				Bool("check_digest", next.CheckDigest).Bool("in_flight", item.inFlight).Msg("预热参数变化，按新的参数重新预热")
+			item.Platform, item.Refresh, item.CheckDigest = next.Platform, next.Refresh, next.CheckDigest
+			item.Attempts, item.LastError, item.NextAttempt = 0, "", now
+			item.requeue = item.inFlight
+			changed = true
+		}
+		if changed {
+			q.save()
+			q.signal()
+		}
+		return
+	}
+	q.items[entry.Image] = next
+	log.Info().Str("image", entry.Image).Int("priority", entry.Priority).Bool("refresh", exists).Msg("镜像加入预热队列")
+	q.save()
+	q.signal()
+}
+
+// AddOnDemand 按需预热入队（节点平台、本地缺失的镜像），watch 接收处理进展；
+// 镜像已在队列中（含执行中、退避中）时不重复入队，提升优先级并在其结果上注册 watch
+func (q *WorkQueue) AddOnDemand(image string, priority int, watch func(QueueEvent)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if item, ok := q.items[image]; ok {
+		if priority > item.Priority {
+			item.Priority = priority
+			q.save()
+		}
+		item.watchers = append(item.watchers, watch)
+		q.signal()
+		return
+	}
+	now := time.Now()
+	q.items[image] = &QueueItem{
+		Image:       image,
+		Priority:    priority,
+		Platform:    config.NormalizePlatform(""),
+		OnDemand:    true,
+		NextAttempt: now,
+		EnqueuedAt:  now,
+		watchers:    []func(QueueEvent){watch},
+	}
+	log.Info().Str("image", image).Int("priority", priority).Msg("按需预热镜像加入预热队列")
+	q.save()
+	q.signal()
+}
+
+// MarkDone 记录镜像处理完成的时间（本地已存在的镜像直接记录）
+func (q *WorkQueue) MarkDone(image string, t time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.lastRun[image] = t
+	q.save()
+}
+
+// LastRun 返回各镜像上次成功处理时间的副本
+func (q *WorkQueue) LastRun() map[string]time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	c := make(map[string]time.Time, len(q.lastRun))
+	for image, t := range q.lastRun {
+		c[image] = t
+	}
+	return c
+}
+
+// Retain 移除已不在镜像列表中的排队项与调度记录，执行中的项与按需预热的项不受影响
+func (q *WorkQueue) Retain(listed map[string]bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	changed := false
+	for image, item := range q.items {
+		if !listed[image] && !item.inFlight && !item.OnDemand {
+			log.Info().Str("image", image).Msg("镜像已从列表移除，移出预热队列")
+			delete(q.items, image)
+			changed = true
+		}
+	}
+	for image := range q.lastRun {
+		if !listed[image] {
+			delete(q.lastRun, image)
+			changed = true
+		}
+	}
+	for image := range q.digests {
+		if !listed[image] {
+			delete(q.digests, image)
+			changed = true
+		}
+	}
+	if changed {
+		q.save()
+	}
+}
+
+// Run 以 workers 个并发处理队列，ctx 取消后等待执行中的项结束再返回
+func (q *WorkQueue) Run(ctx context.Context, workers int) {
+	if workers <= 0 {
+		workers = 1
+	}
+	slots := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		item, wait := q.pop(time.Now())
+		if item == nil {
+			<-slots
+			if !q.wait(ctx, wait) {
+				return
+			}
+			continue
+		}
+		wg.Add(1)
+		go func(item *QueueItem) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			q.process(ctx, item)
+		}(item)
+	}
+}
+
+// pop 取出已到重试时间、优先级最高（同优先级先入队者优先）的项并标记为执行中；
+// 没有可执行项时返回距最近一次重试的等待时间，0 表示队列为空
+func (q *WorkQueue) pop(now time.Time) (*QueueItem, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var best *QueueItem
+	var wait time.Duration
+	for _, item := range q.items {
+		if item.inFlight {
+			continue
+		}
+		if item.NextAttempt.After(now) {
+			if d := item.NextAttempt.Sub(now); wait == 0 || d < wait {
+				wait = d
+			}
+			continue
+		}
+		if best == nil || item.Priority > best.Priority ||
+			(item.Priority == best.Priority && item.EnqueuedAt.Before(best.EnqueuedAt)) {
+			best = item
+		}
+	}
+	if best == nil {
+		return nil, wait
+	}
+	best.inFlight = true
+	best.notify(QueueEvent{Started: true, Attempts: best.Attempts})
+	c := *best
+	return &c, 0
+}
+
+func (q *WorkQueue) process(ctx context.Context, item *QueueItem) {
+	var remoteDigest string
+	if item.CheckDigest {
+		q.mu.Lock()
+		known := q.digests[item.Image]
+		q.mu.Unlock()
+		digest, changed, err := preheat.ImageDigestChanged(ctx, item.Image, known)
+		if err != nil || !changed {
+			if err == nil {
+				log.Info().Str("image", item.Image).Str("digest", digest).Msg("镜像 digest 未变化，无需刷新")
+			}
+			q.finish(ctx, item, "", "", err)
+			return
+		}
+		remoteDigest = digest
+	}
+	if err := preheat.CheckDiskSpace(ctx, item.Image, item.Priority); err != nil {
+		q.deferItem(item.Image, err)
+		return
+	}
+	var source string
+	var err error
+	if item.Refresh {
+		err = preheat.RefreshImageWithLimit(ctx, item.Image, item.Platform)
+	} else {
+		source, err = preheat.PreheatImageWithSource(ctx, item.Image, item.Platform)
+	}
+	if err == nil {
+		preheat.GetPreheatedDigestManager().UpdateDigests(ctx, item.Image)
+		if !item.Refresh && !item.OnDemand && q.OnPreheated != nil {
+			q.OnPreheated(item.Image)
+		}
+	}
+	q.finish(ctx, item, remoteDigest, source, err)
+}
+
+// finish 记录处理结果：成功时出队并记录完成时间（及刷新到的 digest），失败时按指数退避重试，
+// 按需预热的项失败 onDemandMaxAttempts 次后出队；执行期间参数已变化的项保留在队列中，按新的参数立即重新执行
+func (q *WorkQueue) finish(ctx context.Context, item *QueueItem, digest, source string, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	defer q.signal()
+	current, ok := q.items[item.Image]
+	if !ok {
+		return
+	}
+	current.inFlight = false
+	if current.requeue {
+		current.requeue = false
+		if err == nil {
+			q.lastRun[item.Image] = time.Now()
+			current.notify(QueueEvent{Done: true, Source: source, Attempts: current.Attempts})
+			current.watchers = nil
+		}
+		q.save()
+		return
+	}
+	if err == nil {
+		current.notify(QueueEvent{Done: true, Source: source, Attempts: current.Attempts})
+		delete(q.items, item.Image)
+		q.lastRun[item.Image] = time.Now()
+		if digest != "" {
+			q.digests[item.Image] = digest
+		}
+		q.save()
+		return
+	}
+	if ctx.Err() != nil {
+		// 进程退出：保留在队列中，重启后继续，不计入失败次数
+		return
+	}
+	current.Attempts++
+	current.LastError = err.Error()
+	if current.OnDemand && current.Attempts >= onDemandMaxAttempts {
+		log.Error().Err(err).Str("image", item.Image).Int("attempts", current.Attempts).Msg("按需预热镜像失败次数达到上限，移出预热队列")
+		current.notify(QueueEvent{Err: err, Attempts: current.Attempts, Dropped: true})
+		delete(q.items, item.Image)
+		q.save()
+		return
+	}
+	current.NextAttempt = time.Now().Add(retryBackoff(current.Attempts))
+	log.Error().Err(err).Str("image", item.Image).Int("attempts", current.Attempts).Time("next_attempt", current.NextAttempt).Msg("预热镜像失败，稍后重试")
+	current.notify(QueueEvent{Err: err, Attempts: current.Attempts})
+	q.save()
+}
+
+// deferItem 磁盘空间不足时推迟到下一个预热周期，不计入失败次数
+func (q *WorkQueue) deferItem(image string, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	defer q.signal()
+	current, ok := q.items[image]
+	if !ok {
+		return
+	}
+	current.inFlight = false
+	current.LastError = err.Error()
+	current.notify(QueueEvent{Err: err, Deferred: true, Attempts: current.Attempts})
+	if current.requeue {
+		// 参数已变化，按新的参数重新检查磁盘空间
+		current.requeue = false
+		q.save()
+		return
+	}
+	current.NextAttempt = time.Now().Add(config.Interval)
+	q.save()
+}
+
+// retryBackoff 第 attempts 次失败后的退避时间：RETRY_BACKOFF_BASE * 2^(attempts-1)，不超过 RETRY_BACKOFF_MAX
+func retryBackoff(attempts int) time.Duration {
+	d := config.RetryBackoffBase
+	for i := 1; i < attempts && d < config.RetryBackoffMax; i++ {
+		d *= 2
+	}
+	if d > config.RetryBackoffMax {
+		d = config.RetryBackoffMax
+	}
+	return d
+}
+
+// wait 等待新项入队、执行结束或到达 d（d 为 0 时不设超时），ctx 取消时返回 false
+func (q *WorkQueue) wait(ctx context.Context, d time.Duration) bool {
+	var timeout <-chan time.Time
+	if d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-q.wake:
+	case <-timeout:
+	case <-ctx.Done():
+		return false
+	}
+	return true
+}
+
+func (q *WorkQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// save 将队列状态写入快照文件（先写临时文件再重命名），调用方需持有锁
+func (q *WorkQueue) save() {
+	if q.path == "" {
+		return
+	}
+	state := queueState{LastRun: q.lastRun, Digests: q.digests}
+	for _, item := range q.items {
+		state.Items = append(state.Items, item)
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		log.Error().Err(err).Msg("序列化预热队列状态失败")
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(q.path), 0755); err != nil {
+		log.Warn().Err(err).Str("path", q.path).Msg("创建预热队列状态目录失败")
+		return
+	}
+	tmp := q.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		log.Warn().Err(err).Str("path", tmp).Msg("写入预热队列状态失败")
+		return
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		log.Warn().Err(err).Str("path", q.path).Msg("保存预热队列状态失败")
+	}
+}
@@ -0,0 +1,191 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"image-preheat/internal/config"
+)
+
+func newTestQueue(t *testing.T) *WorkQueue {
+	t.Helper()
+	return NewWorkQueue(filepath.Join(t.TempDir(), queueStateFile))
+}
+
+func entry(image string, priority int) config.ImageEntry {
+	return config.ImageEntry{Image: image, Priority: priority, PullPolicy: config.PullPolicyIfNotPresent}
+}
+
+func TestWorkQueueOrdering(t *testing.T) {
+	q := newTestQueue(t)
+	q.Add(entry("low:v1", 0), false)
+	q.Add(entry("high:v1", 10), false)
+	q.Add(entry("low:v2", 0), false)
+	q.items["low:v2"].EnqueuedAt = q.items["low:v1"].EnqueuedAt.Add(time.Second)
+	q.Add(entry("later:v1", 100), false)
+	q.items["later:v1"].NextAttempt = time.Now().Add(time.Hour)
+
+	now := time.Now()
+	var order []string
+	for {
+		item, wait := q.pop(now)
+		if item == nil {
+			if wait <= 0 || wait > time.Hour {
+				t.Fatalf("应返回距退避项重试的等待时间，实际 %v", wait)
+			}
+			break
+		}
+		order = append(order, item.Image)
+	}
+	want := []string{"high:v1", "low:v1", "low:v2"}
+	if len(order) != len(want) {
+		t.Fatalf("出队顺序 %v，期望 %v", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("出队顺序 %v，期望 %v", order, want)
+		}
+	}
+}
+
+func TestWorkQueueDedupeInFlight(t *testing.T) {
+	q := newTestQueue(t)
+	q.Add(entry("nginx:1.25", 0), false)
+	item, _ := q.pop(time.Now())
+	if item == nil {
+		t.Fatal("应取出入队的项")
+	}
+
+	// 执行中再次入队：不重复入队，只提升优先级
+	q.Add(entry("nginx:1.25", 5), false)
+	if len(q.items) != 1 || q.items["nginx:1.25"].Priority != 5 {
+		t.Fatalf("执行中的项不应重复入队: %+v", q.items)
+	}
+	if again, _ := q.pop(time.Now()); again != nil {
+		t.Fatal("执行中的项不应再次出队")
+	}
+	q.finish(context.Background(), item, "", "", nil)
+	if _, ok := q.items["nginx:1.25"]; ok {
+		t.Fatal("执行成功后应出队")
+	}
+	if _, ok := q.LastRun()["nginx:1.25"]; !ok {
+		t.Fatal("执行成功后应记录完成时间")
+	}
+}
+
+func TestWorkQueueAddMergesSpec(t *testing.T) {
+	q := newTestQueue(t)
+	q.Add(entry("nginx:1.25", 0), false)
+	q.items["nginx:1.25"].Attempts = 3
+	q.items["nginx:1.25"].NextAttempt = time.Now().Add(time.Hour)
+
+	// 排队中参数变化：改用新的参数并立即重试
+	arm := entry("nginx:1.25", 0)
+	arm.PullPlatform = "linux/arm64"
+	q.Add(arm, false)
+	queued := q.items["nginx:1.25"]
+	if queued.Platform != "linux/arm64" || queued.Attempts != 0 || queued.NextAttempt.After(time.Now()) {
+		t.Fatalf("排队中的项应按新的平台立即重试: %+v", queued)
+	}
+
+	item, _ := q.pop(time.Now())
+	// 执行中改为 IfChanged 且本地已存在：执行结束后按新的参数重新执行
+	ifChanged := arm
+	ifChanged.PullPolicy = config.PullPolicyIfChanged
+	q.Add(ifChanged, true)
+	q.finish(context.Background(), item, "", "", nil)
+	current, ok := q.items["nginx:1.25"]
+	if !ok {
+		t.Fatal("执行期间参数变化的项应保留在队列中")
+	}
+	if !current.Refresh || !current.CheckDigest || current.inFlight {
+		t.Fatalf("应按新的拉取策略重新执行: %+v", current)
+	}
+	if next, _ := q.pop(time.Now()); next == nil || !next.CheckDigest {
+		t.Fatalf("应立即按新的参数出队: %+v", next)
+	}
+}
+
+func TestWorkQueueBackoff(t *testing.T) {
+	base, maxBackoff := config.RetryBackoffBase, config.RetryBackoffMax
+	t.Cleanup(func() { config.RetryBackoffBase, config.RetryBackoffMax = base, maxBackoff })
+	config.RetryBackoffBase, config.RetryBackoffMax = time.Second, 10*time.Second
+
+	for attempts, want := range map[int]time.Duration{
+		1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 8 * time.Second, 5: 10 * time.Second, 50: 10 * time.Second,
+	} {
+		if got := retryBackoff(attempts); got != want {
+			t.Errorf("第 %d 次失败退避 %v，期望 %v", attempts, got, want)
+		}
+	}
+
+	q := newTestQueue(t)
+	q.Add(entry("nginx:1.25", 0), false)
+	for i := 1; i <= 3; i++ {
+		q.items["nginx:1.25"].NextAttempt = time.Now()
+		item, _ := q.pop(time.Now())
+		before := time.Now()
+		q.finish(context.Background(), item, "", "", errors.New("pull failed"))
+		current := q.items["nginx:1.25"]
+		if current.Attempts != i || current.LastError != "pull failed" {
+			t.Fatalf("失败次数 %d、错误 %q，期望 %d", current.Attempts, current.LastError, i)
+		}
+		if d := current.NextAttempt.Sub(before); d < retryBackoff(i) || d > retryBackoff(i)+time.Second {
+			t.Fatalf("第 %d 次失败后退避 %v，期望 %v", i, d, retryBackoff(i))
+		}
+	}
+
+	// 进程退出导致的失败不计入失败次数
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	q.items["nginx:1.25"].NextAttempt = time.Now()
+	item, _ := q.pop(time.Now())
+	q.finish(ctx, item, "", "", context.Canceled)
+	if q.items["nginx:1.25"].Attempts != 3 {
+		t.Fatalf("ctx 取消不应计入失败次数，实际 %d", q.items["nginx:1.25"].Attempts)
+	}
+}
+
+func TestWorkQueueSaveRestore(t *testing.T) {
+	q := newTestQueue(t)
+	q.Add(entry("nginx:1.25", 5), false)
+	ifChanged := entry("redis:7", 0)
+	ifChanged.PullPolicy = config.PullPolicyIfChanged
+	ifChanged.PullPlatform = "linux/arm64"
+	q.Add(ifChanged, true)
+	done := time.Now().Add(-time.Minute).Round(0)
+	q.MarkDone("busybox:1.36", done)
+	q.mu.Lock()
+	q.digests["busybox:1.36"] = "sha256:abc"
+	q.save()
+	q.mu.Unlock()
+	// 执行中的项重启后应继续执行
+	item, _ := q.pop(time.Now())
+
+	restored := NewWorkQueue(q.path)
+	if err := restored.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.items) != 2 {
+		t.Fatalf("恢复后应有 2 项，实际 %+v", restored.items)
+	}
+	for image, want := range q.items {
+		got, ok := restored.items[image]
+		if !ok {
+			t.Fatalf("%s 未恢复", image)
+		}
+		if got.Priority != want.Priority || got.Platform != want.Platform || got.Refresh != want.Refresh ||
+			got.CheckDigest != want.CheckDigest || !got.EnqueuedAt.Equal(want.EnqueuedAt) || got.inFlight {
+			t.Fatalf("%s 恢复为 %+v，期望 %+v", image, got, want)
+		}
+	}
+	if !restored.LastRun()["busybox:1.36"].Equal(done) || restored.digests["busybox:1.36"] != "sha256:abc" {
+		t.Fatalf("调度记录未恢复: %v %v", restored.LastRun(), restored.digests)
+	}
+	if again, _ := restored.pop(time.Now()); again == nil || again.Image != item.Image {
+		t.Fatalf("重启前执行中的项应按优先级重新出队: %+v", again)
+	}
+}
@@ -1,50 +1,147 @@
 package task
 
 import (
+	"context"
+	"errors"
 	"image-preheat/internal/config"
 	"image-preheat/internal/preheat"
-	"sync"
+	"path/filepath"
+	"runtime"
 	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
-func StartPeriodicCheck(cache *config.ImageListCache, interval time.Duration) {
+// StartPeriodicCheck 定时将到期的镜像加入预热队列，由队列按优先级并发处理、失败退避重试。
+// 队列状态持久化在 MOUNT_DIR 下，重启后继续；开启 GC_ENABLED 时同时回收已从列表移除的预热镜像。ctx 取消时等待执行中的预热结束后返回
+func StartPeriodicCheck(ctx context.Context, cache *config.ImageListCache, interval time.Duration) {
 	log.Info().Dur("interval", interval).Msg("启动定时批量预热任务 StartPeriodicCheck")
+	queue := NewWorkQueue(filepath.Join(config.MountDir, queueStateFile))
+	if err := queue.Load(); err != nil {
+		log.Warn().Err(err).Msg("恢复预热队列状态失败，从空队列开始")
+	}
+	gc := GetGarbageCollector()
+	if err := gc.Load(); err != nil {
+		log.Warn().Err(err).Msg("恢复镜像回收状态失败")
+	}
+	queue.OnPreheated = gc.Track
+	GetJobManager().SetQueue(queue)
+	queueDone := make(chan struct{})
+	go func() {
+		defer close(queueDone)
+		queue.Run(ctx, config.PreheatConcurrency)
+	}()
+	defer func() { <-queueDone }()
+
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 	for {
-		<-ticker.C
+		select {
+		case <-ctx.Done():
+			log.Info().Msg("定时批量预热任务已停止")
+			return
+		case <-ticker.C:
+		}
 		log.Info().Msg("开始新一轮批量镜像预热")
-		images := cache.GetImages()
-		localImages, err := preheat.GetAllLocalImages()
+		localImages, err := preheat.GetAllLocalImages(ctx)
 		if err != nil {
 			log.Error().Err(err).Msg("获取本地镜像列表失败")
 			continue
 		}
-		var wg sync.WaitGroup
-		for _, img := range images {
-			if img == "" {
+		now := time.Now()
+		entries := cache.GetEntries()
+		listed := make(map[string]bool, len(entries))
+		for _, entry := range entries {
+			listed[entry.Image] = true
+		}
+		queue.Retain(listed)
+		if config.GCEnabled {
+			gc.Reconcile(ctx, listed, localImages)
+		}
+		for _, entry := range dueEntries(ctx, entries, queue.LastRun(), now) {
+			exists := preheat.HasLocalImage(ctx, localImages, entry.Image, entry.TargetPlatform())
+			if exists && !entry.NeedsRefresh() && !localPlatformMatches(ctx, entry) {
+				// 本地镜像平台不一致（如此前经节点间传输得到其他平台的镜像），回源刷新
+				queue.Add(entry, exists)
 				continue
 			}
-			if _, ok := localImages[img]; ok {
-				log.Info().Str("image", img).Msg("本地已存在镜像")
+			if exists && !entry.NeedsRefresh() {
+				log.Info().Str("image", entry.Image).Msg("本地已存在镜像")
 				// 新增：维护预热镜像digest
-				preheat.GetPreheatedDigestManager().UpdateDigests(img)
+				preheat.GetPreheatedDigestManager().UpdateDigests(ctx, entry.Image)
+				queue.MarkDone(entry.Image, now)
 				continue
 			}
-			wg.Add(1)
-			go func(image string) {
-				defer wg.Done()
-				if err := preheat.PreheatImageWithLimit(image); err != nil {
-					log.Error().Err(err).Str("image", image).Msg("预热镜像失败")
-				} else {
-					// 新增：预热成功后维护digest
-					preheat.GetPreheatedDigestManager().UpdateDigests(image)
-				}
-			}(img)
-		}
-		wg.Wait()
-		log.Info().Msg("本轮批量镜像预热结束")
+			// 拉取策略 Always/IfChanged：本地已存在时回源刷新（IfChanged 仅在 digest 变化时）
+			queue.Add(entry, exists)
+		}
+	}
+}
+
+// localPlatformMatches 判断本地镜像平台是否为条目应拉取的平台，无法获取平台时视为一致
+func localPlatformMatches(ctx context.Context, entry config.ImageEntry) bool {
+	platform := entry.TargetPlatform()
+	local, err := preheat.CheckImagePlatform(ctx, entry.Image, platform)
+	if errors.Is(err, preheat.ErrPlatformMismatch) {
+		log.Warn().Str("image", entry.Image).Str("local_platform", local).Str("platform", platform).Msg("本地镜像平台不一致，回源刷新")
+		return false
+	}
+	if err != nil {
+		log.Debug().Err(err).Str("image", entry.Image).Msg("获取本地镜像平台失败，跳过平台校验")
+	}
+	return true
+}
+
+// dueEntries 过滤出本节点本轮需要处理的条目：平台与节点标签匹配、调度计划已到期，同名镜像只保留第一项
+func dueEntries(ctx context.Context, entries []config.ImageEntry, lastRun map[string]time.Time, now time.Time) []config.ImageEntry {
+	labels := nodeLabels(ctx)
+	listed := make(map[string]bool, len(entries))
+	var due []config.ImageEntry
+	for _, entry := range entries {
+		if entry.Image == "" || listed[entry.Image] {
+			continue
+		}
+		listed[entry.Image] = true
+		if !entry.MatchesPlatform() {
+			log.Debug().Str("image", entry.Image).Str("platform", entry.Platform).Msg("镜像平台与本节点不一致，跳过")
+			continue
+		}
+		if !entry.MatchesNode(labels) {
+			log.Debug().Str("image", entry.Image).Interface("node_selector", entry.NodeSelector).Str("node_label_selector", entry.NodeLabelSelector).Msg("镜像不面向本节点，跳过")
+			continue
+		}
+		if next := entry.NextRun(lastRun[entry.Image]); now.Before(next) {
+			log.Debug().Str("image", entry.Image).Time("next_run", next).Msg("未到调度时间，跳过")
+			continue
+		}
+		due = append(due, entry)
+	}
+	return due
+}
+
+// nodeLabels 读取本节点 Node 对象的标签；读取失败时使用缓存，无缓存时退化为本地可确定的常用标签
+func nodeLabels(ctx context.Context) map[string]string {
+	labels, err := preheat.GetNodeLabels(ctx)
+	if err == nil {
+		return labels
+	}
+	if labels != nil {
+		log.Warn().Err(err).Msg("获取节点标签失败，使用缓存的节点标签")
+		return labels
+	}
+	log.Warn().Err(err).Msg("获取节点标签失败，仅使用本地可确定的节点标签")
+	return localNodeLabels()
+}
+
+// localNodeLabels kubelet 设置的、可在本地确定的常用标签
+func localNodeLabels() map[string]string {
+	goos, arch, _, err := config.ParsePlatform(config.NodePlatform)
+	if err != nil {
+		goos, arch = runtime.GOOS, runtime.GOARCH
+	}
+	return map[string]string{
+		"kubernetes.io/hostname": config.NodeName,
+		"kubernetes.io/os":       goos,
+		"kubernetes.io/arch":     arch,
 	}
 }
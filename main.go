@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"image-preheat/internal/api"
 	"image-preheat/internal/config"
 	"image-preheat/internal/docker"
 	"image-preheat/internal/metrics"
 	"image-preheat/internal/preheat"
 	"image-preheat/internal/task"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -18,41 +23,111 @@ import (
 func main() {
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 	log.Logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).With().Timestamp().Logger()
+	// SIGTERM/SIGINT 时取消 ctx，停止后台任务并进入优雅退出
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 	// 初始化 Docker 客户端
 	if err := docker.InitDockerClient(); err != nil {
 		log.Fatal().Err(err).Msg("Docker 客户端初始化失败")
 	}
+	if err := docker.InitRegistryAuth(); err != nil {
+		log.Fatal().Err(err).Msg("镜像仓库凭据初始化失败")
+	}
 
 	// 初始化全局下载限速桶
 	preheat.InitDownloadRateLimit(int64(config.DownloadRateLimit))
+	// 初始化节点间下载产物缓存（支持续传）
+	preheat.InitDownloadCache()
 
 	cache := config.NewImageListCache(config.ImageListPath)
 	go cache.WatchAndUpdate()
 
 	// 启动 peer 发现服务
-	go preheat.StartPeerDiscovery() // 每30秒更新一次 peers
+	go preheat.StartPeerDiscovery(ctx) // 每30秒更新一次 peers
 
-	go task.StartPeriodicCheck(cache, config.Interval)
+	task.GetJobManager().SetContext(ctx)
 
+	// 定时任务依赖 K8s 客户端（节点标签、回源锁），需先初始化
 	if err := preheat.InitK8sLock(); err != nil {
 		log.Fatal().Err(err).Msg("K8s 分布式锁初始化失败")
 	}
 
+	periodicDone := make(chan struct{})
+	go func() {
+		defer close(periodicDone)
+		task.StartPeriodicCheck(ctx, cache, config.Interval)
+	}()
+
+	if config.PreheatJobEnabled {
+		go task.StartPreheatJobController(ctx)
+	}
+
 	metrics.InitMetrics()
 
+	tlsConfig, err := preheat.InitPeerTLS(ctx)
+	if err != nil {
+		log.Fatal().Err(err).Msg("节点间 mTLS 初始化失败")
+	}
+
+	if err := api.InitAuth(); err != nil {
+		log.Fatal().Err(err).Msg("HTTP API 鉴权初始化失败")
+	}
+
 	r := gin.Default()
+	r.Use(api.AuthMiddleware())
 	r.GET("/health", api.HealthCheckHandlerGin)
-	r.GET("/images/check", api.ImageCheckHandlerGin)
-	r.GET("/images/download", api.ImageDownloadHandlerGin)
+	// 节点间接口，开启 mTLS 时校验 peer 身份
+	peers := r.Group("/", api.PeerAuthMiddleware())
+	peers.GET("/images/check", api.ImageCheckHandlerGin)
+	peers.GET("/images/download", api.ImageDownloadHandlerGin)
+	peers.GET("/images/layers", api.ImageLayersHandlerGin)
+	peers.POST("/layers/check", api.LayersCheckHandlerGin)
+	r.GET("/images/progress", api.PullProgressHandlerGin)
+	r.POST("/images/preheat", api.PreheatHandlerGin)
+	r.GET("/jobs/:id", api.JobHandlerGin)
+	r.GET("/images/gc", api.GCReportHandlerGin)
 	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
 
+	srv := &http.Server{Addr: ":8080", Handler: r, TLSConfig: tlsConfig}
 	go func() {
-		log.Info().Msg("Gin HTTP 服务启动于 :8080 ...")
-		err := r.Run(":8080")
-		if err != nil {
+		log.Info().Bool("tls", tlsConfig != nil).Msg("Gin HTTP 服务启动于 :8080 ...")
+		var err error
+		if tlsConfig != nil {
+			// 证书由 TLSConfig 回调提供
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatal().Err(err).Msg("Gin HTTP 服务启动失败")
 		}
 	}()
 
-	select {}
+	<-ctx.Done()
+	stop()
+	shutdown(srv, periodicDone)
+}
+
+// shutdown 优雅退出：停止接收新请求并等待进行中的节点间下载完成（最长 SHUTDOWN_TIMEOUT），
+// 等待被取消的预热任务收尾，最后释放仍持有的回源锁
+func shutdown(srv *http.Server, periodicDone <-chan struct{}) {
+	log.Info().Dur("timeout", config.ShutdownTimeout).Int("downloads", preheat.GetCurrentDownloadCount()).Msg("收到退出信号，开始优雅退出")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Warn().Err(err).Int("downloads", preheat.GetCurrentDownloadCount()).Msg("等待下载完成超时，强制关闭 HTTP 服务")
+		srv.Close()
+	} else {
+		log.Info().Msg("HTTP 服务已关闭")
+	}
+
+	select {
+	case <-periodicDone:
+	case <-shutdownCtx.Done():
+		log.Warn().Msg("等待预热任务退出超时")
+	}
+
+	preheat.ReleaseHeldLocks()
+	log.Info().Msg("优雅退出完成")
 }